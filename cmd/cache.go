@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"dt-geo-converter/commands"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var cacheDir string
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect or clear the cache of remote sheets",
+	Long: "The tabs downloaded with --remote are kept in a cache, so that later runs only download the tabs that " +
+		"changed and --offline can rebuild the database without network access. The cache is stored in " +
+		commands.DefaultCacheDir() + " unless --cache-dir is set.",
+	Run: func(cmd *cobra.Command, args []string) {
+		_ = cmd.Help()
+	},
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the cached tabs with their size, sync time and hash",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := commands.PrintCache(commands.NewSheetCache(cacheDir)); err != nil {
+			fmt.Printf("Failed to read the cache: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var cacheClearCmd = &cobra.Command{
+	Use:   "clear [WP...]",
+	Short: "Remove the cached tabs of the given work packages, or of every work package",
+	Run: func(cmd *cobra.Command, args []string) {
+		removed, err := commands.NewSheetCache(cacheDir).Clear(args)
+		if err != nil {
+			fmt.Printf("Failed to clear the cache: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed %d cached tabs.\n", removed)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheListCmd, cacheClearCmd)
+	rootCmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", "", "Directory of the cache of remote sheets (default "+commands.DefaultCacheDir()+")")
+}
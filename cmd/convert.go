@@ -12,17 +12,61 @@ var (
 	convertDBFile string
 	workflowID    string
 	convertAll    bool
+	convertCheck  bool
+	convertMeta   string
 )
 
 var convertCmd = &cobra.Command{
 	Use:   "convert",
 	Short: "Convert workflow(s) from the database into CWL and generate workflow graphs",
+	Long: "Convert workflow(s) from the database into CWL and generate workflow graphs, written to ./workflows.\n\n" +
+		"With --check, nothing is written: the conversion output is compared with ./workflows, e.g. in CI, and the " +
+		"command exits with a non-zero status listing the files that are missing, modified or no longer generated. " +
+		"The conversion logs are not compared. Converting removes the files that are no longer generated, and with --all " +
+		"the directories of workflows that are no longer in the database; --all also converts and checks the meta-workflows " +
+		"found in ./workflows.\n\n" +
+		"The workflows declared part of a converted workflow in WF_WF are converted and checked along with it, " +
+		"since its CWL runs them as sub-workflows.\n\n" +
+		"With --meta WF6101, the workflows declared input to WF6101 in WF_WF, directly or through other workflows, are " +
+		"converted along with it, and a meta-workflow running them as sub-workflows is written to ./workflows/meta-WF6101, " +
+		"wiring the outputs of each workflow to the inputs of the next by dataset ID. --meta all does the same for every " +
+		"workflow declared input to another one.",
 	Run: func(cmd *cobra.Command, args []string) {
+		if convertMeta != "" && (convertAll || workflowID != "") {
+			fmt.Println("--meta cannot be combined with --wf or --all.")
+			os.Exit(1)
+		}
+		if convertMeta != "" {
+			if !convertCheck {
+				commands.ConvertMetaWorkflow(convertDBFile, convertMeta)
+				return
+			}
+			stale, err := commands.CheckMetaWorkflow(convertDBFile, convertMeta)
+			if err != nil {
+				fmt.Printf("Error checking the converted workflows: %v\n", err)
+				os.Exit(1)
+			}
+			if stale > 0 {
+				os.Exit(1)
+			}
+			return
+		}
 		if !convertAll && workflowID == "" {
-			fmt.Println("Either --wf or --all must be specified.")
+			fmt.Println("Either --wf, --all or --meta must be specified.")
 			cmd.Help()
 			os.Exit(1)
 		}
+		if convertCheck {
+			stale, err := commands.CheckWorkflows(convertDBFile, workflowID, convertAll)
+			if err != nil {
+				fmt.Printf("Error checking the converted workflows: %v\n", err)
+				os.Exit(1)
+			}
+			if stale > 0 {
+				os.Exit(1)
+			}
+			return
+		}
 		commands.ConvertWorkflows(convertDBFile, workflowID, convertAll)
 	},
 }
@@ -32,4 +76,6 @@ func init() {
 	convertCmd.Flags().StringVar(&convertDBFile, "db", "./db.db", "Path to the database file (optional)")
 	convertCmd.Flags().StringVar(&workflowID, "wf", "", "Workflow ID to process. Use --all to process all workflows.")
 	convertCmd.Flags().BoolVar(&convertAll, "all", false, "Convert all workflows in the database")
+	convertCmd.Flags().StringVar(&convertMeta, "meta", "", "Workflow ID to generate the meta-workflow of, running it and the workflows declared input to it, or 'all'")
+	convertCmd.Flags().BoolVar(&convertCheck, "check", false, "Compare the conversion output with ./workflows without writing it, and fail if it differs")
 }
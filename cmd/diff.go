@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"dt-geo-converter/commands"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffFormat string
+	diffOut    string
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff-db OLD_DB NEW_DB",
+	Short: "Report the differences between two databases",
+	Long: "Compare two databases, e.g. before and after an import, and report the workflows, relationships and " +
+		"dataset, step and software service attributes that were added, removed or changed, grouped by work " +
+		"package and workflow. A relationship whose type changed is reported as changed.",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := commands.DiffDatabases(args[0], args[1], diffFormat, diffOut); err != nil {
+			fmt.Printf("Error comparing databases: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringVar(&diffFormat, "format", "text", "Output format: "+strings.Join(commands.DiffFormats, ", "))
+	diffCmd.Flags().StringVar(&diffOut, "out", "", "File to write the report to instead of the standard output (optional)")
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"dt-geo-converter/commands"
+	"dt-geo-converter/vocabulary"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportDBFile string
+	exportOut    string
+	exportVocab  string
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export-csv",
+	Short: "Export the database to CSV files",
+	Long: "Export the database to one directory of CSV files per work package, with the layout read by init-db. " +
+		"Values are trimmed, relationship types use their canonical text, and rows are sorted and de-duplicated, " +
+		"so importing the export gives back the same data.",
+	Run: func(cmd *cobra.Command, args []string) {
+		vocab, err := vocabulary.Load(exportVocab)
+		if err != nil {
+			fmt.Printf("Failed to load the relationship vocabulary: %v\n", err)
+			os.Exit(1)
+		}
+		if err := commands.ExportCSV(exportDBFile, exportOut, vocab); err != nil {
+			fmt.Printf("Error exporting database: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Database exported to: %s\n", exportOut)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVar(&exportDBFile, "db", "./db.db", "Path to the database file")
+	exportCmd.Flags().StringVar(&exportOut, "out", "./export", "Directory to write the CSV files to")
+	exportCmd.Flags().StringVar(&exportVocab, "vocabulary", "", "YAML file extending the built-in relationship vocabulary, as used to import the data (optional)")
+}
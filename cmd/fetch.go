@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"dt-geo-converter/commands"
+	"dt-geo-converter/logger"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	fetchRemote  string
+	fetchOut     string
+	fetchOffline bool
+)
+
+var fetchCmd = &cobra.Command{
+	Use:   "fetch",
+	Short: "Save the remote spreadsheets as CSV files",
+	Long: "Download the remote spreadsheets into a snapshot laid out as expected by 'init-db --dir': one directory per " +
+		"work package, plus a manifest.json with the spreadsheet IDs, gids, fetch times and SHA-256 hash of each file. " +
+		"If --out ends with .zip, .tar.gz or .tgz, the snapshot is written as an archive, which init-db and validate also accept.",
+	Run: func(cmd *cobra.Command, args []string) {
+		dir := downloadRemote(fetchRemote, fetchOffline)
+		defer func() {
+			if err := os.RemoveAll(dir); err != nil {
+				logger.Error("Warning: failed to clean up temporary directory", dir, ":", err)
+			}
+		}()
+
+		if err := commands.SaveSnapshot(dir, fetchOut); err != nil {
+			fmt.Printf("Failed to save the snapshot: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Snapshot saved to %s\n", fetchOut)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fetchCmd)
+	addRemoteFlag(fetchCmd, &fetchRemote, "Fetch the remote spreadsheets in the DT-GEO Google Drive.")
+	fetchCmd.Flags().StringVar(&fetchOut, "out", "", "Directory, or .zip, .tar.gz or .tgz archive, to write the snapshot to")
+	fetchCmd.Flags().BoolVar(&fetchOffline, "offline", false, "Use the copies of the remote sheets kept in the cache instead of downloading them")
+	_ = fetchCmd.MarkFlagRequired("remote")
+	_ = fetchCmd.MarkFlagRequired("out")
+}
+
+// extractArchive extracts a snapshot archive into a temporary directory, exiting on error.
+func extractArchive(archive string) string {
+	dir, err := commands.ExtractArchive(archive)
+	if err != nil {
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+		fmt.Printf("Failed to extract %s: %v\n", archive, err)
+		os.Exit(1)
+	}
+	return dir
+}
@@ -2,64 +2,54 @@ package cmd
 
 import (
 	"dt-geo-converter/commands"
-	"dt-geo-converter/logger"
+	"dt-geo-converter/vocabulary"
 	"fmt"
 	"os"
-	"strings"
 
 	"github.com/spf13/cobra"
 )
 
 var (
-	initDBFile string
-	initDir    string
-	initUpdate bool
-	initRemote string
+	initDBFile     string
+	initDirs       []string
+	initURLs       []string
+	initUpdate     bool
+	initRemote     string
+	initVocab      string
+	initBestEffort bool
+	initWorkbooks  []string
+	initOffline    bool
 )
 
 var initDBCmd = &cobra.Command{
 	Use:   "init-db",
 	Short: "Initialize the database with CSV data",
-	Long:  "Initialize the database with CSV data from local directory or remote Google Sheets",
+	Long: "Initialize the database with CSV data from local directories, snapshot archives, web servers, workbooks or remote Google Sheets. " +
+		"Sources can be combined: each file of a work package is taken from the last source providing it, in the order " +
+		"--remote, --url, --dir, --workbook, so that e.g. a local folder with corrected files overrides the downloaded ones. " +
+		"When updating an existing database, only the work packages being imported are replaced. " +
+		"The import is all-or-nothing: a missing or malformed file leaves the database unchanged, unless --best-effort is set.",
 	Run: func(cmd *cobra.Command, args []string) {
 		// Check if database file already exists and handle accordingly
 		if _, err := os.Stat(initDBFile); err == nil && !initUpdate {
-			fmt.Printf("Database file already exists at %s. Use --update flag to overwrite it.\n", initDBFile)
+			fmt.Printf("Database file already exists at %s. Use --update flag to update it.\n", initDBFile)
 			os.Exit(1)
 		}
 
-		if initRemote != "" {
-
-			remotes, err := parseRemoteFlag()
-			if err != nil {
-				fmt.Printf("Failed to parse the --remote flag: %v\n", err)
-				os.Exit(1)
-			}
-			initDir, err = commands.DownloadRemoteSheets(remotes)
-			if err != nil {
-				fmt.Printf("Failed to download remote sheets: %v\n", err)
-				os.Exit(1)
-			}
-			// Ensure we clean up the temporary directory when done.
-			defer func() {
-				if err := os.RemoveAll(initDir); err != nil {
-					logger.Error("Warning: failed to clean up temporary directory %s: %v", initDir, err)
-				}
-				logger.Debug("Successfully removed temp dir")
-			}()
-		} else if initDir == "" {
-			fmt.Println("The --dir flag is required if not using --remote.")
-			_ = cmd.Help()
+		vocab, err := vocabulary.Load(initVocab)
+		if err != nil {
+			fmt.Printf("Failed to load the relationship vocabulary: %v\n", err)
 			os.Exit(1)
 		}
 
-		// Verify the directory exists
-		if _, err := os.Stat(initDir); os.IsNotExist(err) {
-			fmt.Printf("Directory does not exist: %s\n", initDir)
+		sources := initSources()
+		if len(sources) == 0 {
+			fmt.Println("One of the --dir, --remote, --url or --workbook flags is required.")
+			_ = cmd.Help()
 			os.Exit(1)
 		}
 
-		err := commands.InitDatabase(initDBFile, initDir, initUpdate)
+		err = commands.InitDatabase(initDBFile, sources, vocab, initBestEffort)
 		if err != nil {
 			fmt.Printf("Error initializing database: %v\n", err)
 			os.Exit(1)
@@ -70,56 +60,47 @@ var initDBCmd = &cobra.Command{
 }
 
 func init() {
-	// Dynamically retrieve available work packages for help text.
-	availableWPs := commands.GetAvailableWPs()
-	helpMsg := fmt.Sprintf(
-		"Initialize the database using the remote spreadsheets in the DT-GEO Google Drive. "+
-			"Allowed values: 'all' or a comma-separated list from [%s]. Use '--remote all' to load all available work packages.",
-		strings.Join(availableWPs, ", "))
-
 	rootCmd.AddCommand(initDBCmd)
 	// Define and document all flags
 	initDBCmd.Flags().StringVar(&initDBFile, "db", "./db.db", "Path to the database file")
-	initDBCmd.Flags().StringVar(&initDir, "dir", "", "Directory containing CSV files or subdirectories with CSV files")
-	initDBCmd.Flags().BoolVar(&initUpdate, "update", false, "Reset and reinitialize the database if it exists")
-	initDBCmd.Flags().StringVar(&initRemote, "remote", "", helpMsg)
-
-	// Mark flags as mutually exclusive
-	initDBCmd.MarkFlagsMutuallyExclusive("dir", "remote")
+	initDBCmd.Flags().StringArrayVar(&initDirs, "dir", nil, "Directory containing CSV files or subdirectories with CSV files, or a .zip, .tar.gz or .tgz snapshot written by fetch (repeatable)")
+	initDBCmd.Flags().BoolVar(&initUpdate, "update", false, "Update an existing database, replacing only the rows of the imported work packages")
+	addRemoteFlag(initDBCmd, &initRemote, "Initialize the database using the remote spreadsheets in the DT-GEO Google Drive.")
+	initDBCmd.Flags().StringArrayVar(&initURLs, "url", nil, "Base URL of a snapshot written by fetch and published on a web server, i.e. of the directory holding its manifest.json (repeatable)")
+	initDBCmd.Flags().BoolVar(&initOffline, "offline", false, "With --remote, use the copies of the remote sheets kept in the cache instead of downloading them")
+	initDBCmd.Flags().StringVar(&initVocab, "vocabulary", "", "YAML file extending the built-in relationship vocabulary (optional)")
+	initDBCmd.Flags().StringSliceVar(&initWorkbooks, "workbook", nil, "Spreadsheet files (.xlsx or .ods) to import, one per work package named after the file, e.g. WP5.xlsx (repeatable or comma-separated)")
+	initDBCmd.Flags().BoolVar(&initBestEffort, "best-effort", false, "Import what can be read: keep the rows before a malformed line and skip failing work packages instead of rolling back")
 }
 
-func parseRemoteFlag() ([]string, error) {
-	// Clean up the remote flag value and split it
-	remoteVal := strings.TrimSpace(initRemote)
-	var remotes []string
-
-	// If the value is "all" (case-insensitive), use that directly.
-	if strings.EqualFold(remoteVal, "all") {
-		remotes = []string{"all"}
-	} else {
-		// Split on commas and trim spaces from each remote key.
-		parts := strings.Split(remoteVal, ",")
-		for _, p := range parts {
-			trimmed := strings.TrimSpace(p)
-			if trimmed != "" {
-				remotes = append(remotes, trimmed)
-			}
-		}
-		if len(remotes) == 0 {
-			return nil, fmt.Errorf("error: invalid --remote flag value")
-		}
-		// Retrieve available work packages dynamically.
-		availableWPs := commands.GetAvailableWPs()
-		allowed := make(map[string]bool)
-		for _, wp := range availableWPs {
-			allowed[wp] = true
+// initSources returns the sources selected by the flags of init-db, from the lowest
+// to the highest precedence.
+func initSources() []commands.Source {
+	var sources []commands.Source
+	if initRemote != "" {
+		registry := loadRegistry()
+		remotes, err := parseRemoteFlag(registry, initRemote)
+		if err != nil {
+			fmt.Printf("Failed to parse the --remote flag: %v\n", err)
+			os.Exit(1)
 		}
-		// Validate each provided remote value.
-		for _, r := range remotes {
-			if !allowed[r] {
-				return nil, fmt.Errorf("error: unknown remote value '%s'. Allowed values are 'all' or one of [%s]", r, strings.Join(availableWPs, ", "))
-			}
+		sources = append(sources, &commands.RemoteSource{Registry: registry, WorkPackages: remotes, Downloader: newDownloader(initOffline)})
+	} else if initOffline {
+		fmt.Println("The --offline flag can only be used with --remote.")
+		os.Exit(1)
+	}
+	for _, url := range initURLs {
+		sources = append(sources, &commands.HTTPSource{BaseURL: url, Downloader: commands.NewDownloader()})
+	}
+	for _, dir := range initDirs {
+		if commands.IsArchive(dir) {
+			sources = append(sources, &commands.ArchiveSource{Path: dir})
+		} else {
+			sources = append(sources, &commands.DirSource{Dir: dir})
 		}
 	}
-	return remotes, nil
+	if len(initWorkbooks) > 0 {
+		sources = append(sources, &commands.WorkbookSource{Paths: initWorkbooks})
+	}
+	return sources
 }
@@ -6,17 +6,21 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var listDBFile string
+var (
+	listDBFile     string
+	listProvenance bool
+)
 
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List workflows available in the database",
 	Run: func(cmd *cobra.Command, args []string) {
-		commands.ListWorkflows(listDBFile)
+		commands.ListWorkflows(listDBFile, listProvenance)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(listCmd)
 	listCmd.Flags().StringVar(&listDBFile, "db", "./db.db", "Path to the database file (optional)")
+	listCmd.Flags().BoolVar(&listProvenance, "provenance", false, "Show the work package and import run each workflow came from")
 }
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"dt-geo-converter/commands"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateDBFile string
+	migrateDryRun bool
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade an existing database to the schema of this release",
+	Long:  "Upgrade an existing database in place by applying the pending schema migrations. Use --dry-run to only list them.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := commands.MigrateDatabase(migrateDBFile, migrateDryRun); err != nil {
+			fmt.Printf("Error migrating database: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.Flags().StringVar(&migrateDBFile, "db", "./db.db", "Path to the database file")
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "List the pending migrations without applying them")
+}
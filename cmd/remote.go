@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"dt-geo-converter/commands"
+	"dt-geo-converter/googleauth"
+	"dt-geo-converter/logger"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	registryFile    string
+	credentialsFile string
+)
+
+var remoteCmd = &cobra.Command{
+	Use:   "remote",
+	Short: "Inspect the registry of remote spreadsheets",
+	Long: "Inspect the registry of remote Google Sheets used by --remote. The registry is read from the file given by " +
+		"--registry, or from " + commands.RegistryConfigPath() + " when it exists, and defaults to the built-in list.",
+	Run: func(cmd *cobra.Command, args []string) {
+		_ = cmd.Help()
+	},
+}
+
+var remoteListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the remote spreadsheets of the active registry",
+	Run: func(cmd *cobra.Command, args []string) {
+		commands.PrintRegistry(loadRegistry())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(remoteCmd)
+	remoteCmd.AddCommand(remoteListCmd)
+	rootCmd.PersistentFlags().StringVar(&registryFile, "registry", "", "YAML or JSON file listing the remote spreadsheets (optional)")
+	rootCmd.PersistentFlags().StringVar(&credentialsFile, "credentials", "", "Service account key or OAuth token file giving access to private spreadsheets "+
+		"(default: the content of $"+googleauth.EnvContent+" or the file named by $"+googleauth.EnvFile+")")
+
+	// Flags are parsed before help is shown, so the --remote help text can list the
+	// work packages of the registry selected with --registry.
+	defaultHelp := rootCmd.HelpFunc()
+	rootCmd.SetHelpFunc(func(cmd *cobra.Command, args []string) {
+		if flag := cmd.Flags().Lookup("remote"); flag != nil {
+			if registry, err := commands.LoadRegistry(registryFile); err == nil {
+				flag.Usage = remoteUsage(flag.Annotations[remotePurpose][0], registry.Names())
+			}
+		}
+		defaultHelp(cmd, args)
+	})
+}
+
+// remotePurpose annotates --remote flags with the first sentence of their help text.
+const remotePurpose = "remote-purpose"
+
+// addRemoteFlag defines the --remote flag of a command.
+func addRemoteFlag(cmd *cobra.Command, value *string, purpose string) {
+	var names []string
+	if registry, err := commands.LoadRegistry(""); err == nil {
+		names = registry.Names()
+	}
+	cmd.Flags().StringVar(value, "remote", "", remoteUsage(purpose, names))
+	_ = cmd.Flags().SetAnnotation("remote", remotePurpose, []string{purpose})
+}
+
+// remoteUsage builds the help text of a --remote flag.
+func remoteUsage(purpose string, names []string) string {
+	return fmt.Sprintf("%s Allowed values: 'all' or a comma-separated list from [%s]. Use 'remote list' to show the registry.",
+		purpose, strings.Join(names, ", "))
+}
+
+// loadRegistry returns the registry selected by --registry, exiting on error.
+func loadRegistry() *commands.Registry {
+	registry, err := commands.LoadRegistry(registryFile)
+	if err != nil {
+		fmt.Printf("Failed to load the remote registry: %v\n", err)
+		os.Exit(1)
+	}
+	return registry
+}
+
+// downloadRemote downloads the work packages selected by a --remote flag value into a
+// temporary directory, exiting on error. The tabs are kept in the sheet cache.
+func downloadRemote(value string, offline bool) string {
+	registry := loadRegistry()
+	remotes, err := parseRemoteFlag(registry, value)
+	if err != nil {
+		fmt.Printf("Failed to parse the --remote flag: %v\n", err)
+		os.Exit(1)
+	}
+	dir, err := newDownloader(offline).Download(registry, remotes)
+	if err != nil {
+		fmt.Printf("Failed to download remote sheets: %v\n", err)
+		os.Exit(1)
+	}
+	return dir
+}
+
+// newDownloader returns a Downloader for Google Sheets keeping the tabs in the sheet
+// cache, authenticated with the credentials given by --credentials or the environment.
+func newDownloader(offline bool) *commands.Downloader {
+	downloader := commands.NewDownloader()
+	downloader.Cache = commands.NewSheetCache(cacheDir)
+	downloader.Offline = offline
+	if offline {
+		return downloader
+	}
+
+	credentials, err := googleauth.FromEnv()
+	if credentialsFile != "" {
+		credentials, err = googleauth.Load(credentialsFile)
+	}
+	if err != nil {
+		fmt.Printf("Failed to load the Google credentials: %v\n", err)
+		os.Exit(1)
+	}
+	if credentials != nil {
+		logger.Info("Authenticating to Google with the", credentials)
+		downloader.Client = credentials.Client(downloader.Client)
+	}
+	return downloader
+}
+
+// parseRemoteFlag returns the work packages selected by a --remote flag value.
+func parseRemoteFlag(registry *commands.Registry, value string) ([]string, error) {
+	// Clean up the remote flag value and split it
+	remoteVal := strings.TrimSpace(value)
+	var remotes []string
+
+	// If the value is "all" (case-insensitive), use that directly.
+	if strings.EqualFold(remoteVal, "all") {
+		remotes = []string{"all"}
+	} else {
+		// Split on commas and trim spaces from each remote key.
+		parts := strings.Split(remoteVal, ",")
+		for _, p := range parts {
+			trimmed := strings.TrimSpace(p)
+			if trimmed != "" {
+				remotes = append(remotes, trimmed)
+			}
+		}
+		if len(remotes) == 0 {
+			return nil, fmt.Errorf("error: invalid --remote flag value")
+		}
+		// Retrieve available work packages dynamically.
+		availableWPs := registry.Names()
+		allowed := make(map[string]bool)
+		for _, wp := range availableWPs {
+			allowed[wp] = true
+		}
+		// Validate each provided remote value.
+		for _, r := range remotes {
+			if !allowed[r] {
+				return nil, fmt.Errorf("error: unknown remote value '%s'. Allowed values are 'all' or one of [%s]", r, strings.Join(availableWPs, ", "))
+			}
+		}
+	}
+	return remotes, nil
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"dt-geo-converter/commands"
+	"dt-geo-converter/logger"
+	"dt-geo-converter/vocabulary"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	validateDir     string
+	validateRemote  string
+	validateVocab   string
+	validateOffline bool
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the CSV data for errors without importing it",
+	Long: "Check the CSV data from a local directory or remote Google Sheets for dangling references, " +
+		"IDs in the wrong column, unknown relationship types, stray whitespace, duplicate rows and short rows. " +
+		"Issues are reported per work package and file with their line numbers. " +
+		"The command exits with a non-zero status when errors are found.",
+	Run: func(cmd *cobra.Command, args []string) {
+		vocab, err := vocabulary.Load(validateVocab)
+		if err != nil {
+			fmt.Printf("Failed to load the relationship vocabulary: %v\n", err)
+			os.Exit(1)
+		}
+
+		dir := validateDir
+		var delimiter rune
+		if validateRemote != "" {
+			dir = downloadRemote(validateRemote, validateOffline)
+			// Google Sheets exports comma-separated files.
+			delimiter = ','
+
+			defer func() {
+				if err := os.RemoveAll(dir); err != nil {
+					logger.Error("Warning: failed to clean up temporary directory", dir, ":", err)
+				}
+			}()
+		} else if validateOffline {
+			fmt.Println("The --offline flag can only be used with --remote.")
+			os.Exit(1)
+		} else if dir == "" {
+			fmt.Println("The --dir flag is required if not using --remote.")
+			_ = cmd.Help()
+			os.Exit(1)
+		}
+
+		if commands.IsArchive(dir) {
+			dir = extractArchive(dir)
+			defer os.RemoveAll(dir)
+		}
+
+		errorCount, err := commands.ValidateCSV(dir, vocab, delimiter)
+		if err != nil {
+			fmt.Printf("Error validating CSV data: %v\n", err)
+			os.Exit(1)
+		}
+		if errorCount > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+	validateCmd.Flags().StringVar(&validateDir, "dir", "", "Directory containing CSV files or subdirectories with CSV files, or a .zip, .tar.gz or .tgz snapshot written by fetch")
+	addRemoteFlag(validateCmd, &validateRemote, "Validate the remote spreadsheets in the DT-GEO Google Drive.")
+	validateCmd.Flags().BoolVar(&validateOffline, "offline", false, "With --remote, use the copies of the remote sheets kept in the cache instead of downloading them")
+	validateCmd.Flags().StringVar(&validateVocab, "vocabulary", "", "YAML file extending the built-in relationship vocabulary (optional)")
+
+	validateCmd.MarkFlagsMutuallyExclusive("dir", "remote")
+}
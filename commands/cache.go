@@ -0,0 +1,220 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"dt-geo-converter/logger"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// errNotCached is returned in offline mode for a tab that is not in the cache.
+var errNotCached = errors.New("not in the cache, run once without --offline to fill it")
+
+// SheetCache keeps the last downloaded copy of every remote tab, so that unchanged
+// tabs are not downloaded again and the database can be rebuilt offline. Tabs are
+// stored under a directory per spreadsheet ID, named after their gid, or after
+// their name when they are looked up by name. Each tab has a .csv file with its
+// content and a .json file with its CacheEntry.
+type SheetCache struct {
+	Dir string
+}
+
+// CacheEntry describes a cached tab.
+type CacheEntry struct {
+	Spreadsheet   string `json:"spreadsheet"`
+	SpreadsheetID string `json:"spreadsheet_id"`
+	Tab           string `json:"tab"`
+	Gid           string `json:"gid,omitempty"`
+	URL           string `json:"url"`
+	// ETag and LastModified are the validators of the response, sent back to only
+	// download the tab again when it changed.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	SHA256       string `json:"sha256"`
+	Size         int    `json:"size"`
+	// Synced is the last time the content was downloaded or confirmed unchanged.
+	Synced time.Time `json:"synced"`
+}
+
+// DefaultCacheDir returns the cache directory used when none is given explicitly,
+// e.g. ~/.cache/dt-geo-converter/sheets on Linux.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "dt-geo-converter", "sheets")
+	}
+	return filepath.Join(dir, "dt-geo-converter", "sheets")
+}
+
+// NewSheetCache returns the cache in dir, or in DefaultCacheDir if dir is empty.
+func NewSheetCache(dir string) *SheetCache {
+	if dir == "" {
+		dir = DefaultCacheDir()
+	}
+	return &SheetCache{Dir: dir}
+}
+
+// path returns the path of a cached tab, without extension.
+func (c *SheetCache) path(spreadsheetID string, sheet Sheet) string {
+	key := sheet.Gid
+	if key == "" {
+		key = "name-" + sheet.Name
+	}
+	return filepath.Join(c.Dir, url.PathEscape(spreadsheetID), url.PathEscape(key))
+}
+
+// load returns a cached tab and its content, or nil if it is not cached or its
+// content does not match the recorded hash.
+func (c *SheetCache) load(spreadsheetID string, sheet Sheet) (*CacheEntry, []byte) {
+	path := c.path(spreadsheetID, sheet)
+	entry, err := readCacheEntry(path + ".json")
+	if err != nil {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path + ".csv")
+	if err != nil || hashOf(data) != entry.SHA256 {
+		return nil, nil
+	}
+	return entry, data
+}
+
+// store saves a tab and its entry, filling in the hash, size and sync time.
+func (c *SheetCache) store(entry CacheEntry, data []byte) error {
+	path := c.path(entry.SpreadsheetID, Sheet{Name: entry.Tab, Gid: entry.Gid})
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	entry.SHA256 = hashOf(data)
+	entry.Size = len(data)
+	entry.Synced = time.Now().UTC()
+	meta, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The content is written first: an entry without matching content is ignored.
+	if err := os.WriteFile(path+".csv", data, 0644); err != nil {
+		return fmt.Errorf("failed to write cached tab: %w", err)
+	}
+	if err := os.WriteFile(path+".json", meta, 0644); err != nil {
+		return fmt.Errorf("failed to write cached tab: %w", err)
+	}
+	return nil
+}
+
+// Entries returns the cached tabs, sorted by spreadsheet and tab name.
+func (c *SheetCache) Entries() ([]CacheEntry, error) {
+	var entries []CacheEntry
+	err := filepath.WalkDir(c.Dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fs.SkipAll
+		}
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".json" {
+			return err
+		}
+		entry, err := readCacheEntry(path)
+		if err != nil {
+			logger.Warning("Ignoring", err)
+			return nil
+		}
+		entries = append(entries, *entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache %s: %w", c.Dir, err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Spreadsheet != entries[j].Spreadsheet {
+			return entries[i].Spreadsheet < entries[j].Spreadsheet
+		}
+		return entries[i].Tab < entries[j].Tab
+	})
+	return entries, nil
+}
+
+// Clear removes the cached tabs of the named spreadsheets, or of every spreadsheet
+// if no name is given, and returns the number of tabs removed. Only the files of
+// the cached tabs are removed, and the directories they leave empty: the cache
+// directory may be shared with other files.
+func (c *SheetCache) Clear(names []string) (int, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	dirs := make(map[string]bool)
+	for _, entry := range entries {
+		if len(names) > 0 && !slices.ContainsFunc(names, func(name string) bool { return strings.EqualFold(name, entry.Spreadsheet) }) {
+			continue
+		}
+		path := c.path(entry.SpreadsheetID, Sheet{Name: entry.Tab, Gid: entry.Gid})
+		for _, ext := range []string{".json", ".csv"} {
+			if err := os.Remove(path + ext); err != nil && !os.IsNotExist(err) {
+				return removed, fmt.Errorf("failed to remove cached tab: %w", err)
+			}
+		}
+		dirs[filepath.Dir(path)] = true
+		removed++
+	}
+	for _, dir := range append(slices.Sorted(maps.Keys(dirs)), c.Dir) {
+		removeIfEmpty(dir)
+	}
+	return removed, nil
+}
+
+// removeIfEmpty removes a directory if it holds no file.
+func removeIfEmpty(dir string) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+		if err := os.Remove(dir); err != nil {
+			logger.Debug("Failed to remove empty cache directory", dir, ":", err)
+		}
+	}
+}
+
+// PrintCache prints the cached tabs of a cache.
+func PrintCache(c *SheetCache) error {
+	entries, err := c.Entries()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sheet cache (%s):\n", c.Dir)
+	if len(entries) == 0 {
+		fmt.Println("The cache is empty.")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WP\tTAB\tGID\tSIZE\tSYNCED\tSHA256")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", entry.Spreadsheet, entry.Tab, entry.Gid, entry.Size,
+			entry.Synced.Local().Format("2006-01-02 15:04"), entry.SHA256[:min(12, len(entry.SHA256))])
+	}
+	return w.Flush()
+}
+
+func readCacheEntry(filename string) (*CacheEntry, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("invalid cache entry %s: %w", filename, err)
+	}
+	return &entry, nil
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
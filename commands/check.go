@@ -0,0 +1,224 @@
+package commands
+
+import (
+	"bytes"
+	"database/sql"
+	"dt-geo-converter/logger"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// uncheckedFiles are the generated files that CheckWorkflows does not compare: the
+// conversion log holds the time of every message.
+var uncheckedFiles = map[string]bool{"log.log": true}
+
+// staleFile is a file of the workflows directory that differs from the conversion
+// output.
+type staleFile struct {
+	Path string
+	// Status is "missing", "modified" or "unexpected".
+	Status string
+	Detail string
+}
+
+// CheckWorkflows converts one or all workflows, along with their components, in
+// memory and compares the result with the workflows directory, without writing
+// anything. It prints the files that are missing, modified, or no longer generated,
+// and returns their number. With 'all', the meta-workflows of the workflows
+// directory are checked too, and the directories of workflows that are no longer in
+// the database are reported.
+func CheckWorkflows(dbFile, workflowID string, all bool) (int, error) {
+	db, err := openDatabase(dbFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	workflows := []string{workflowID}
+	if all {
+		if workflows, err = allWorkflows(db); err != nil {
+			return 0, fmt.Errorf("failed to query workflows: %w", err)
+		}
+	}
+
+	stale, checked, err := checkWorkflows(db, workflows)
+	if err != nil {
+		return 0, err
+	}
+
+	if all {
+		entries, err := os.ReadDir(workflowsDir)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("failed to read directory %s: %w", workflowsDir, err)
+		}
+		for _, entry := range entries {
+			if !slices.Contains(workflows, entry.Name()) && !strings.HasPrefix(entry.Name(), metaPrefix) {
+				stale = append(stale, staleFile{Path: filepath.Join(workflowsDir, entry.Name()), Status: "unexpected", Detail: "not a workflow of the database"})
+			}
+		}
+
+		targets, err := metaWorkflowTargets()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read directory %s: %w", workflowsDir, err)
+		}
+		for _, target := range targets {
+			dir := filepath.Join(workflowsDir, metaPrefix+target)
+			_, files, err := generateMetaWorkflow(db, target)
+			if err != nil {
+				stale = append(stale, staleFile{Path: dir, Status: "unexpected", Detail: "no longer generated: " + err.Error()})
+				continue
+			}
+			dirStale, dirChecked, err := checkDir(dir, files)
+			if err != nil {
+				return 0, err
+			}
+			stale = append(stale, dirStale...)
+			checked += dirChecked
+		}
+	}
+
+	return reportStale(stale, checked), nil
+}
+
+// CheckMetaWorkflow converts a meta-workflow and the workflows taking part in it in
+// memory, as ConvertMetaWorkflow does, and compares the result with the workflows
+// directory like CheckWorkflows.
+func CheckMetaWorkflow(dbFile, target string) (int, error) {
+	db, err := openDatabase(dbFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	workflows, metaFiles, err := generateMetaWorkflow(db, target)
+	if err != nil {
+		return 0, err
+	}
+
+	stale, checked, err := checkWorkflows(db, workflows)
+	if err != nil {
+		return 0, err
+	}
+	dirStale, dirChecked, err := checkDir(filepath.Join(workflowsDir, metaPrefix+target), metaFiles)
+	if err != nil {
+		return 0, err
+	}
+	return reportStale(append(stale, dirStale...), checked+dirChecked), nil
+}
+
+// checkWorkflows converts workflows, and the workflows they run as components, in
+// memory and compares the result with their directories, returning the stale files
+// and the number of files compared.
+func checkWorkflows(db *sql.DB, workflows []string) ([]staleFile, int, error) {
+	var stale []staleFile
+	checked := 0
+	err := withComponents(workflows, func(wf string) ([]string, error) {
+		logger.Info("Checking workflow", wf)
+		files, components, err := generateWorkflow(db, wf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert workflow %s: %w", wf, err)
+		}
+		dirStale, dirChecked, err := checkDir(filepath.Join(workflowsDir, wf), files)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, dirStale...)
+		checked += dirChecked
+		return components, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return stale, checked, nil
+}
+
+// checkDir compares the files generated for a directory of the workflows directory
+// with its content, and returns the stale files and the number of files compared.
+func checkDir(dir string, files map[string][]byte) ([]staleFile, int, error) {
+	var stale []staleFile
+	checked := 0
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if uncheckedFiles[name] {
+			continue
+		}
+		checked++
+		path := filepath.Join(dir, name)
+		current, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			stale = append(stale, staleFile{Path: path, Status: "missing"})
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if !bytes.Equal(current, files[name]) {
+			stale = append(stale, staleFile{Path: path, Status: "modified", Detail: lineChanges(current, files[name])})
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if _, generated := files[entry.Name()]; !generated && !uncheckedFiles[entry.Name()] {
+			stale = append(stale, staleFile{Path: filepath.Join(dir, entry.Name()), Status: "unexpected", Detail: "no longer generated"})
+		}
+	}
+	return stale, checked, nil
+}
+
+// reportStale prints the result of a check, and returns the number of stale files.
+func reportStale(stale []staleFile, checked int) int {
+	if len(stale) == 0 {
+		fmt.Printf("The converted workflows are up to date (%d %s checked).\n", checked, plural(checked, "file"))
+		return 0
+	}
+	fmt.Printf("The converted workflows are out of date (%d %s checked, %d stale), run convert to regenerate them:\n", checked, plural(checked, "file"), len(stale))
+	for _, file := range stale {
+		line := fmt.Sprintf("  %-10s  %s", file.Status, file.Path)
+		if file.Detail != "" {
+			line += " (" + file.Detail + ")"
+		}
+		fmt.Println(line)
+	}
+	return len(stale)
+}
+
+// lineChanges summarizes the difference between two versions of a file: the lines
+// added and removed, regardless of their order, and the first line that differs.
+func lineChanges(before, after []byte) string {
+	oldLines := strings.Split(string(before), "\n")
+	newLines := strings.Split(string(after), "\n")
+
+	first := 0
+	for first < len(oldLines) && first < len(newLines) && oldLines[first] == newLines[first] {
+		first++
+	}
+
+	counts := make(map[string]int)
+	for _, line := range oldLines {
+		counts[line]++
+	}
+	added := 0
+	for _, line := range newLines {
+		if counts[line] > 0 {
+			counts[line]--
+		} else {
+			added++
+		}
+	}
+	removed := 0
+	for _, n := range counts {
+		removed += n
+	}
+
+	if added == 0 && removed == 0 {
+		return fmt.Sprintf("lines reordered from line %d", first+1)
+	}
+	return fmt.Sprintf("+%d -%d %s, from line %d", added, removed, plural(max(added, removed), "line"), first+1)
+}
@@ -1,16 +1,19 @@
 package commands
 
 import (
+	"bytes"
 	"database/sql"
 	"dt-geo-converter/cwl"
 	"dt-geo-converter/implicit"
 	"dt-geo-converter/logger"
+	"dt-geo-converter/model"
 	"dt-geo-converter/rocrate"
-	"encoding/csv"
 	"fmt"
+	"maps"
 	"os"
-	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"text/template"
 
@@ -19,110 +22,97 @@ import (
 	_ "modernc.org/sqlite"
 )
 
-// InitDatabase initializes (or re‑initializes) the database using CSV files.
-// The 'dir' parameter must point to a folder that either contains the CSV files directly,
-// or contains subdirectories where each has the expected CSV files.
-func InitDatabase(dbFile, dir string, update bool) error {
-	logger.Info("Initializing database")
-	// Check if the DB exists.
-	dbExists := false
-	if _, err := os.Stat(dbFile); err == nil {
-		dbExists = true
-	}
-
-	// If update is requested, remove the existing database.
-	if update && dbExists {
-		if err := resetDatabase(dbFile); err != nil {
-			return fmt.Errorf("failed to reset database: %w", err)
-		}
-		dbExists = false
-	}
-
-	// Open the database.
-	db, err := sql.Open("sqlite", dbFile)
-	if err != nil {
-		return fmt.Errorf("failed to open database: %w", err)
-	}
-	defer db.Close()
-
-	// Create tables.
-	if err := createTables(db); err != nil {
-		return fmt.Errorf("failed to create tables: %w", err)
-	}
-
-	// Determine if the provided directory contains CSV files directly
-	// (by checking for a known file, e.g., "wf.csv").
-	if _, err := os.Stat(filepath.Join(dir, "wf.csv")); err == nil {
-		logger.Info("Importing CSV data from directory:", dir)
-		if err := importDataFromCSV(db, dir); err != nil {
-			return fmt.Errorf("failed to import CSV data: %w", err)
-		}
-	} else {
-		// Otherwise, assume it contains subdirectories.
-		entries, err := os.ReadDir(dir)
-		if err != nil {
-			return fmt.Errorf("error reading directory: %w", err)
-		}
-		for _, entry := range entries {
-			if entry.IsDir() {
-				subDir := filepath.Join(dir, entry.Name())
-				logger.Debug("Importing CSV data from subdirectory:", subDir)
-				if err := importDataFromCSV(db, subDir); err != nil {
-					logger.Error("Failed to import CSV data from", subDir, ":", err)
-				}
-			}
-		}
-	}
-	logger.Info("Database initialized successfully")
-	return nil
-}
-
-// ConvertWorkflows converts one or all workflows from the database.
+// ConvertWorkflows converts one or all workflows from the database, along with the
+// workflows they run as components. With 'all', the directories of workflows that
+// are no longer in the database are removed, and the meta-workflows found in the
+// workflows directory are converted again.
 // If 'update' is true, the database is re‑initialized using the CSV data from 'dir' before conversion.
 func ConvertWorkflows(dbFile, workflowID string, all bool) {
-	db, err := sql.Open("sqlite", dbFile)
+	db, err := openDatabase(dbFile)
 	if err != nil {
 		logger.Fatal("Failed to open database:", err)
 	}
 	defer db.Close()
 
 	if all {
-		// Query all workflow IDs.
-		rows, err := db.Query("SELECT name FROM WF")
+		workflows, err := allWorkflows(db)
 		if err != nil {
 			logger.Fatal("Failed to query workflows:", err)
 		}
-		defer rows.Close()
-
-		var workflows []string
-		for rows.Next() {
-			var name string
-			if err := rows.Scan(&name); err != nil {
-				logger.Error("Error scanning workflow:", err)
-				continue
-			}
-			workflows = append(workflows, name)
-		}
 
-		for _, wf := range workflows {
-			logger.Info("Processing workflow", wf)
-			if err := processWorkflow(db, wf); err != nil {
-				logger.Error("Failed to process workflow", wf, ":", err)
-			} else {
-				logger.Info("Workflow", wf, "processed successfully.")
-			}
+		processWorkflows(db, workflows)
+		if err := pruneWorkflowsDir(workflows); err != nil {
+			logger.Error("Failed to remove the workflows that are no longer in the database:", err)
 		}
+		convertMetaWorkflows(db)
 		logger.Info("All workflows processed.")
 	} else {
 		if workflowID == "" {
 			logger.Fatal("Workflow ID must be provided if not processing all workflows.")
 		}
 		logger.Info("Processing workflow", workflowID)
-		if err := processWorkflow(db, workflowID); err != nil {
+		components, err := processWorkflow(db, workflowID)
+		if err != nil {
 			logger.Fatal("Failed to process workflow:", err)
 		}
 		logger.Info("Workflow processed successfully.")
+		processWorkflows(db, components)
+	}
+}
+
+// processWorkflows converts workflows, and the workflows they run as components,
+// logging the ones that fail.
+func processWorkflows(db *sql.DB, workflows []string) {
+	_ = withComponents(workflows, func(wf string) ([]string, error) {
+		logger.Info("Processing workflow", wf)
+		components, err := processWorkflow(db, wf)
+		if err != nil {
+			logger.Error("Failed to process workflow", wf, ":", err)
+		} else {
+			logger.Info("Workflow", wf, "processed successfully.")
+		}
+		return components, nil
+	})
+}
+
+// withComponents calls fn for each workflow, and for the components it returns:
+// the workflows run by that workflow as sub-workflows, which must be converted
+// along with it for their CWL files to be found. Each workflow is visited once, and
+// the first error stops the walk.
+func withComponents(workflows []string, fn func(wf string) ([]string, error)) error {
+	visited := make(map[string]bool)
+	for queue := slices.Clone(workflows); len(queue) > 0; queue = queue[1:] {
+		if visited[queue[0]] {
+			continue
+		}
+		visited[queue[0]] = true
+		components, err := fn(queue[0])
+		if err != nil {
+			return err
+		}
+		queue = append(queue, components...)
+	}
+	return nil
+}
+
+// allWorkflows returns the IDs of the workflows in the database, sorted.
+func allWorkflows(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM WF ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var workflows []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			logger.Error("Error scanning workflow:", err)
+			continue
+		}
+		workflows = append(workflows, name)
 	}
+	return workflows, rows.Err()
 }
 
 // GenerateRoCrate generates an RO‑Crate metadata package from the specified CWL file.
@@ -146,14 +136,19 @@ func GenerateRoCrate(cwlPath, workflowName, output string) {
 }
 
 // ListWorkflows prints out all workflows stored in the database.
-func ListWorkflows(dbFile string) {
-	db, err := sql.Open("sqlite", dbFile)
+// With provenance set, it also prints the work package and import run each workflow came from.
+func ListWorkflows(dbFile string, provenance bool) {
+	db, err := openDatabase(dbFile)
 	if err != nil {
 		logger.Fatal("Failed to open database:", err)
 	}
 	defer db.Close()
 
-	rows, err := db.Query("SELECT name, description, author FROM WF")
+	rows, err := db.Query(`
+		SELECT WF.name, WF.description, WF.author, WF.wp, IMPORT_RUN.id, IMPORT_RUN.started_at, IMPORT_RUN.source
+		FROM WF
+		LEFT JOIN IMPORT_RUN ON WF.import_run = IMPORT_RUN.id
+	`)
 	if err != nil {
 		logger.Fatal("Failed to query workflows:", err)
 	}
@@ -161,236 +156,123 @@ func ListWorkflows(dbFile string) {
 
 	fmt.Println("Workflows in database:")
 	for rows.Next() {
-		var name, description, author string
-		if err := rows.Scan(&name, &description, &author); err != nil {
+		var name, description, author, wp string
+		var runID sql.NullInt64
+		var startedAt, source sql.NullString
+		if err := rows.Scan(&name, &description, &author, &wp, &runID, &startedAt, &source); err != nil {
 			logger.Error("Error scanning workflow:", err)
 			continue
 		}
-		fmt.Printf("ID: %s, Description: %s, Author: %s\n", name, description, author)
-	}
-}
-
-// resetDatabase removes the existing database file.
-func resetDatabase(dbFile string) error {
-	if err := os.Remove(dbFile); err != nil {
-		return fmt.Errorf("error removing database file %s: %w", dbFile, err)
-	}
-	logger.Info("Old database file", dbFile, "removed successfully")
-	return nil
-}
-
-// createTables creates the required tables in the database.
-func createTables(db *sql.DB) error {
-	schemas := []string{
-		`CREATE TABLE IF NOT EXISTS WF (
-			name TEXT PRIMARY KEY,
-			description TEXT,
-			author TEXT
-		);`,
-		`CREATE TABLE IF NOT EXISTS WF_WF (
-			id1 TEXT,
-			relationship_type TEXT NOT NULL,
-			id2 TEXT,
-			FOREIGN KEY (id1) REFERENCES WF(name),
-			FOREIGN KEY (id2) REFERENCES WF(name),
-			PRIMARY KEY (id1, relationship_type, id2)
-		);`,
-		`CREATE TABLE IF NOT EXISTS ST_ST (
-			id1 TEXT,
-			relationship_type TEXT NOT NULL,
-			id2 TEXT,
-			PRIMARY KEY (id1, relationship_type, id2)
-		);`,
-		`CREATE TABLE IF NOT EXISTS SS_SS (
-			id1 TEXT,
-			relationship_type TEXT NOT NULL,
-			id2 TEXT,
-			PRIMARY KEY (id1, relationship_type, id2)
-		);`,
-		`CREATE TABLE IF NOT EXISTS ST_WF (
-			id1 TEXT,
-			relationship_type TEXT NOT NULL,
-			id2 TEXT,
-			FOREIGN KEY (id1) REFERENCES WF(name),
-			PRIMARY KEY (id1, relationship_type, id2)
-		);`,
-		`CREATE TABLE IF NOT EXISTS SS_ST (
-			id1 TEXT,
-			relationship_type TEXT NOT NULL,
-			id2 TEXT,
-			PRIMARY KEY (id1, relationship_type, id2)
-		);`,
-		`CREATE TABLE IF NOT EXISTS DT_ST (
-			id1 TEXT,
-			relationship_type TEXT NOT NULL,
-			id2 TEXT,
-			PRIMARY KEY (id1, relationship_type, id2)
-		);`,
-		`CREATE TABLE IF NOT EXISTS DT_SS (
-			id1 TEXT,
-			relationship_type TEXT NOT NULL,
-			id2 TEXT,
-			PRIMARY KEY (id1, relationship_type, id2)
-		);`,
-	}
-	for _, schema := range schemas {
-		if _, err := db.Exec(schema); err != nil {
-			return err
+		if !provenance {
+			fmt.Printf("ID: %s, Description: %s, Author: %s\n", name, description, author)
+			continue
+		}
+		run := "unknown"
+		if runID.Valid {
+			run = fmt.Sprintf("#%d (%s from %s)", runID.Int64, startedAt.String, source.String)
 		}
-		logger.Debug("Executed schema:", schema)
+		if wp == "" {
+			wp = "unknown"
+		}
+		fmt.Printf("ID: %s, WP: %s, Import run: %s, Description: %s, Author: %s\n", name, wp, run, description, author)
 	}
-	return nil
 }
 
-// importDataFromCSV imports CSV data from a given directory.
-func importDataFromCSV(db *sql.DB, dir string) error {
-	// Ensure the directory string is in lowercase.
-	dir = strings.ToLower(dir)
-	relationships := map[string]string{
-		"WF_WF": filepath.Join(dir, "wf_wf.csv"),
-		"ST_ST": filepath.Join(dir, "st_st.csv"),
-		"SS_SS": filepath.Join(dir, "ss_ss.csv"),
-		"SS_ST": filepath.Join(dir, "ss_st.csv"),
-		"ST_WF": filepath.Join(dir, "st_wf.csv"),
-		"DT_ST": filepath.Join(dir, "dt_st.csv"),
-		"DT_SS": filepath.Join(dir, "dt_ss.csv"),
-	}
-
-	for table, file := range relationships {
-		logger.Debug("Importing table from file:", file)
-		if err := importFromCSV(db, table, file); err != nil {
-			return err
-		}
-	}
+// workflowsDir is the directory the converted workflows are written to, one
+// subdirectory per workflow.
+const workflowsDir = "./workflows"
 
-	if err := insertWF(db, filepath.Join(dir, "wf.csv")); err != nil {
-		return err
+// processWorkflow generates the workflow graph and saves it to files. It returns
+// the workflows the workflow runs as components.
+func processWorkflow(db *sql.DB, workflowID string) ([]string, error) {
+	files, components, err := generateWorkflow(db, workflowID)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return components, writeFiles(workflowsDir+"/"+workflowID, files)
 }
 
-// importFromCSV reads a CSV file and imports its data into the specified table.
-func importFromCSV(db *sql.DB, tableName, filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
+// writeFiles writes generated files, by name, to a directory of the workflows
+// directory, and removes the files of the directory that are no longer generated.
+func writeFiles(path string, files map[string][]byte) error {
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory %s: %w", path, err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		if err := os.WriteFile(path+"/"+name, files[name], 0622); err != nil {
+			return fmt.Errorf("error saving workflow to file: %w", err)
+		}
+		logger.Debug("Saved file", path+"/"+name)
 	}
-	defer file.Close()
-
-	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = -1
 
-	query := fmt.Sprintf("INSERT INTO %s (id1, relationship_type, id2) VALUES (?, ?, ?)", tableName)
-	stmt, err := db.Prepare(query)
+	entries, err := os.ReadDir(path)
 	if err != nil {
-		return err
+		return fmt.Errorf("error reading directory %s: %w", path, err)
 	}
-	defer stmt.Close()
-
-	logger.Debug("Inserting rows into table", tableName)
-	for {
-		row, err := reader.Read()
-		if err != nil {
-			break
-		}
-		if len(row) < 3 {
-			continue
-		}
-		id1 := strings.TrimSpace(row[0])
-		relType := strings.TrimSpace(row[1])
-		id2 := strings.TrimSpace(row[2])
-
-		if id1 == "" || relType == "" || id2 == "" {
+	for _, entry := range entries {
+		if _, generated := files[entry.Name()]; generated {
 			continue
 		}
-		if _, err = stmt.Exec(id1, relType, id2); err != nil {
-			// Check if the error is due to a duplicate record.
-			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-				logger.Warning("Duplicate record encountered in", tableName, "skipping row:", row)
-				continue
-			} else {
-				logger.Error("Error inserting row:", row, "error:", err)
-				return err
-			}
+		if err := os.RemoveAll(path + "/" + entry.Name()); err != nil {
+			return fmt.Errorf("error removing %s: %w", path+"/"+entry.Name(), err)
 		}
+		logger.Info("Removed", path+"/"+entry.Name(), "as it is no longer generated")
 	}
-	logger.Debug("Finished importing data for table", tableName)
 	return nil
 }
 
-// insertWF imports workflow data from a CSV file into the WF table.
-func insertWF(db *sql.DB, filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
+// pruneWorkflowsDir removes the directories of the workflows directory that belong
+// to none of the given workflows. Meta-workflows are left to convertMetaWorkflows.
+func pruneWorkflowsDir(workflows []string) error {
+	entries, err := os.ReadDir(workflowsDir)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	defer file.Close()
-
-	reader := csv.NewReader(file)
-	query := "INSERT INTO WF (name, description, author) VALUES (?, ?, ?)"
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	logger.Debug("Inserting workflow data from", filename)
-	for {
-		row, err := reader.Read()
-		if err != nil {
-			break
+	for _, entry := range entries {
+		if slices.Contains(workflows, entry.Name()) || strings.HasPrefix(entry.Name(), metaPrefix) {
+			continue
 		}
-		name := safeAccess(row, 0)
-		description := safeAccess(row, 1)
-		author := safeAccess(row, 2)
-
-		if _, err = stmt.Exec(name, description, author); err != nil {
-			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-				logger.Warning("Duplicate workflow record encountered, skipping row:", row)
-				continue
-			} else {
-				logger.Error("Error inserting row:", row, "error:", err)
-				return err
-			}
+		if err := os.RemoveAll(workflowsDir + "/" + entry.Name()); err != nil {
+			return err
 		}
+		logger.Info("Removed", workflowsDir+"/"+entry.Name(), "as it is not a workflow of the database")
 	}
-	logger.Debug("Workflow data imported successfully from", filename)
 	return nil
 }
 
-// processWorkflow generates the workflow graph and saves it to files.
-func processWorkflow(db *sql.DB, workflowID string) error {
-	// Set up logging for this conversion.
-	path := "./workflows/" + workflowID
-	originalOutput, logFile, err := logger.StartCopyLogToFile("log.log", path)
-	if err != nil {
-		return err
-	}
+// generateWorkflow converts a workflow in memory and returns the files of its
+// directory by name: the DOT, CWL and RO-Crate files, the conversion log and the
+// README listing the issues found in the log. It also returns the workflows the
+// workflow runs as components.
+func generateWorkflow(db *sql.DB, workflowID string) (map[string][]byte, []string, error) {
+	// Keep the log of this conversion.
+	var conversionLog bytes.Buffer
+	originalOutput := logger.StartCopyLog(&conversionLog)
 
 	logger.Info("Loading workflow graph for ID", workflowID)
 	workflow, err := implicit.GetWorkflowGraph(workflowID, db)
 	if err != nil {
-		return fmt.Errorf("error getting workflow graph for ID %s: %w", workflowID, err)
+		logger.StopCopyLog(originalOutput)
+		return nil, nil, fmt.Errorf("error getting workflow graph for ID %s: %w", workflowID, err)
 	}
 
-	logger.Debug("Saving workflow graph to file")
-	if err := workflow.SaveToFile(db); err != nil {
-		return fmt.Errorf("error saving workflow to file: %w", err)
+	logger.Debug("Generating workflow files")
+	files, err := workflow.Files(db)
+	logger.StopCopyLog(originalOutput)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating workflow files: %w", err)
 	}
 
-	// Stop logging to flush the file before reading it.
-	logger.StopCopyLogToFile(originalOutput, logFile)
-
-	issues, err := os.ReadFile(path + "/log.log")
-	if err != nil {
-		return fmt.Errorf("error reading log file: %w", err)
+	files["log.log"] = conversionLog.Bytes()
+	if files["README.md"], err = createReadme(db, workflow, conversionLog.String(), workflowsDir+"/"+workflowID); err != nil {
+		return nil, nil, err
 	}
-	if err := createReadme(workflow, string(issues), path); err != nil {
-		return err
+	var components []string
+	for _, component := range workflow.Components {
+		components = append(components, component.Name)
 	}
-
-	return nil
+	return files, components, nil
 }
 
 // ReadmeData holds the information to fill in the template.
@@ -398,50 +280,67 @@ type ReadmeData struct {
 	WorkflowID     string
 	DetectedIssues string // This could be a multi-line string with the issues.
 	LogFile        string
+	Steps          []model.ST
+	Datasets       []model.DT
+	// Parent is the workflow this one is part of, and Components the workflows
+	// part of it, as declared in wf_wf.csv.
+	Parent     string
+	Components []model.WF
 }
 
 //go:embed templates/readme.template
 var readmeTemplate string
 
-// createReadme loads a dedicated template file and writes a README.md file in the workflow directory.
-func createReadme(w implicit.Workflow, issues string, logFilePath string) error {
+// createReadme fills in the embedded template to generate the README.md file of the workflow directory.
+func createReadme(db *sql.DB, w implicit.Workflow, issues string, logFilePath string) ([]byte, error) {
 	issues = filterWarnings(issues)
 
+	steps, err := model.GetSTsForWF(db, w.Name)
+	if err != nil {
+		return nil, err
+	}
+	datasets, err := model.GetDTsForWF(db, w.Name)
+	if err != nil {
+		return nil, err
+	}
+	order, err := w.StepOrder()
+	if err != nil {
+		return nil, err
+	}
+	model.OrderSTs(steps, order)
+	sort.Slice(datasets, func(i, j int) bool { return datasets[i].ID < datasets[j].ID })
+
 	data := ReadmeData{
 		WorkflowID:     w.Name,
 		DetectedIssues: issues,
 		LogFile:        logFilePath,
+		Steps:          steps,
+		Datasets:       datasets,
+		Parent:         w.Parent,
+		Components:     w.Components,
 	}
 
 	// Parse the embedded template.
-	tmpl, err := template.New("readme").Parse(readmeTemplate)
+	tmpl, err := template.New("readme").Funcs(template.FuncMap{"cell": tableCell}).Parse(readmeTemplate)
 	if err != nil {
 		logger.Error("Error parsing embedded README template:", err)
-		return err
+		return nil, err
 	}
 
-	dirPath := "workflows/" + w.Name + "/"
-	readmePath := dirPath + "README.md"
-
-	if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
-		logger.Error("Error creating directory", dirPath, ":", err)
-		return err
-	}
-
-	file, err := os.Create(readmePath)
-	if err != nil {
-		logger.Error("Error creating README file at", readmePath, ":", err)
-		return err
-	}
-	defer file.Close()
-
-	if err = tmpl.Execute(file, data); err != nil {
+	var readme bytes.Buffer
+	if err = tmpl.Execute(&readme, data); err != nil {
 		logger.Error("Error executing README template:", err)
-		return err
+		return nil, err
 	}
 
-	logger.Debug("Created README file at", readmePath)
-	return nil
+	logger.Debug("Generated README file for workflow", w.Name)
+	return readme.Bytes(), nil
+}
+
+// tableCell escapes a value for a Markdown table cell.
+func tableCell(value string) string {
+	value = strings.ReplaceAll(value, "|", "\\|")
+	return strings.Join(strings.Fields(value), " ")
 }
 
 func filterWarnings(logStr string) string {
@@ -459,10 +358,3 @@ func filterWarnings(logStr string) string {
 	}
 	return strings.Join(filteredLines, "\n")
 }
-
-func safeAccess(slice []string, index int) string {
-	if index < len(slice) {
-		return strings.TrimSpace(slice[index])
-	}
-	return ""
-}
@@ -0,0 +1,431 @@
+package commands
+
+import (
+	"bytes"
+	"database/sql"
+	"dt-geo-converter/vocabulary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// DiffChange is a difference between two databases: a workflow, relationship or
+// entity that was added or removed, or one of their fields that changed.
+type DiffChange struct {
+	// Change is "added", "removed" or "changed".
+	Change string `json:"change"`
+	Table  string `json:"table"`
+	// ID is the workflow or entity the change is about, for WF, DT, ST and SS rows.
+	ID string `json:"id,omitempty"`
+	// From, Type and To describe a relationship. Type is its kind, and is empty when
+	// the kind itself changed.
+	From string `json:"from,omitempty"`
+	Type string `json:"type,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Field, Old and New describe a changed value; an empty value is omitted.
+	Field string `json:"field,omitempty"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// DiffWorkflow lists the changes of a workflow.
+type DiffWorkflow struct {
+	Workflow string       `json:"workflow"`
+	Changes  []DiffChange `json:"changes"`
+}
+
+// DiffWorkPackage lists the changed workflows of a work package.
+type DiffWorkPackage struct {
+	WP        string         `json:"wp"`
+	Workflows []DiffWorkflow `json:"workflows"`
+}
+
+// DiffReport is the difference between two databases, grouped by work package and
+// workflow. A change that involves several workflows, e.g. a dataset shared by two of
+// them, is listed under each; the counts only include it once.
+type DiffReport struct {
+	Old          string            `json:"old"`
+	New          string            `json:"new"`
+	Added        int               `json:"added"`
+	Removed      int               `json:"removed"`
+	Changed      int               `json:"changed"`
+	WorkPackages []DiffWorkPackage `json:"work_packages"`
+}
+
+// Labels of the changes that cannot be attributed to a work package or workflow.
+const (
+	noWorkPackage = "(no work package)"
+	noWorkflow    = "(no workflow)"
+)
+
+// DiffFormats lists the output formats of DiffDatabases.
+var DiffFormats = []string{"text", "markdown", "json"}
+
+// DiffDatabases compares two databases and writes the differences to out, or to
+// the standard output if out is empty, as text, Markdown or JSON.
+func DiffDatabases(oldFile, newFile, format, out string) error {
+	if !slices.Contains(DiffFormats, format) {
+		return fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(DiffFormats, ", "))
+	}
+	report, err := diffDatabases(oldFile, newFile)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	case "markdown":
+		writeDiffMarkdown(&buf, report)
+	default:
+		writeDiffText(&buf, report)
+	}
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	if err := os.WriteFile(out, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", out, err)
+	}
+	return nil
+}
+
+// dbContent holds the rows of a database that are compared.
+type dbContent struct {
+	workflows     map[string]workflowRow
+	relationships map[relationshipKey][]string
+	entities      map[entityKey][]string
+	// stepWorkflows maps a step to its workflows, and parents a software service or
+	// dataset to the steps and software services it is attached to.
+	stepWorkflows map[string][]string
+	parents       map[string][]string
+}
+
+type workflowRow struct {
+	Description, Author, WP string
+}
+
+// relationshipKey identifies a relationship regardless of its kind, so that a kind
+// that was corrected is reported as a change.
+type relationshipKey struct {
+	Table, WP, ID1, ID2 string
+}
+
+type entityKey struct {
+	Table, WP, ID string
+}
+
+func loadDBContent(dbFile string) (*dbContent, error) {
+	db, err := openDatabase(dbFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	content := &dbContent{
+		workflows:     make(map[string]workflowRow),
+		relationships: make(map[relationshipKey][]string),
+		entities:      make(map[entityKey][]string),
+		stepWorkflows: make(map[string][]string),
+		parents:       make(map[string][]string),
+	}
+
+	rows, err := queryRows(db, "SELECT TRIM(name), COALESCE(description, ''), COALESCE(author, ''), wp FROM WF")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		content.workflows[row[0]] = workflowRow{Description: row[1], Author: row[2], WP: row[3]}
+	}
+
+	for _, sheet := range relationshipSheets {
+		rows, err := queryRows(db, fmt.Sprintf("SELECT TRIM(id1), relationship_type, TRIM(id2), wp FROM %s", sheet.Table))
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			key := relationshipKey{Table: sheet.Table, WP: row[3], ID1: row[0], ID2: row[2]}
+			content.relationships[key] = append(content.relationships[key], row[1])
+			switch sheet.Table {
+			case "ST_WF":
+				content.stepWorkflows[row[0]] = append(content.stepWorkflows[row[0]], row[2])
+			case "SS_ST", "DT_ST", "DT_SS":
+				content.parents[row[0]] = append(content.parents[row[0]], row[2])
+			}
+		}
+	}
+	for key := range content.relationships {
+		sort.Strings(content.relationships[key])
+	}
+
+	if err := loadEntities(db, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+func loadEntities(db *sql.DB, content *dbContent) error {
+	columns := []string{"TRIM(id)", "wp"}
+	columns = append(columns, entityColumns...)
+	for _, sheet := range entitySheets {
+		rows, err := queryRows(db, fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), sheet.Table))
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			content.entities[entityKey{Table: sheet.Table, WP: row[1], ID: row[0]}] = row[2:]
+		}
+	}
+	return nil
+}
+
+// workflowsOf returns the workflows an ID of the given type belongs to in either
+// database, following software services to their steps and datasets to their steps
+// and software services.
+func workflowsOf(idType, id string, dbs ...*dbContent) []string {
+	if idType == "WF" {
+		return []string{id}
+	}
+	var workflows []string
+	seen := map[string]bool{id: true}
+	queue := []string{id}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, db := range dbs {
+			for _, workflow := range db.stepWorkflows[current] {
+				if !slices.Contains(workflows, workflow) {
+					workflows = append(workflows, workflow)
+				}
+			}
+			for _, parent := range db.parents[current] {
+				if !seen[parent] {
+					seen[parent] = true
+					queue = append(queue, parent)
+				}
+			}
+		}
+	}
+	sort.Strings(workflows)
+	return workflows
+}
+
+// diffDatabases compares the rows of two databases.
+func diffDatabases(oldFile, newFile string) (*DiffReport, error) {
+	oldDB, err := loadDBContent(oldFile)
+	if err != nil {
+		return nil, err
+	}
+	newDB, err := loadDBContent(newFile)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DiffReport{Old: oldFile, New: newFile}
+	grouped := make(map[string]map[string][]DiffChange)
+	add := func(change DiffChange, wp string, workflows []string) {
+		switch change.Change {
+		case "added":
+			report.Added++
+		case "removed":
+			report.Removed++
+		default:
+			report.Changed++
+		}
+		if wp == "" {
+			wp = noWorkPackage
+		}
+		if len(workflows) == 0 {
+			workflows = []string{noWorkflow}
+		}
+		if grouped[wp] == nil {
+			grouped[wp] = make(map[string][]DiffChange)
+		}
+		for _, workflow := range workflows {
+			grouped[wp][workflow] = append(grouped[wp][workflow], change)
+		}
+	}
+
+	for _, name := range sortedKeys(oldDB.workflows, newDB.workflows) {
+		before, inOld := oldDB.workflows[name]
+		after, inNew := newDB.workflows[name]
+		switch {
+		case !inOld:
+			add(DiffChange{Change: "added", Table: "WF", ID: name}, after.WP, []string{name})
+		case !inNew:
+			add(DiffChange{Change: "removed", Table: "WF", ID: name}, before.WP, []string{name})
+		default:
+			fields := []struct{ name, old, new string }{
+				{"wp", before.WP, after.WP},
+				{"description", before.Description, after.Description},
+				{"author", before.Author, after.Author},
+			}
+			for _, field := range fields {
+				if field.old != field.new {
+					add(DiffChange{Change: "changed", Table: "WF", ID: name, Field: field.name, Old: field.old, New: field.new}, after.WP, []string{name})
+				}
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(oldDB.relationships, newDB.relationships) {
+		before, after := oldDB.relationships[key], newDB.relationships[key]
+		idTypes := strings.Split(key.Table, "_")
+		workflows := workflowsOf(idTypes[0], key.ID1, newDB, oldDB)
+		for _, workflow := range workflowsOf(idTypes[1], key.ID2, newDB, oldDB) {
+			if !slices.Contains(workflows, workflow) {
+				workflows = append(workflows, workflow)
+			}
+		}
+		sort.Strings(workflows)
+		relationship := DiffChange{Table: key.Table, From: key.ID1, To: key.ID2}
+		switch {
+		case len(before) > 0 && len(after) > 0:
+			if !slices.Equal(before, after) {
+				relationship.Change, relationship.Field = "changed", "relationship_type"
+				relationship.Old, relationship.New = strings.Join(before, ", "), strings.Join(after, ", ")
+				add(relationship, key.WP, workflows)
+			}
+		case len(after) > 0:
+			for _, kind := range after {
+				relationship.Change, relationship.Type = "added", kind
+				add(relationship, key.WP, workflows)
+			}
+		default:
+			for _, kind := range before {
+				relationship.Change, relationship.Type = "removed", kind
+				add(relationship, key.WP, workflows)
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(oldDB.entities, newDB.entities) {
+		before, inOld := oldDB.entities[key]
+		after, inNew := newDB.entities[key]
+		workflows := workflowsOf(key.Table, key.ID, newDB, oldDB)
+		switch {
+		case !inOld:
+			add(DiffChange{Change: "added", Table: key.Table, ID: key.ID}, key.WP, workflows)
+		case !inNew:
+			add(DiffChange{Change: "removed", Table: key.Table, ID: key.ID}, key.WP, workflows)
+		default:
+			for i, column := range entityColumns {
+				if before[i] != after[i] {
+					add(DiffChange{Change: "changed", Table: key.Table, ID: key.ID, Field: column, Old: before[i], New: after[i]}, key.WP, workflows)
+				}
+			}
+		}
+	}
+
+	for _, wp := range sortedKeys(grouped) {
+		entry := DiffWorkPackage{WP: wp}
+		for _, workflow := range sortedKeys(grouped[wp]) {
+			entry.Workflows = append(entry.Workflows, DiffWorkflow{Workflow: workflow, Changes: grouped[wp][workflow]})
+		}
+		report.WorkPackages = append(report.WorkPackages, entry)
+	}
+	return report, nil
+}
+
+// sortedKeys returns the keys of the maps, sorted and without duplicates. Struct
+// keys are sorted by their formatted value.
+func sortedKeys[K comparable, V any](maps ...map[K]V) []K {
+	seen := make(map[K]bool)
+	var keys []K
+	for _, m := range maps {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	return keys
+}
+
+// describe returns the text of a change, without its kind.
+func (c DiffChange) describe() string {
+	var subject string
+	switch {
+	case c.ID != "":
+		subject = c.ID
+	case c.Type != "":
+		return fmt.Sprintf("%s %s %s", c.From, vocabulary.Kind(c.Type).Phrase(), c.To)
+	default:
+		subject = c.From + " -> " + c.To
+	}
+	if c.Field == "" {
+		return subject
+	}
+	if c.Field == "relationship_type" {
+		return fmt.Sprintf("%s: %s => %s", subject, kindPhrases(c.Old), kindPhrases(c.New))
+	}
+	return fmt.Sprintf("%s %s: %q => %q", subject, c.Field, c.Old, c.New)
+}
+
+// kindPhrases returns the phrases of a comma-separated list of kinds.
+func kindPhrases(kinds string) string {
+	var phrases []string
+	for _, kind := range strings.Split(kinds, ", ") {
+		phrases = append(phrases, vocabulary.Kind(kind).Phrase())
+	}
+	return strings.Join(phrases, ", ")
+}
+
+func (r *DiffReport) summary() string {
+	return fmt.Sprintf("%d added, %d removed, %d changed", r.Added, r.Removed, r.Changed)
+}
+
+var diffSymbols = map[string]string{"added": "+", "removed": "-", "changed": "~"}
+
+func writeDiffText(w io.Writer, report *DiffReport) {
+	if len(report.WorkPackages) == 0 {
+		fmt.Fprintf(w, "No differences between %s and %s\n", report.Old, report.New)
+		return
+	}
+	fmt.Fprintf(w, "Differences from %s to %s: %s\n", report.Old, report.New, report.summary())
+	for _, wp := range report.WorkPackages {
+		fmt.Fprintf(w, "\n%s\n", wp.WP)
+		for _, workflow := range wp.Workflows {
+			fmt.Fprintf(w, "  %s\n", workflow.Workflow)
+			for _, change := range workflow.Changes {
+				fmt.Fprintf(w, "    %s %-6s %s\n", diffSymbols[change.Change], change.Table, change.describe())
+			}
+		}
+	}
+}
+
+func writeDiffMarkdown(w io.Writer, report *DiffReport) {
+	fmt.Fprintf(w, "# Differences from `%s` to `%s`\n\n", report.Old, report.New)
+	if len(report.WorkPackages) == 0 {
+		fmt.Fprintln(w, "No differences.")
+		return
+	}
+	fmt.Fprintf(w, "%s.\n", report.summary())
+	for _, wp := range report.WorkPackages {
+		fmt.Fprintf(w, "\n## %s\n", wp.WP)
+		for _, workflow := range wp.Workflows {
+			fmt.Fprintf(w, "\n### %s\n\n", workflow.Workflow)
+			fmt.Fprintln(w, "| Change | Table | Description |")
+			fmt.Fprintln(w, "|---|---|---|")
+			for _, change := range workflow.Changes {
+				fmt.Fprintf(w, "| %s | %s | %s |\n", change.Change, change.Table, tableCell(change.describe()))
+			}
+		}
+	}
+}
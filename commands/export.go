@@ -0,0 +1,203 @@
+package commands
+
+import (
+	"database/sql"
+	"dt-geo-converter/logger"
+	"dt-geo-converter/vocabulary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// unattributedWP is the directory the rows imported by releases that did not record
+// their work package are exported to.
+const unattributedWP = "UNATTRIBUTED"
+
+// ExportCSV writes the content of the database to 'outDir' using the layout read by
+// InitDatabase: one directory per work package with wf.csv, the relationship sheets
+// and, when the work package has any, the entity attribute sheets. Values are trimmed,
+// relationship types are written with their canonical text, and rows are sorted and
+// de-duplicated, so that importing the export with the same vocabulary gives back the
+// same data.
+func ExportCSV(dbFile, outDir string, vocab *vocabulary.Vocabulary) error {
+	db, err := openDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	wps, err := exportedWorkPackages(db)
+	if err != nil {
+		return err
+	}
+	if len(wps) == 0 {
+		return fmt.Errorf("the database %s is empty", dbFile)
+	}
+
+	for _, wp := range wps {
+		dir := wp
+		if wp == "" {
+			dir = unattributedWP
+			logger.Warning("Exporting the rows without a work package to", filepath.Join(outDir, dir))
+		}
+		dir = filepath.Join(outDir, dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+
+		if err := exportRows(db, filepath.Join(dir, "wf.csv"),
+			"SELECT DISTINCT TRIM(name), TRIM(COALESCE(description, '')), TRIM(COALESCE(author, '')) FROM WF WHERE wp = ?", wp); err != nil {
+			return err
+		}
+		for _, sheet := range relationshipSheets {
+			if err := exportRelationships(db, vocab, sheet, filepath.Join(dir, sheet.File), wp); err != nil {
+				return err
+			}
+		}
+		for _, sheet := range entitySheets {
+			if err := exportEntities(db, sheet, filepath.Join(dir, sheet.File), wp); err != nil {
+				return err
+			}
+		}
+		logger.Info("Exported work package", wp, "to", dir)
+	}
+	return nil
+}
+
+// exportedWorkPackages returns the work packages that have rows in any table.
+func exportedWorkPackages(db *sql.DB) ([]string, error) {
+	tables := []string{"WF"}
+	for _, sheet := range relationshipSheets {
+		tables = append(tables, sheet.Table)
+	}
+	for _, sheet := range entitySheets {
+		tables = append(tables, sheet.Table)
+	}
+	selects := make([]string, 0, len(tables))
+	for _, table := range tables {
+		selects = append(selects, "SELECT wp FROM "+table)
+	}
+
+	rows, err := db.Query(strings.Join(selects, " UNION ") + " ORDER BY wp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query work packages: %w", err)
+	}
+	defer rows.Close()
+
+	var wps []string
+	for rows.Next() {
+		var wp string
+		if err := rows.Scan(&wp); err != nil {
+			return nil, fmt.Errorf("failed to scan work package: %w", err)
+		}
+		wps = append(wps, wp)
+	}
+	return wps, rows.Err()
+}
+
+// exportRelationships writes a relationship sheet of a work package.
+func exportRelationships(db *sql.DB, vocab *vocabulary.Vocabulary, sheet relationshipSheet, filename, wp string) error {
+	rows, err := queryRows(db, fmt.Sprintf("SELECT TRIM(id1), relationship_type, TRIM(id2) FROM %s WHERE wp = ?", sheet.Table), wp)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		row[1] = relationshipText(vocab, sheet.Table, vocabulary.Kind(row[1]))
+	}
+	return writeSortedCSV(filename, rows)
+}
+
+// relationshipText returns the text a relationship kind is exported with: its
+// canonical phrase, or its name when the vocabulary maps the phrase to something
+// else. Unknown types, stored as written, are exported unchanged.
+func relationshipText(vocab *vocabulary.Vocabulary, table string, kind vocabulary.Kind) string {
+	for _, text := range []string{kind.Phrase(), string(kind)} {
+		if term, ok := vocab.Lookup(table, text); ok && term.Kind == kind && !term.Reverse {
+			return text
+		}
+	}
+	if kind.Phrase() != string(kind) {
+		logger.Warning("The", table, "relationship type", kind, "cannot be written so that it is imported back unchanged")
+	}
+	return string(kind)
+}
+
+// exportEntities writes an entity attribute sheet of a work package, if it has any rows.
+func exportEntities(db *sql.DB, sheet entitySheet, filename, wp string) error {
+	columns := []string{"TRIM(id)"}
+	for _, name := range entityColumns {
+		columns = append(columns, "TRIM("+name+")")
+	}
+	rows, err := queryRows(db, fmt.Sprintf("SELECT %s FROM %s WHERE wp = ?", strings.Join(columns, ", "), sheet.Table), wp)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		// A stale sheet from a previous export would be imported back.
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeSortedCSV(filename, rows)
+}
+
+// exportRows writes the rows returned by a query to a CSV file.
+func exportRows(db *sql.DB, filename, query string, args ...any) error {
+	rows, err := queryRows(db, query, args...)
+	if err != nil {
+		return err
+	}
+	return writeSortedCSV(filename, rows)
+}
+
+// queryRows returns the rows of a query whose columns are all text.
+func queryRows(db *sql.DB, query string, args ...any) ([][]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rows to export: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var result [][]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("failed to scan row to export: %w", err)
+		}
+		row := make([]string, len(columns))
+		for i, v := range values {
+			row[i] = v.String
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// writeSortedCSV sorts rows, drops duplicates and writes them to a CSV file.
+func writeSortedCSV(filename string, rows [][]string) error {
+	sort.Slice(rows, func(i, j int) bool {
+		return strings.Join(rows[i], "\x00") < strings.Join(rows[j], "\x00")
+	})
+	var unique [][]string
+	for _, row := range rows {
+		if len(unique) > 0 && strings.Join(row, "\x00") == strings.Join(unique[len(unique)-1], "\x00") {
+			continue
+		}
+		unique = append(unique, row)
+	}
+	if err := writeCSV(filename, unique); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+	return nil
+}
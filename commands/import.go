@@ -0,0 +1,524 @@
+package commands
+
+import (
+	"database/sql"
+	"dt-geo-converter/logger"
+	"dt-geo-converter/vocabulary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// relationshipSheet maps a relationship table to the CSV file it is imported from.
+type relationshipSheet struct {
+	Table string
+	File  string
+	// Optional sheets were added after the first spreadsheets were shared;
+	// older exports may not contain them.
+	Optional bool
+}
+
+var relationshipSheets = []relationshipSheet{
+	{Table: "WF_WF", File: "wf_wf.csv"},
+	{Table: "ST_WF", File: "st_wf.csv"},
+	{Table: "ST_ST", File: "st_st.csv"},
+	{Table: "SS_ST", File: "ss_st.csv"},
+	{Table: "SS_SS", File: "ss_ss.csv"},
+	{Table: "DT_ST", File: "dt_st.csv"},
+	{Table: "DT_SS", File: "dt_ss.csv"},
+	{Table: "DT_DT", File: "dt_dt.csv", Optional: true},
+}
+
+// entitySheet maps an entity table to the optional CSV file holding the attributes
+// of its datasets, steps or software services.
+type entitySheet struct {
+	Table string
+	File  string
+}
+
+var entitySheets = []entitySheet{
+	{Table: "DT", File: "dt.csv"},
+	{Table: "ST", File: "st.csv"},
+	{Table: "SS", File: "ss.csv"},
+}
+
+// entityColumns lists, in sheet order, the attribute columns of dt.csv, st.csv and
+// ss.csv that follow the ID.
+var entityColumns = []string{"name", "description", "format", "url", "license", "contact", "epos_id"}
+
+// importer holds the state shared by all the files of an import run.
+type importer struct {
+	tx    *sql.Tx
+	runID int64
+	vocab *vocabulary.Vocabulary
+	// bestEffort keeps going past malformed files and failing work packages
+	// instead of rolling back the whole import.
+	bestEffort bool
+	summary    *importSummary
+	// provided tells which source each file came from.
+	provided provenance
+}
+
+// InitDatabase initializes the database, or updates an existing one, using the CSV
+// files of the given sources. Each source provides a folder that either contains the
+// CSV files directly, or contains subdirectories where each has the expected CSV files.
+// Each folder is a work package: the rows previously imported from the same work
+// packages are replaced, while the rows of every other work package are kept. When
+// several sources provide the same file of a work package, the last one wins (see
+// combineSources). Relationship types are stored in the canonical form defined by 'vocab'.
+//
+// All changes happen in one transaction: a missing or malformed file, or a database
+// error, rolls back the whole import, and a database created by the call is removed.
+// With 'bestEffort', the rows before a malformed line are kept and a failing work
+// package is skipped, keeping its previous rows, while the others are imported.
+// A summary of the imported, skipped and duplicate rows is printed in both cases.
+func InitDatabase(dbFile string, sources []Source, vocab *vocabulary.Vocabulary, bestEffort bool) (err error) {
+	logger.Info("Initializing database")
+
+	if _, statErr := os.Stat(dbFile); os.IsNotExist(statErr) {
+		// Do not leave an empty database behind when the first import fails.
+		defer func() {
+			if err != nil {
+				os.Remove(dbFile)
+			}
+		}()
+	}
+
+	// Open the database.
+	db, err := sql.Open("sqlite", dbFile)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	// Fail before fetching the sources if the database cannot be upgraded; it is
+	// upgraded within the import transaction.
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > currentSchemaVersion() {
+		return checkSchemaVersion(version)
+	}
+
+	defer func() {
+		for _, source := range sources {
+			if err := source.Close(); err != nil {
+				logger.Error("Warning: failed to clean up", source.Name(), ":", err)
+			}
+		}
+	}()
+	dir, provided, err := combineSources(sources)
+	if dir != "" {
+		defer os.RemoveAll(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	dirs, err := workPackageDirs(dir)
+	if err != nil {
+		return err
+	}
+	wps := make([]string, 0, len(dirs))
+	for _, d := range dirs {
+		wps = append(wps, workPackageName(d))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Create or upgrade the tables.
+	if err := migrateWithin(tx); err != nil {
+		return fmt.Errorf("failed to migrate database schema: %w", err)
+	}
+
+	names := make([]string, 0, len(sources))
+	for _, source := range sources {
+		names = append(names, source.Name())
+	}
+	runID, err := startImportRun(tx, strings.Join(names, " + "), wps)
+	if err != nil {
+		return err
+	}
+	logger.Info("Started import run", runID, "for work packages", strings.Join(wps, ", "))
+
+	imp := &importer{tx: tx, runID: runID, vocab: vocab, bestEffort: bestEffort, summary: newImportSummary(), provided: provided}
+	var errs []error
+	for _, d := range dirs {
+		if err := imp.replaceWorkPackage(d); err != nil {
+			logger.Error("Failed to import CSV data from", d, ":", err)
+			imp.summary.failed[workPackageName(d)] = err
+			errs = append(errs, fmt.Errorf("%s: %w", workPackageName(d), err))
+		}
+	}
+	imp.summary.print()
+
+	if len(errs) > 0 && !bestEffort {
+		return fmt.Errorf("import rolled back, the database was not changed (use --best-effort to import the valid work packages): %w", errors.Join(errs...))
+	}
+	warnUnattributedRows(tx)
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit import: %w", err)
+	}
+	logger.Info("Database initialized successfully")
+	return nil
+}
+
+// workPackageDirs returns the directories to import: 'dir' itself when it contains
+// the CSV files directly (detected through any of the expected file names), its
+// subdirectories otherwise.
+func workPackageDirs(dir string) ([]string, error) {
+	for _, tab := range workbookTabs() {
+		if _, err := os.Stat(filepath.Join(dir, tab+".csv")); err == nil {
+			return []string{dir}, nil
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory: %w", err)
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, filepath.Join(dir, entry.Name()))
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no CSV files or work package subdirectories found in %s", dir)
+	}
+	return dirs, nil
+}
+
+// workPackageName derives the work package a directory of CSV files belongs to
+// from its name, so that "data/wp5" and a downloaded "WP5" are the same package.
+func workPackageName(dir string) string {
+	return strings.ToUpper(filepath.Base(filepath.Clean(dir)))
+}
+
+// startImportRun records a new import run and returns its ID.
+func startImportRun(tx *sql.Tx, source string, wps []string) (int64, error) {
+	res, err := tx.Exec("INSERT INTO IMPORT_RUN (started_at, source, work_packages) VALUES (?, ?, ?)",
+		time.Now().UTC().Format(time.RFC3339), source, strings.Join(wps, ","))
+	if err != nil {
+		return 0, fmt.Errorf("failed to record import run: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// replaceWorkPackage deletes the rows previously imported for the work package in
+// 'dir' and imports its CSV files again. It runs inside a savepoint, so a failing
+// work package keeps its previous rows.
+func (imp *importer) replaceWorkPackage(dir string) error {
+	wp := workPackageName(dir)
+	if _, err := imp.tx.Exec("SAVEPOINT work_package"); err != nil {
+		return err
+	}
+
+	if err := deleteWorkPackage(imp.tx, wp); err != nil {
+		rollbackWorkPackage(imp.tx)
+		return err
+	}
+	logger.Debug("Importing CSV data for work package", wp, "from", dir)
+	if err := imp.importDataFromCSV(dir, wp); err != nil {
+		rollbackWorkPackage(imp.tx)
+		return err
+	}
+
+	_, err := imp.tx.Exec("RELEASE SAVEPOINT work_package")
+	return err
+}
+
+// rollbackWorkPackage undoes the changes made since the work_package savepoint.
+func rollbackWorkPackage(tx *sql.Tx) {
+	if _, err := tx.Exec("ROLLBACK TO SAVEPOINT work_package"); err != nil {
+		logger.Error("Failed to roll back work package import:", err)
+	}
+	if _, err := tx.Exec("RELEASE SAVEPOINT work_package"); err != nil {
+		logger.Error("Failed to release work package savepoint:", err)
+	}
+}
+
+// deleteWorkPackage removes every row that was imported from the given work package.
+func deleteWorkPackage(tx *sql.Tx, wp string) error {
+	tables := []string{"WF"}
+	for _, sheet := range relationshipSheets {
+		tables = append(tables, sheet.Table)
+	}
+	for _, sheet := range entitySheets {
+		tables = append(tables, sheet.Table)
+	}
+	for _, table := range tables {
+		res, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE wp = ?", table), wp)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s rows of %s: %w", table, wp, err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			logger.Debug("Removed", n, "rows of", wp, "from", table)
+		}
+	}
+	return nil
+}
+
+// warnUnattributedRows warns about rows imported by releases that did not record
+// the source work package: they are never replaced by an update.
+func warnUnattributedRows(tx *sql.Tx) {
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM WF WHERE wp = ''").Scan(&count); err != nil {
+		logger.Error("Failed to count workflows without a work package:", err)
+		return
+	}
+	if count > 0 {
+		logger.Warning(count, "workflows were imported by an older release and have no work package;",
+			"they will not be replaced by updates. Re-create the database to attribute them.")
+	}
+}
+
+// importDataFromCSV imports the CSV files of a work package from a given directory.
+func (imp *importer) importDataFromCSV(dir, wp string) error {
+	for _, sheet := range relationshipSheets {
+		file := filepath.Join(dir, sheet.File)
+		if _, err := os.Stat(file); os.IsNotExist(err) && sheet.Optional {
+			logger.Debug("Optional file", file, "not found, skipping table", sheet.Table)
+			continue
+		}
+		logger.Debug("Importing table from file:", file)
+		if err := imp.importFromCSV(sheet.Table, file, imp.sourceFile(dir, sheet.File), wp); err != nil {
+			return err
+		}
+	}
+
+	if err := imp.insertWF(filepath.Join(dir, "wf.csv"), imp.sourceFile(dir, "wf.csv"), wp); err != nil {
+		return err
+	}
+
+	for _, sheet := range entitySheets {
+		file := filepath.Join(dir, sheet.File)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			logger.Debug("Optional file", file, "not found, skipping table", sheet.Table)
+			continue
+		}
+		logger.Debug("Importing entity attributes from file:", file)
+		if err := imp.insertEntities(sheet.Table, file, imp.sourceFile(dir, sheet.File), wp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sourceFile returns the name under which rows of 'file' record their origin: the
+// file name prefixed by its work package directory as named in its source, e.g.
+// "wp5/dt_st.csv", rather than the upper-cased work package of the combined sources.
+func (imp *importer) sourceFile(dir, file string) string {
+	if name := imp.provided.fileOf(workPackageName(dir), file); name != "" {
+		return name
+	}
+	return path.Join(filepath.Base(filepath.Clean(dir)), file)
+}
+
+// readSheet reads the records of the sheet imported into a table, and records the
+// dialect it was written in. A malformed row is a hard error, unless the import is
+// best-effort: the rows before it are then imported and the rest of the file is ignored.
+func (imp *importer) readSheet(wp, table, filename, source string, columns []column) ([]record, error) {
+	records, d, err := readRecords(filename, columns, imp.provided.delimiterOf(wp, filepath.Base(filename)))
+	if err == nil || len(records) > 0 {
+		stats := imp.summary.table(wp, table)
+		stats.Dialect = d.String()
+		stats.Source = imp.provided.sourceOf(wp, filepath.Base(filename))
+		logger.Debug("Reading", source, "as", d)
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) && imp.bestEffort {
+		logger.Error("Malformed CSV in", source, ":", err, "- ignoring the rest of the file")
+		return records, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", source, err)
+	}
+	return records, nil
+}
+
+// importFromCSV reads a CSV file and imports its data into the specified table.
+// Every row records 'source' and its line number, so that later warnings can point
+// to the spreadsheet cell that caused them. Relationship types are replaced by their
+// canonical kind, swapping the IDs of reversed aliases; unknown types are reported
+// and stored as written.
+func (imp *importer) importFromCSV(tableName, filename, source, wp string) error {
+	records, err := imp.readSheet(wp, tableName, filename, source, relationshipColumns(tableName))
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (id1, relationship_type, id2, wp, import_run, source_file, source_line) VALUES (?, ?, ?, ?, ?, ?, ?)", tableName)
+	stmt, err := imp.tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	logger.Debug("Inserting rows into table", tableName)
+	stats := imp.summary.table(wp, tableName)
+	for _, rec := range records {
+		if isBlank(rec.Fields) {
+			continue
+		}
+		row := rec.Fields
+		location := fmt.Sprintf("%s:%d", source, rec.Line)
+		id1 := safeAccess(row, 0)
+		relType := safeAccess(row, 1)
+		id2 := safeAccess(row, 2)
+
+		if id1 == "" || relType == "" || id2 == "" {
+			logger.Warning("Incomplete", tableName, "row at", location, "skipping row:", row)
+			stats.Skipped++
+			continue
+		}
+		if term, ok := imp.vocab.Lookup(tableName, relType); ok {
+			relType = string(term.Kind)
+			if term.Reverse {
+				id1, id2 = id2, id1
+			}
+		} else {
+			relType = vocabulary.Normalize(relType)
+			logger.Warning("Unknown", tableName, "relationship type", "\""+relType+"\"", "at", location)
+		}
+		if _, err = stmt.Exec(id1, relType, id2, wp, imp.runID, source, rec.Line); err != nil {
+			// Check if the error is due to a duplicate record.
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				logger.Warning("Duplicate record encountered in", tableName, "at", location, "skipping row:", row)
+				stats.Duplicates++
+				continue
+			} else {
+				logger.Error("Error inserting row at", location, ":", row, "error:", err)
+				return err
+			}
+		}
+		stats.Imported++
+	}
+	logger.Debug("Finished importing data for table", tableName)
+	return nil
+}
+
+// insertWF imports workflow data from a CSV file into the WF table.
+func (imp *importer) insertWF(filename, source, wp string) error {
+	records, err := imp.readSheet(wp, "WF", filename, source, wfColumns)
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT INTO WF (name, description, author, wp, import_run, source_file, source_line) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	stmt, err := imp.tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	logger.Debug("Inserting workflow data from", filename)
+	stats := imp.summary.table(wp, "WF")
+	for _, rec := range records {
+		if isBlank(rec.Fields) {
+			continue
+		}
+		row := rec.Fields
+		location := fmt.Sprintf("%s:%d", source, rec.Line)
+		name := safeAccess(row, 0)
+		description := safeAccess(row, 1)
+		author := safeAccess(row, 2)
+
+		if name == "" {
+			logger.Warning("Workflow without ID at", location, "skipping row:", row)
+			stats.Skipped++
+			continue
+		}
+		if _, err = stmt.Exec(name, description, author, wp, imp.runID, source, rec.Line); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				logger.Warning("Duplicate workflow record encountered at", location, "skipping row:", row)
+				stats.Duplicates++
+				continue
+			} else {
+				logger.Error("Error inserting row at", location, ":", row, "error:", err)
+				return err
+			}
+		}
+		stats.Imported++
+	}
+	logger.Debug("Workflow data imported successfully from", filename)
+	return nil
+}
+
+// insertEntities imports the attributes of datasets, steps or software services from
+// a CSV file into the given entity table. Rows are laid out as the ID followed by
+// entityColumns; missing trailing columns are stored empty, and rows whose ID is not
+// of the type of the table are skipped.
+func (imp *importer) insertEntities(tableName, filename, source, wp string) error {
+	records, err := imp.readSheet(wp, tableName, filename, source, entitySheetColumns(tableName))
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (id, %s, wp, import_run, source_file, source_line) VALUES (?%s, ?, ?, ?, ?)",
+		tableName, strings.Join(entityColumns, ", "), strings.Repeat(", ?", len(entityColumns)))
+	stmt, err := imp.tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	logger.Debug("Inserting rows into table", tableName)
+	stats := imp.summary.table(wp, tableName)
+	for _, rec := range records {
+		if isBlank(rec.Fields) {
+			continue
+		}
+		row := rec.Fields
+		location := fmt.Sprintf("%s:%d", source, rec.Line)
+		id := safeAccess(row, 0)
+		if id == "" {
+			logger.Warning(tableName, "row without ID at", location, "skipping row:", row)
+			stats.Skipped++
+			continue
+		}
+		if !strings.HasPrefix(strings.ToUpper(id), tableName) {
+			logger.Warning(id, "at", location, "is not a", tableName, "ID, skipping row:", row)
+			stats.Skipped++
+			continue
+		}
+
+		args := []any{id}
+		for i := range entityColumns {
+			args = append(args, safeAccess(row, i+1))
+		}
+		args = append(args, wp, imp.runID, source, rec.Line)
+		if _, err = stmt.Exec(args...); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				logger.Warning("Duplicate", tableName, "record encountered at", location, "skipping row:", row)
+				stats.Duplicates++
+				continue
+			} else {
+				logger.Error("Error inserting row at", location, ":", row, "error:", err)
+				return err
+			}
+		}
+		stats.Imported++
+	}
+	logger.Debug("Finished importing data for table", tableName)
+	return nil
+}
+
+func safeAccess(slice []string, index int) string {
+	if index < len(slice) {
+		return strings.TrimSpace(slice[index])
+	}
+	return ""
+}
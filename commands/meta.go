@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"bytes"
+	"database/sql"
+	"dt-geo-converter/implicit"
+	"dt-geo-converter/logger"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// metaPrefix starts the names of the directories of meta-workflows in the workflows
+// directory, e.g. meta-WF6101.
+const metaPrefix = "meta-"
+
+// ConvertMetaWorkflow converts the meta-workflow ending at the target workflow, or
+// of every workflow declared input to another one with target "all". The workflows
+// taking part, and their components, are converted, and the meta-workflow running
+// them is written next to them, e.g. to workflows/meta-WF6101.
+func ConvertMetaWorkflow(dbFile, target string) {
+	db, err := openDatabase(dbFile)
+	if err != nil {
+		logger.Fatal("Failed to open database:", err)
+	}
+	defer db.Close()
+
+	workflows, files, err := generateMetaWorkflow(db, target)
+	if err != nil {
+		logger.Fatal("Failed to generate meta-workflow:", err)
+	}
+	processWorkflows(db, workflows)
+	if err := writeFiles(workflowsDir+"/"+metaPrefix+target, files); err != nil {
+		logger.Fatal("Failed to save meta-workflow:", err)
+	}
+	logger.Info("Meta-workflow", metaPrefix+target, "processed successfully.")
+}
+
+// convertMetaWorkflows converts again the meta-workflows found in the workflows
+// directory, and removes those that can no longer be generated, e.g. because their
+// target left the database.
+func convertMetaWorkflows(db *sql.DB) {
+	targets, err := metaWorkflowTargets()
+	if err != nil {
+		logger.Error("Failed to list the meta-workflows:", err)
+		return
+	}
+	for _, target := range targets {
+		dir := workflowsDir + "/" + metaPrefix + target
+		_, files, err := generateMetaWorkflow(db, target)
+		if err != nil {
+			logger.Warning("Removing", dir, "as it can no longer be generated:", err)
+			if err := os.RemoveAll(dir); err != nil {
+				logger.Error("Failed to remove", dir, ":", err)
+			}
+			continue
+		}
+		if err := writeFiles(dir, files); err != nil {
+			logger.Error("Failed to save meta-workflow", metaPrefix+target, ":", err)
+			continue
+		}
+		logger.Info("Meta-workflow", metaPrefix+target, "processed successfully.")
+	}
+}
+
+// metaWorkflowTargets returns the targets of the meta-workflows in the workflows
+// directory, e.g. WF6101 for workflows/meta-WF6101.
+func metaWorkflowTargets() ([]string, error) {
+	entries, err := os.ReadDir(workflowsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var targets []string
+	for _, entry := range entries {
+		if target, found := strings.CutPrefix(entry.Name(), metaPrefix); found && entry.IsDir() {
+			targets = append(targets, target)
+		}
+	}
+	return targets, nil
+}
+
+// generateMetaWorkflow creates a meta-workflow in memory, and returns the workflows
+// taking part in execution order, and the files of its directory by name: the CWL
+// and DOT files, and the log listing the links that carry no dataset.
+func generateMetaWorkflow(db *sql.DB, target string) ([]string, map[string][]byte, error) {
+	var conversionLog bytes.Buffer
+	originalOutput := logger.StartCopyLog(&conversionLog)
+
+	logger.Info("Loading meta-workflow for", target)
+	meta, err := implicit.GetMetaWorkflow(metaPrefix+target, target, db)
+	if err != nil {
+		logger.StopCopyLog(originalOutput)
+		return nil, nil, fmt.Errorf("error getting meta-workflow for %s: %w", target, err)
+	}
+	files, err := meta.Files(db)
+	logger.StopCopyLog(originalOutput)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating meta-workflow files: %w", err)
+	}
+	workflows, err := meta.Workflows()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error ordering the workflows of the meta-workflow: %w", err)
+	}
+
+	files["log.log"] = conversionLog.Bytes()
+	return workflows, files, nil
+}
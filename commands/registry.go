@@ -0,0 +1,174 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	_ "embed"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Registry lists the remote spreadsheets that can be downloaded, one per work package.
+type Registry struct {
+	Spreadsheets []Spreadsheet `yaml:"spreadsheets" json:"spreadsheets"`
+	// Source tells where the registry was loaded from.
+	Source string `yaml:"-" json:"-"`
+}
+
+type Spreadsheet struct {
+	Name   string  `yaml:"name" json:"name"`
+	Id     string  `yaml:"id" json:"id"`
+	Sheets []Sheet `yaml:"sheets" json:"sheets"`
+}
+
+// Sheet represents a single sheet with its name and gid. Tabs added after the
+// spreadsheets were shared have no gid: they are looked up by name and may be missing.
+type Sheet struct {
+	Name string `yaml:"name" json:"name"`
+	Gid  string `yaml:"gid,omitempty" json:"gid,omitempty"`
+}
+
+//go:embed registry.yaml
+var defaultRegistry []byte
+
+// RegistryConfigPath returns the registry file used when none is given explicitly,
+// e.g. ~/.config/dt-geo-converter/registry.yaml on Linux.
+func RegistryConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "dt-geo-converter", "registry.yaml")
+}
+
+// LoadRegistry returns the registry of remote spreadsheets read from the YAML or JSON
+// file at path. An empty path selects the file at RegistryConfigPath when it exists,
+// and the built-in registry otherwise.
+func LoadRegistry(path string) (*Registry, error) {
+	if path == "" {
+		if config := RegistryConfigPath(); config != "" {
+			if _, err := os.Stat(config); err == nil {
+				path = config
+			}
+		}
+	}
+	if path == "" {
+		r, err := parseRegistry(defaultRegistry)
+		if err != nil {
+			panic(fmt.Sprintf("invalid built-in registry: %v", err))
+		}
+		r.Source = "built-in registry"
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry file: %w", err)
+	}
+	r, err := parseRegistry(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry file %s: %w", path, err)
+	}
+	r.Source = path
+	return r, nil
+}
+
+// parseRegistry decodes and validates a registry. JSON is accepted as a subset of YAML.
+func parseRegistry(data []byte) (*Registry, error) {
+	var r Registry
+	if err := yaml.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// validate checks that spreadsheets are named uniquely, have a document ID, and list
+// every required tab with known tab names only.
+func (r *Registry) validate() error {
+	if len(r.Spreadsheets) == 0 {
+		return fmt.Errorf("no spreadsheets defined")
+	}
+
+	known := workbookTabs()
+	required := requiredTabs()
+
+	names := make(map[string]bool)
+	for i, s := range r.Spreadsheets {
+		if strings.TrimSpace(s.Name) == "" {
+			return fmt.Errorf("spreadsheet #%d has no name", i+1)
+		}
+		if strings.EqualFold(s.Name, "all") {
+			return fmt.Errorf("spreadsheet name %q is reserved", s.Name)
+		}
+		// Names become work package directories of downloads and snapshots.
+		if strings.ContainsAny(s.Name, `/\`) || !filepath.IsLocal(s.Name) {
+			return fmt.Errorf("spreadsheet name %q is not a valid directory name", s.Name)
+		}
+		if names[strings.ToUpper(s.Name)] {
+			return fmt.Errorf("spreadsheet %s is defined more than once", s.Name)
+		}
+		names[strings.ToUpper(s.Name)] = true
+		if strings.TrimSpace(s.Id) == "" {
+			return fmt.Errorf("spreadsheet %s has no id", s.Name)
+		}
+
+		tabs := make(map[string]bool)
+		for _, sheet := range s.Sheets {
+			if !slices.Contains(known, sheet.Name) {
+				return fmt.Errorf("spreadsheet %s: unknown tab %q, expected one of %s", s.Name, sheet.Name, strings.Join(known, ", "))
+			}
+			if tabs[sheet.Name] {
+				return fmt.Errorf("spreadsheet %s: tab %s is defined more than once", s.Name, sheet.Name)
+			}
+			tabs[sheet.Name] = true
+		}
+		for _, name := range required {
+			if !tabs[name] {
+				return fmt.Errorf("spreadsheet %s: missing required tab %s", s.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// requiredTabs returns the names of the tabs every spreadsheet must provide.
+func requiredTabs() []string {
+	required := []string{"wf"}
+	for _, sheet := range relationshipSheets {
+		if !sheet.Optional {
+			required = append(required, strings.TrimSuffix(sheet.File, ".csv"))
+		}
+	}
+	return required
+}
+
+// Names returns the names of the spreadsheets of the registry, in registry order.
+func (r *Registry) Names() []string {
+	result := make([]string, 0, len(r.Spreadsheets))
+	for _, sheet := range r.Spreadsheets {
+		result = append(result, sheet.Name)
+	}
+	return result
+}
+
+// PrintRegistry prints the spreadsheets of a registry and their tabs.
+func PrintRegistry(r *Registry) {
+	fmt.Printf("Remote spreadsheets (%s):\n", r.Source)
+	for _, s := range r.Spreadsheets {
+		fmt.Printf("%s: https://docs.google.com/spreadsheets/d/%s\n", s.Name, s.Id)
+		for _, sheet := range s.Sheets {
+			gid := sheet.Gid
+			if gid == "" {
+				gid = "looked up by name, optional"
+			}
+			fmt.Printf("  %-6s gid %s\n", sheet.Name, gid)
+		}
+	}
+}
@@ -1,108 +1,104 @@
 package commands
 
 import (
+	"bytes"
+	"context"
 	"dt-geo-converter/logger"
+	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
-type Spreadsheet struct {
-	Name   string
-	Id     string
-	Sheets []Sheet
-}
+// URL path patterns for the CSV export of a tab, by gid and by tab name.
+const (
+	exportPath       = "/spreadsheets/d/%s/export?format=csv&gid=%s"
+	exportByNamePath = "/spreadsheets/d/%s/gviz/tq?tqx=out:csv&sheet=%s"
+)
 
-// Sheet represents a single sheet with its name and gid.
-type Sheet struct {
-	Name string
-	Gid  string
+// Downloader fetches the tabs of remote spreadsheets as CSV files.
+type Downloader struct {
+	// BaseURL is the Google Sheets server, e.g. "https://docs.google.com".
+	BaseURL string
+	Client  *http.Client
+	// Concurrency is the number of tabs fetched at the same time.
+	Concurrency int
+	// Retries is the number of times a request failing with a network error, a
+	// server error or a rate limit is repeated. The delay before the first retry is
+	// Backoff, and it doubles after each attempt.
+	Retries int
+	Backoff time.Duration
+	// Timeout bounds each request, and MaxSize the size of each tab in bytes.
+	Timeout time.Duration
+	MaxSize int64
+	// Cache, if set, keeps the downloaded tabs: tabs are only downloaded again when
+	// the server reports a change. In Offline mode, tabs are read from the cache only.
+	Cache   *SheetCache
+	Offline bool
+	// URL, if set, returns the URL of a tab in place of the Google Sheets export URL.
+	URL func(spreadsheet Spreadsheet, sheet Sheet) string
 }
 
-var spreadsheets = []Spreadsheet{
-	{
-		Name: "WP8",
-		Id:   "1PBNwRbdwKxIC62_qGbhlpFFenqEQc-gjWqd2uZiHCv8",
-		Sheets: []Sheet{
-			{"wf", "0"},
-			{"wf_wf", "592166767"},
-			{"st_wf", "1799804703"},
-			{"st_st", "6566471"},
-			{"ss_st", "1214315610"},
-			{"ss_ss", "736239675"},
-			{"dt_st", "1422982849"},
-			{"dt_ss", "1334178335"},
-		},
-	},
-	{
-		Name: "WP6",
-		Id:   "1QUgmvmuuK13x_ElTCXBNHyvzHV44WCoaNstLiTLVb7Q",
-		Sheets: []Sheet{
-			{"wf", "0"},
-			{"wf_wf", "592166767"},
-			{"st_wf", "1799804703"},
-			{"st_st", "6566471"},
-			{"ss_st", "1214315610"},
-			{"ss_ss", "736239675"},
-			{"dt_st", "1422982849"},
-			{"dt_ss", "1334178335"},
-		},
-	},
-	{
-		Name: "WP5",
-		Id:   "1Dfj4GXIJNwvTT3LgKlRkUAISHiC6gsFKTf6mj3pitLU",
-		Sheets: []Sheet{
-			{"wf", "0"},
-			{"wf_wf", "592166767"},
-			{"st_wf", "1799804703"},
-			{"st_st", "6566471"},
-			{"ss_st", "1214315610"},
-			{"ss_ss", "736239675"},
-			{"dt_st", "1422982849"},
-			{"dt_ss", "1334178335"},
-		},
-	},
-	{
-		Name: "WP7",
-		Id:   "1lnSpLPO2XDrGRUizuIcIOwCTqEHmLBKFKFwHJIDe0sI",
-		Sheets: []Sheet{
-			{"wf", "0"},
-			{"wf_wf", "592166767"},
-			{"st_wf", "1799804703"},
-			{"st_st", "6566471"},
-			{"ss_st", "1214315610"},
-			{"ss_ss", "736239675"},
-			{"dt_st", "1422982849"},
-			{"dt_ss", "1334178335"},
-		},
-	},
+// NewDownloader returns a Downloader for the public Google Sheets server.
+func NewDownloader() *Downloader {
+	return &Downloader{
+		BaseURL:     "https://docs.google.com",
+		Client:      &http.Client{},
+		Concurrency: 4,
+		Retries:     3,
+		Backoff:     time.Second,
+		Timeout:     30 * time.Second,
+		MaxSize:     10 << 20,
+	}
 }
 
-func GetAvailableWPs() []string {
-	result := make([]string, 0)
-	for _, sheet := range spreadsheets {
-		result = append(result, sheet.Name)
+// sheetURL returns the CSV export URL of a sheet.
+func (d *Downloader) sheetURL(spreadsheet Spreadsheet, sheet Sheet) string {
+	if d.URL != nil {
+		return d.URL(spreadsheet, sheet)
+	}
+	base := strings.TrimSuffix(d.BaseURL, "/")
+	if sheet.Gid == "" {
+		return base + fmt.Sprintf(exportByNamePath, url.PathEscape(spreadsheet.Id), url.QueryEscape(sheet.Name))
 	}
-	return result
+	return base + fmt.Sprintf(exportPath, url.PathEscape(spreadsheet.Id), url.QueryEscape(sheet.Gid))
 }
 
-// Base URL pattern for CSV export including the gid parameter.
-var baseURL = "https://docs.google.com/spreadsheets/d/%s/export?format=csv&gid=%s"
+// statusError is returned for a response with an unexpected HTTP status.
+type statusError struct {
+	Code int
+}
 
-// DownloadRemoteSheets downloads the sheets for only the specified work packages.
-// If "all" is passed in toLoad (case-insensitive), then all spreadsheets are downloaded.
-func DownloadRemoteSheets(toLoad []string) (string, error) {
-	// Create a temporary directory for the sheets.
-	dir, err := os.MkdirTemp("", "sheets-*")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp directory: %w", err)
-	}
+func (e statusError) Error() string {
+	return fmt.Sprintf("status code %d %s", e.Code, http.StatusText(e.Code))
+}
 
-	// Determine if "all" is specified.
+// fetchResult is the outcome of downloading a tab.
+type fetchResult struct {
+	Data    []byte
+	Fetched time.Time
+	Err     error
+}
+
+// Download downloads the sheets of the registry for only the specified work packages
+// into a new temporary directory, with one subdirectory per spreadsheet and a
+// manifest.json describing the files (see Manifest). If "all" is passed in toLoad
+// (case-insensitive), then all spreadsheets are downloaded.
+//
+// Every tab is checked to be CSV with the expected columns and IDs. Tabs looked up
+// by name are skipped when missing, or when the first tab is returned in their
+// place; any other tab that cannot be fetched is reported at the end, and if it is
+// a required tab the directory is removed and an error is returned.
+func (d *Downloader) Download(registry *Registry, toLoad []string) (string, error) {
 	loadAll := false
 	for _, s := range toLoad {
 		if strings.EqualFold(s, "all") {
@@ -110,57 +106,342 @@ func DownloadRemoteSheets(toLoad []string) (string, error) {
 			break
 		}
 	}
+	var selected []Spreadsheet
+	for _, spreadsheet := range registry.Spreadsheets {
+		if !loadAll && !slices.Contains(toLoad, spreadsheet.Name) {
+			logger.Debug("Skipping spreadsheet", spreadsheet.Name, "as it's not specified in toLoad")
+			continue
+		}
+		selected = append(selected, spreadsheet)
+	}
 
-	// Loop over the spreadsheets and process only the specified ones.
-	for _, spreadsheet := range spreadsheets {
-		if !loadAll {
-			found := slices.Contains(toLoad, spreadsheet.Name)
-			if !found {
-				logger.Debug("Skipping spreadsheet", spreadsheet.Name, "as it's not specified in toLoad")
-				continue
-			}
+	// Create a temporary directory for the sheets.
+	dir, err := os.MkdirTemp("", "sheets-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	results := make([][]fetchResult, len(selected))
+	semaphore := make(chan struct{}, max(d.Concurrency, 1))
+	var wg sync.WaitGroup
+	for i, spreadsheet := range selected {
+		if d.Offline {
+			logger.Info("Loading", spreadsheet.Name, "from the cache")
+		} else {
+			logger.Info("Fetching", spreadsheet.Name, "from", d.BaseURL)
+		}
+		results[i] = make([]fetchResult, len(spreadsheet.Sheets))
+		for j, sheet := range spreadsheet.Sheets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, fetched, err := d.fetchSheet(spreadsheet, sheet, semaphore)
+				results[i][j] = fetchResult{Data: data, Fetched: fetched, Err: err}
+			}()
 		}
+	}
+	wg.Wait()
 
-		logger.Info("Fetching", spreadsheet.Name, "from Google Drive")
+	manifest := Manifest{Created: time.Now().UTC(), Registry: registry.Source}
+	required := requiredTabs()
+	var failures []string
+	var requiredErrs []error
+	for i, spreadsheet := range selected {
 		sheetDir := filepath.Join(dir, spreadsheet.Name)
 		if err := os.Mkdir(sheetDir, 0755); err != nil {
-			return dir, fmt.Errorf("failed to create directory for spreadsheet %s: %w", spreadsheet.Name, err)
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("failed to create directory for spreadsheet %s: %w", spreadsheet.Name, err)
 		}
 
-		for _, sheet := range spreadsheet.Sheets {
-			url := fmt.Sprintf(baseURL, spreadsheet.Id, sheet.Gid)
-			logger.Debug("Fetching CSV for", spreadsheet.Name+"-"+sheet.Name, "from", url)
-
-			resp, err := http.Get(url)
-			if err != nil {
-				logger.Error("Error fetching CSV for", spreadsheet.Name+"-"+sheet.Name, ":", err)
+		entry := ManifestSpreadsheet{Name: spreadsheet.Name, ID: spreadsheet.Id}
+		for j, sheet := range spreadsheet.Sheets {
+			result := results[i][j]
+			name := spreadsheet.Name + "-" + sheet.Name
+			var status statusError
+			if sheet.Gid == "" && (errors.As(result.Err, &status) && status.Code < 500 ||
+				errors.Is(result.Err, errNotCached) || errors.Is(result.Err, errOtherTab)) {
+				logger.Debug("Optional tab", name, "not found:", result.Err)
 				continue
 			}
-			// Ensure the response body is closed explicitly after processing.
-			if resp.StatusCode != http.StatusOK {
-				logger.Error("Error fetching CSV for", spreadsheet.Name+"-"+sheet.Name, ": status code", resp.StatusCode)
-				resp.Body.Close()
+			if result.Err != nil {
+				if slices.Contains(required, sheet.Name) {
+					failures = append(failures, fmt.Sprintf("%s %s (required): %v", spreadsheet.Name, sheet.Name, result.Err))
+					requiredErrs = append(requiredErrs, fmt.Errorf("%s: %w", name, result.Err))
+				} else {
+					failures = append(failures, fmt.Sprintf("%s %s: %v", spreadsheet.Name, sheet.Name, result.Err))
+				}
+				logger.Debug("Error fetching CSV for", name, ":", result.Err)
 				continue
 			}
 
 			filePath := filepath.Join(sheetDir, sheet.Name+".csv")
-			file, err := os.Create(filePath)
-			if err != nil {
-				logger.Error("Error creating file for", spreadsheet.Name+"-"+sheet.Name, ":", err)
-				resp.Body.Close()
-				continue
-			}
-
-			// Copy the CSV data to the file.
-			_, err = io.Copy(file, resp.Body)
-			file.Close()
-			resp.Body.Close()
-			if err != nil {
-				logger.Error("Error writing CSV data for", spreadsheet.Name+"-"+sheet.Name, ":", err)
-				continue
+			if err := os.WriteFile(filePath, result.Data, 0644); err != nil {
+				os.RemoveAll(dir)
+				return "", fmt.Errorf("failed to write CSV data for %s: %w", name, err)
 			}
+			entry.Files = append(entry.Files, ManifestFile{
+				Tab:     sheet.Name,
+				Gid:     sheet.Gid,
+				Path:    spreadsheet.Name + "/" + sheet.Name + ".csv",
+				URL:     d.sheetURL(spreadsheet, sheet),
+				Fetched: result.Fetched,
+				SHA256:  hashOf(result.Data),
+				Size:    len(result.Data),
+			})
 		}
+		manifest.Spreadsheets = append(manifest.Spreadsheets, entry)
 	}
 
+	if len(failures) > 0 {
+		fmt.Println("Download failures:")
+		for _, failure := range failures {
+			fmt.Println("  " + failure)
+		}
+	}
+	if len(requiredErrs) > 0 {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to download %d required tabs (see the download failures above), first error: %w", len(requiredErrs), requiredErrs[0])
+	}
+	if err := writeManifest(dir, manifest); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
 	return dir, nil
 }
+
+// fetchSheet returns the checked content of a tab, from the server or the cache,
+// along with the time it was last fetched from the server. Requests to the server
+// take a slot of 'semaphore', as in fetch.
+func (d *Downloader) fetchSheet(spreadsheet Spreadsheet, sheet Sheet, semaphore chan struct{}) ([]byte, time.Time, error) {
+	name := spreadsheet.Name + "-" + sheet.Name
+	var cached *CacheEntry
+	var cachedData []byte
+	if d.Cache != nil {
+		cached, cachedData = d.Cache.load(spreadsheet.Id, sheet)
+	}
+	if d.Offline {
+		if cached == nil {
+			return nil, time.Time{}, errNotCached
+		}
+		if err := checkShape(sheet.Name, cachedData); err != nil {
+			return nil, time.Time{}, err
+		}
+		logger.Debug("Using the copy of", name, "cached on", cached.Synced.Local().Format(time.RFC3339))
+		return cachedData, cached.Synced, nil
+	}
+
+	url := d.sheetURL(spreadsheet, sheet)
+	resp, err := d.fetch(url, name, cached, semaphore)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data := resp.Data
+	if resp.NotModified {
+		logger.Debug(name, "has not changed since", cached.Synced.Local().Format(time.RFC3339))
+		data = cachedData
+		if err := checkShape(sheet.Name, data); err != nil {
+			return nil, time.Time{}, err
+		}
+	} else if err := checkContentType(resp.ContentType); err != nil {
+		return nil, time.Time{}, err
+	} else if err := checkShape(sheet.Name, data); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if d.Cache != nil {
+		entry := CacheEntry{
+			Spreadsheet:   spreadsheet.Name,
+			SpreadsheetID: spreadsheet.Id,
+			Tab:           sheet.Name,
+			Gid:           sheet.Gid,
+			URL:           url,
+			ETag:          resp.ETag,
+			LastModified:  resp.LastModified,
+		}
+		if resp.NotModified {
+			entry.ETag, entry.LastModified = cached.ETag, cached.LastModified
+		}
+		if err := d.Cache.store(entry, data); err != nil {
+			logger.Warning("Failed to cache", name, ":", err)
+		}
+	}
+	return data, time.Now().UTC(), nil
+}
+
+// response is a downloaded tab along with its validators. NotModified is set when
+// the server confirmed that the cached copy is current, and Data is then empty.
+type response struct {
+	Data         []byte
+	ContentType  string
+	ETag         string
+	LastModified string
+	NotModified  bool
+}
+
+// fetch downloads a URL, retrying with exponential backoff on transient failures.
+// The validators of the cached entry, if any, make the request conditional. Each
+// attempt takes a slot of 'semaphore', if set, which is released while waiting to
+// retry so that other tabs can be fetched meanwhile.
+func (d *Downloader) fetch(url, name string, cached *CacheEntry, semaphore chan struct{}) (*response, error) {
+	delay := d.Backoff
+	for attempt := 0; ; attempt++ {
+		logger.Debug("Fetching CSV for", name, "from", url)
+		if semaphore != nil {
+			semaphore <- struct{}{}
+		}
+		resp, retry, err := d.fetchOnce(url, cached)
+		if semaphore != nil {
+			<-semaphore
+		}
+		if err == nil || !retry || attempt >= d.Retries {
+			return resp, err
+		}
+		logger.Debug("Retrying", name, "in", delay, "after error:", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// fetchOnce downloads a URL once. It tells whether the request is worth retrying.
+func (d *Downloader) fetchOnce(url string, cached *CacheEntry) (result *response, retry bool, err error) {
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return &response{NotModified: true}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return nil, retry, statusError{Code: resp.StatusCode}
+	}
+
+	body := io.Reader(resp.Body)
+	if d.MaxSize > 0 {
+		body = io.LimitReader(resp.Body, d.MaxSize+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to read response: %w", err)
+	}
+	if d.MaxSize > 0 && int64(len(data)) > d.MaxSize {
+		return nil, false, fmt.Errorf("response larger than %d bytes", d.MaxSize)
+	}
+	return &response{
+		Data:         data,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, false, nil
+}
+
+// checkContentType accepts the media types CSV files are served with. An HTML page
+// is what a spreadsheet that is not shared publicly answers with: a login page.
+func checkContentType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid Content-Type %q", contentType)
+	}
+	switch mediaType {
+	case "text/csv", "text/plain", "application/csv", "application/octet-stream":
+		return nil
+	case "text/html":
+		return fmt.Errorf("received an HTML page instead of CSV, check that the spreadsheet is shared publicly or use --credentials")
+	default:
+		return fmt.Errorf("unexpected Content-Type %q, expected text/csv", mediaType)
+	}
+}
+
+// errOtherTab is returned for a tab holding the rows of another one: Google Sheets
+// answers with the first tab when no tab has the requested name.
+var errOtherTab = errors.New("the tab holds the rows of another tab")
+
+// checkShape checks that the data of a tab is CSV with at least the columns the tab
+// is read with, and that its first column holds the IDs the tab is about rather
+// than only IDs of another type. Empty tabs are accepted.
+func checkShape(tab string, data []byte) error {
+	trimmed := bytes.ToLower(bytes.TrimSpace(bytes.TrimPrefix(data, utf8BOM)))
+	if bytes.HasPrefix(trimmed, []byte("<!doctype html")) || bytes.HasPrefix(trimmed, []byte("<html")) {
+		return fmt.Errorf("received an HTML page instead of CSV, check that the spreadsheet is shared publicly or use --credentials")
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return fmt.Errorf("invalid CSV: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	expected := 1
+	for _, sheet := range relationshipSheets {
+		if sheet.File == tab+".csv" {
+			expected = len(relationshipColumns(sheet.Table))
+		}
+	}
+	width := 0
+	for _, row := range rows {
+		width = max(width, len(row))
+	}
+	if width < expected {
+		return fmt.Errorf("found %d columns, expected at least %d", width, expected)
+	}
+
+	// Header rows and blank rows hold no ID and are ignored.
+	prefix := tabIDPrefix(tab)
+	var found []string
+	for _, row := range rows {
+		if match := entityID.FindStringSubmatch(strings.TrimSpace(row[0])); match != nil {
+			found = append(found, strings.ToUpper(match[1]))
+		}
+	}
+	if prefix != "" && len(found) > 0 && !slices.Contains(found, prefix) {
+		return fmt.Errorf("%w: no ID in its first column starts with %s", errOtherTab, prefix)
+	}
+	return nil
+}
+
+// tabIDPrefix returns the prefix of the IDs in the first column of a tab, or "" for
+// an unknown tab.
+func tabIDPrefix(tab string) string {
+	if tab == "wf" {
+		return "WF"
+	}
+	for _, sheet := range entitySheets {
+		if sheet.File == tab+".csv" {
+			return sheet.Table
+		}
+	}
+	for _, sheet := range relationshipSheets {
+		if sheet.File == tab+".csv" {
+			return strings.Split(sheet.Table, "_")[0]
+		}
+	}
+	return ""
+}
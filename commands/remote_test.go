@@ -0,0 +1,268 @@
+package commands
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTab is a tab of the fake Google Sheets server.
+type fakeTab struct {
+	Name, Gid   string
+	ContentType string
+	Body        string
+	// Failures is the number of requests answered with Status before the tab is
+	// served.
+	Failures int
+	Status   int
+}
+
+// fakeSheets serves the tabs of a spreadsheet like Google Sheets: by gid through
+// the CSV export, and by name through the visualization API, which quotes every
+// cell and answers with the first tab when no tab has the requested name.
+type fakeSheets struct {
+	mu       sync.Mutex
+	tabs     []*fakeTab
+	requests map[string]int
+}
+
+func newFakeSheets(t *testing.T, tabs ...*fakeTab) *httptest.Server {
+	sheets := &fakeSheets{tabs: tabs, requests: make(map[string]int)}
+	server := httptest.NewServer(sheets)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (f *fakeSheets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var tab *fakeTab
+	quoted := false
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/export"):
+		for _, candidate := range f.tabs {
+			if candidate.Gid != "" && candidate.Gid == r.URL.Query().Get("gid") {
+				tab = candidate
+			}
+		}
+	case strings.HasSuffix(r.URL.Path, "/gviz/tq"):
+		tab, quoted = f.tabs[0], true
+		for _, candidate := range f.tabs {
+			if candidate.Name == r.URL.Query().Get("sheet") {
+				tab = candidate
+			}
+		}
+	}
+	if tab == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.requests[tab.Name]++
+	if tab.Failures > 0 {
+		tab.Failures--
+		w.WriteHeader(tab.Status)
+		return
+	}
+	contentType := tab.ContentType
+	if contentType == "" {
+		contentType = "text/csv; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	body := tab.Body
+	if quoted {
+		body = quoteAll(body)
+	}
+	w.Write([]byte(body))
+}
+
+// quoteAll quotes every cell of CSV data, as the visualization API does.
+func quoteAll(data string) string {
+	rows, _ := csv.NewReader(strings.NewReader(data)).ReadAll()
+	var b strings.Builder
+	for _, row := range rows {
+		for i, cell := range row {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(`"` + strings.ReplaceAll(cell, `"`, `""`) + `"`)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// requiredFakeTabs returns a valid tab for each required sheet, the first being wf.
+func requiredFakeTabs() []*fakeTab {
+	bodies := map[string]string{
+		"wf":    "WF5101,Workflow,Author\n",
+		"wf_wf": "WF5101,is part of,WF5102\n",
+		"st_wf": "ST510101,is part of,WF5101\n",
+		"st_st": "ST510101,is previous to,ST510102\n",
+		"ss_st": "SS5101,is part of,ST510101\n",
+		"ss_ss": "SS5101,is previous to,SS5102\n",
+		"dt_st": "DT5101,is input to,ST510101\n",
+		"dt_ss": "DT5101,is input to,SS5101\n",
+	}
+	var tabs []*fakeTab
+	for i, name := range requiredTabs() {
+		tabs = append(tabs, &fakeTab{Name: name, Gid: strings.Repeat("1", i+1), Body: bodies[name]})
+	}
+	return tabs
+}
+
+// registryOf returns a registry with a single spreadsheet listing the given tabs.
+func registryOf(tabs []*fakeTab) *Registry {
+	spreadsheet := Spreadsheet{Name: "WP5", Id: "spreadsheet-id"}
+	for _, tab := range tabs {
+		spreadsheet.Sheets = append(spreadsheet.Sheets, Sheet{Name: tab.Name, Gid: tab.Gid})
+	}
+	return &Registry{Spreadsheets: []Spreadsheet{spreadsheet}}
+}
+
+func testDownloader(server *httptest.Server) *Downloader {
+	d := NewDownloader()
+	d.BaseURL = server.URL
+	d.Client = server.Client()
+	d.Backoff = time.Millisecond
+	return d
+}
+
+// tempDir points the temporary directory of the downloads to an empty directory,
+// which it returns.
+func tempDir(t *testing.T) string {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	return dir
+}
+
+func TestDownloadRetriesTransientFailures(t *testing.T) {
+	tabs := requiredFakeTabs()
+	tabs[0].Failures, tabs[0].Status = 2, http.StatusServiceUnavailable
+	tabs[1].Failures, tabs[1].Status = 1, http.StatusTooManyRequests
+	server := newFakeSheets(t, tabs...)
+	sheets := server.Config.Handler.(*fakeSheets)
+
+	dir, err := testDownloader(server).Download(registryOf(tabs), []string{"all"})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if got := sheets.requests["wf"]; got != 3 {
+		t.Errorf("wf was requested %d times, want 3", got)
+	}
+	if got := sheets.requests["wf_wf"]; got != 2 {
+		t.Errorf("wf_wf was requested %d times, want 2", got)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "WP5", "wf.csv"))
+	if err != nil || string(data) != tabs[0].Body {
+		t.Errorf("wf.csv = %q, %v; want %q", data, err, tabs[0].Body)
+	}
+}
+
+func TestDownloadGivesUpAfterRetries(t *testing.T) {
+	tabs := requiredFakeTabs()
+	tabs[0].Failures, tabs[0].Status = 10, http.StatusBadGateway
+	server := newFakeSheets(t, tabs...)
+	sheets := server.Config.Handler.(*fakeSheets)
+
+	d := testDownloader(server)
+	d.Retries = 2
+	if dir, err := d.Download(registryOf(tabs), []string{"all"}); err == nil {
+		os.RemoveAll(dir)
+		t.Fatal("Download succeeded, want an error")
+	}
+	if got := sheets.requests["wf"]; got != 3 {
+		t.Errorf("wf was requested %d times, want 3", got)
+	}
+}
+
+func TestDownloadRejectsLoginPage(t *testing.T) {
+	page := "<!DOCTYPE html><html><body>Sign in</body></html>\n"
+	for name, contentType := range map[string]string{
+		"HTML content type": "text/html; charset=utf-8",
+		"CSV content type":  "text/csv",
+	} {
+		t.Run(name, func(t *testing.T) {
+			tabs := requiredFakeTabs()
+			tabs[2].ContentType, tabs[2].Body = contentType, page
+			server := newFakeSheets(t, tabs...)
+
+			dir, err := testDownloader(server).Download(registryOf(tabs), []string{"all"})
+			if err == nil {
+				os.RemoveAll(dir)
+				t.Fatal("Download succeeded, want an error")
+			}
+			if !strings.Contains(err.Error(), "HTML page") {
+				t.Errorf("error %q does not report the HTML page", err)
+			}
+		})
+	}
+}
+
+func TestDownloadRejectsOversizedTab(t *testing.T) {
+	tabs := requiredFakeTabs()
+	tabs[3].Body = strings.Repeat("ST510101,is previous to,ST510102\n", 10)
+	server := newFakeSheets(t, tabs...)
+
+	d := testDownloader(server)
+	d.MaxSize = int64(len(tabs[3].Body) - 1)
+	dir, err := d.Download(registryOf(tabs), []string{"all"})
+	if err == nil {
+		os.RemoveAll(dir)
+		t.Fatal("Download succeeded, want an error")
+	}
+	if !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("error %q does not report the size limit", err)
+	}
+}
+
+func TestDownloadFailsOnMissingRequiredTab(t *testing.T) {
+	temp := tempDir(t)
+	tabs := requiredFakeTabs()
+	server := newFakeSheets(t, tabs[1:]...)
+
+	dir, err := testDownloader(server).Download(registryOf(tabs), []string{"all"})
+	if err == nil {
+		t.Fatal("Download succeeded, want an error")
+	}
+	if dir != "" {
+		t.Errorf("Download returned directory %s along with the error", dir)
+	}
+	entries, err := os.ReadDir(temp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("the temporary directory %s was not removed", filepath.Join(temp, entries[0].Name()))
+	}
+}
+
+func TestDownloadSkipsMissingOptionalTab(t *testing.T) {
+	tabs := requiredFakeTabs()
+	steps := &fakeTab{Name: "st", Body: "ID,name\nST510101,Step\n"}
+	server := newFakeSheets(t, append(tabs, steps)...)
+
+	// dt is looked up by name but missing: the server answers with the wf tab.
+	registry := registryOf(append(tabs, steps, &fakeTab{Name: "dt"}))
+	dir, err := testDownloader(server).Download(registry, []string{"all"})
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := os.Stat(filepath.Join(dir, "WP5", "dt.csv")); !os.IsNotExist(err) {
+		t.Errorf("dt.csv was written from another tab")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "WP5", "st.csv")); err != nil {
+		t.Errorf("st.csv was not written: %v", err)
+	}
+}
@@ -0,0 +1,445 @@
+package commands
+
+import (
+	"database/sql"
+	"dt-geo-converter/logger"
+	"dt-geo-converter/vocabulary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// migration is a single, ordered change to the database schema.
+type migration struct {
+	Version     int
+	Description string
+	Statements  []string
+	// Apply, when set, runs after Statements for changes that cannot be expressed in SQL.
+	Apply func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change in the order it must be applied.
+// Never edit a released migration: append a new one instead.
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "Create the workflow and relationship tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS WF (
+				name TEXT PRIMARY KEY,
+				description TEXT,
+				author TEXT
+			);`,
+			`CREATE TABLE IF NOT EXISTS WF_WF (
+				id1 TEXT,
+				relationship_type TEXT NOT NULL,
+				id2 TEXT,
+				FOREIGN KEY (id1) REFERENCES WF(name),
+				FOREIGN KEY (id2) REFERENCES WF(name),
+				PRIMARY KEY (id1, relationship_type, id2)
+			);`,
+			`CREATE TABLE IF NOT EXISTS ST_ST (
+				id1 TEXT,
+				relationship_type TEXT NOT NULL,
+				id2 TEXT,
+				PRIMARY KEY (id1, relationship_type, id2)
+			);`,
+			`CREATE TABLE IF NOT EXISTS SS_SS (
+				id1 TEXT,
+				relationship_type TEXT NOT NULL,
+				id2 TEXT,
+				PRIMARY KEY (id1, relationship_type, id2)
+			);`,
+			`CREATE TABLE IF NOT EXISTS ST_WF (
+				id1 TEXT,
+				relationship_type TEXT NOT NULL,
+				id2 TEXT,
+				FOREIGN KEY (id1) REFERENCES WF(name),
+				PRIMARY KEY (id1, relationship_type, id2)
+			);`,
+			`CREATE TABLE IF NOT EXISTS SS_ST (
+				id1 TEXT,
+				relationship_type TEXT NOT NULL,
+				id2 TEXT,
+				PRIMARY KEY (id1, relationship_type, id2)
+			);`,
+			`CREATE TABLE IF NOT EXISTS DT_ST (
+				id1 TEXT,
+				relationship_type TEXT NOT NULL,
+				id2 TEXT,
+				PRIMARY KEY (id1, relationship_type, id2)
+			);`,
+			`CREATE TABLE IF NOT EXISTS DT_SS (
+				id1 TEXT,
+				relationship_type TEXT NOT NULL,
+				id2 TEXT,
+				PRIMARY KEY (id1, relationship_type, id2)
+			);`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "Add the DT_DT table for dataset lineage",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS DT_DT (
+				id1 TEXT,
+				relationship_type TEXT NOT NULL,
+				id2 TEXT,
+				PRIMARY KEY (id1, relationship_type, id2)
+			);`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "Record the source work package and import run of every row",
+		Statements: append([]string{
+			`CREATE TABLE IF NOT EXISTS IMPORT_RUN (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				started_at TEXT NOT NULL,
+				source TEXT,
+				work_packages TEXT
+			);`,
+			`ALTER TABLE WF ADD COLUMN wp TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE WF ADD COLUMN import_run INTEGER REFERENCES IMPORT_RUN(id);`,
+		}, addWorkPackageToRelationshipTables()...),
+	},
+	{
+		Version:     4,
+		Description: "Record the CSV file and line every row was imported from",
+		Statements:  addSourceLocationColumns(),
+	},
+	{
+		Version:     5,
+		Description: "Store relationship types in canonical form using the built-in vocabulary",
+		Apply:       canonicalizeRelationships,
+	},
+	{
+		Version:     6,
+		Description: "Add the DT, ST and SS tables for entity attributes",
+		Statements:  createEntityTables(),
+	},
+}
+
+// addSourceLocationColumns adds the source_file and source_line columns to the
+// workflow table and to every relationship table.
+func addSourceLocationColumns() []string {
+	var statements []string
+	for _, table := range []string{"WF", "WF_WF", "ST_WF", "ST_ST", "SS_ST", "SS_SS", "DT_ST", "DT_SS", "DT_DT"} {
+		statements = append(statements,
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN source_file TEXT;", table),
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN source_line INTEGER;", table),
+		)
+	}
+	return statements
+}
+
+// addWorkPackageToRelationshipTables rebuilds every relationship table with the
+// wp and import_run columns. The work package becomes part of the primary key, so
+// the same relationship can be declared by several work packages and replacing one
+// of them leaves the others untouched. SQLite cannot alter a primary key, hence the
+// copy and rename.
+func addWorkPackageToRelationshipTables() []string {
+	var statements []string
+	for _, table := range []string{"WF_WF", "ST_WF", "ST_ST", "SS_ST", "SS_SS", "DT_ST", "DT_SS", "DT_DT"} {
+		statements = append(statements,
+			fmt.Sprintf(`CREATE TABLE %s_new (
+				id1 TEXT,
+				relationship_type TEXT NOT NULL,
+				id2 TEXT,
+				wp TEXT NOT NULL DEFAULT '',
+				import_run INTEGER REFERENCES IMPORT_RUN(id),
+				PRIMARY KEY (wp, id1, relationship_type, id2)
+			);`, table),
+			fmt.Sprintf("INSERT INTO %s_new (id1, relationship_type, id2) SELECT id1, relationship_type, id2 FROM %s;", table, table),
+			fmt.Sprintf("DROP TABLE %s;", table),
+			fmt.Sprintf("ALTER TABLE %s_new RENAME TO %s;", table, table),
+		)
+	}
+	return statements
+}
+
+// createEntityTables creates the tables holding the descriptive attributes of
+// datasets, steps and software services, read from dt.csv, st.csv and ss.csv.
+func createEntityTables() []string {
+	var statements []string
+	for _, table := range []string{"DT", "ST", "SS"} {
+		statements = append(statements, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+				id TEXT NOT NULL,
+				name TEXT NOT NULL DEFAULT '',
+				description TEXT NOT NULL DEFAULT '',
+				format TEXT NOT NULL DEFAULT '',
+				url TEXT NOT NULL DEFAULT '',
+				license TEXT NOT NULL DEFAULT '',
+				contact TEXT NOT NULL DEFAULT '',
+				epos_id TEXT NOT NULL DEFAULT '',
+				wp TEXT NOT NULL DEFAULT '',
+				import_run INTEGER REFERENCES IMPORT_RUN(id),
+				source_file TEXT,
+				source_line INTEGER,
+				PRIMARY KEY (wp, id)
+			);`, table))
+	}
+	return statements
+}
+
+// canonicalizeRelationships rewrites the relationship types imported by older
+// releases to their canonical kind, swapping the IDs of reversed aliases. Rows that
+// become identical to an existing one are dropped.
+func canonicalizeRelationships(tx *sql.Tx) error {
+	vocab := vocabulary.Default()
+	for _, table := range []string{"WF_WF", "ST_WF", "ST_ST", "SS_ST", "SS_SS", "DT_ST", "DT_SS", "DT_DT"} {
+		rows, err := tx.Query(fmt.Sprintf("SELECT rowid, id1, relationship_type, id2 FROM %s", table))
+		if err != nil {
+			return err
+		}
+		type update struct {
+			rowid         int64
+			id1, rel, id2 string
+		}
+		var updates []update
+		for rows.Next() {
+			var u update
+			if err := rows.Scan(&u.rowid, &u.id1, &u.rel, &u.id2); err != nil {
+				rows.Close()
+				return err
+			}
+			term, ok := vocab.Lookup(table, u.rel)
+			if !ok {
+				continue
+			}
+			if term.Reverse {
+				u.id1, u.id2 = u.id2, u.id1
+			}
+			u.rel = string(term.Kind)
+			updates = append(updates, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, u := range updates {
+			query := fmt.Sprintf("UPDATE OR IGNORE %s SET id1 = ?, relationship_type = ?, id2 = ? WHERE rowid = ?", table)
+			res, err := tx.Exec(query, u.id1, u.rel, u.id2, u.rowid)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE rowid = ?", table), u.rowid); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// currentSchemaVersion returns the schema version this release works with.
+func currentSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// openDatabase opens an existing database and checks that its schema matches the
+// version expected by this release. It never modifies the database.
+func openDatabase(dbFile string) (*sql.DB, error) {
+	if _, err := os.Stat(dbFile); err != nil {
+		return nil, fmt.Errorf("database file %s not found, run 'dt-geo-converter init-db' first: %w", dbFile, err)
+	}
+
+	db, err := sql.Open("sqlite", dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := checkSchemaVersion(version); err != nil {
+		db.Close()
+		if version < currentSchemaVersion() {
+			return nil, fmt.Errorf("%w; run 'dt-geo-converter migrate --db %s' to upgrade it", err, dbFile)
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+// checkSchemaVersion reports whether a database with the given schema version can
+// be used as-is by this release.
+func checkSchemaVersion(version int) error {
+	current := currentSchemaVersion()
+	switch {
+	case version > current:
+		return fmt.Errorf("database schema version %d is newer than the version supported by this release (%d); please upgrade dt-geo-converter", version, current)
+	case version < current:
+		return fmt.Errorf("database schema version %d is older than the version required by this release (%d)", version, current)
+	}
+	return nil
+}
+
+// schemaVersion returns the schema version recorded in the database. Databases
+// created before schema versioning was introduced, as well as empty databases,
+// report version 0; the first migration only uses CREATE TABLE IF NOT EXISTS so
+// it can safely be applied to both.
+func schemaVersion(db executor) (int, error) {
+	var name string
+	err := db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect database schema: %w", err)
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// pendingMigrations returns the migrations that still have to be applied to a
+// database at the given schema version.
+func pendingMigrations(version int) []migration {
+	var pending []migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// executor runs statements on a database or within a transaction.
+type executor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// migrateDatabase applies all pending migrations, each one in its own transaction.
+// It refuses to touch databases written by a newer release.
+func migrateDatabase(db *sql.DB) error {
+	pending, err := prepareMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		err = applyMigration(tx, m)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+		logger.Info("Applied migration", m.Version, ":", m.Description)
+	}
+	return nil
+}
+
+// migrateWithin applies all pending migrations within a transaction, so that they
+// are rolled back along with the rest of it. Like migrateDatabase, it refuses to
+// touch databases written by a newer release.
+func migrateWithin(tx *sql.Tx) error {
+	pending, err := prepareMigrations(tx)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if err := applyMigration(tx, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+		logger.Info("Applied migration", m.Version, ":", m.Description)
+	}
+	return nil
+}
+
+// prepareMigrations checks that the database can be migrated, creates the
+// schema_version table if needed and returns the pending migrations.
+func prepareMigrations(db executor) ([]migration, error) {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version > currentSchemaVersion() {
+		return nil, checkSchemaVersion(version)
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT,
+		applied_at TEXT
+	);`); err != nil {
+		return nil, fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+	return pendingMigrations(version), nil
+}
+
+// applyMigration runs the statements of a single migration and records it in
+// schema_version, within the given transaction.
+func applyMigration(tx *sql.Tx, m migration) error {
+	for _, statement := range m.Statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+		logger.Debug("Executed schema:", statement)
+	}
+	if m.Apply != nil {
+		if err := m.Apply(tx); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+		m.Version, m.Description, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// MigrateDatabase upgrades an existing database in place to the schema version of
+// this release. With dryRun set, it only lists the pending migrations.
+func MigrateDatabase(dbFile string, dryRun bool) error {
+	if _, err := os.Stat(dbFile); err != nil {
+		return fmt.Errorf("database file %s not found: %w", dbFile, err)
+	}
+
+	db, err := sql.Open("sqlite", dbFile)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > currentSchemaVersion() {
+		return checkSchemaVersion(version)
+	}
+
+	pending := pendingMigrations(version)
+	fmt.Printf("Database schema version: %d (current: %d)\n", version, currentSchemaVersion())
+	if len(pending) == 0 {
+		fmt.Println("The database is up to date.")
+		return nil
+	}
+
+	fmt.Println("Pending migrations:")
+	for _, m := range pending {
+		fmt.Printf("  %d: %s\n", m.Version, m.Description)
+	}
+	if dryRun {
+		return nil
+	}
+
+	if err := migrateDatabase(db); err != nil {
+		return err
+	}
+	fmt.Printf("Database migrated to schema version %d\n", currentSchemaVersion())
+	return nil
+}
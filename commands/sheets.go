@@ -0,0 +1,256 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// record is a row of a spreadsheet export, along with the line it starts at.
+type record struct {
+	Line   int
+	Fields []string
+}
+
+// column is an expected column of a sheet, along with the header names it may be
+// found under. Names are compared after normalizeHeader.
+type column struct {
+	Name    string
+	Aliases []string
+}
+
+// dialect describes how a spreadsheet export was written.
+type dialect struct {
+	Delimiter rune
+	BOM       bool
+	Header    bool
+}
+
+// delimiters are the field separators recognized when sniffing a file, in order of
+// preference when several fit equally well.
+var delimiters = []rune{',', ';', '\t', '|'}
+
+var delimiterNames = map[rune]string{',': "comma", ';': "semicolon", '\t': "tab", '|': "pipe"}
+
+// String returns a short description of the dialect, e.g. "semicolon+BOM+header".
+func (d dialect) String() string {
+	parts := []string{delimiterNames[d.Delimiter]}
+	if d.BOM {
+		parts = append(parts, "BOM")
+	}
+	if d.Header {
+		parts = append(parts, "header")
+	}
+	return strings.Join(parts, "+")
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// entityID matches the IDs of workflows, steps, software services and datasets.
+var entityID = regexp.MustCompile(`(?i)^(WF|ST|SS|DT)\d`)
+
+// readRecords reads all the records of a CSV file whose columns are expected in the
+// given order. The delimiter is sniffed unless one is given, and a UTF-8 BOM is
+// stripped. A first row naming the columns is recognized as a header: it is skipped
+// and the fields of the other rows are rearranged in the expected order. Rows may
+// have any number of fields. Reading stops at the first malformed row: the records
+// read up to that point are returned together with the error, which reports its
+// line.
+func readRecords(filename string, columns []column, delimiter rune) ([]record, dialect, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, dialect{}, err
+	}
+
+	var d dialect
+	if bytes.HasPrefix(data, utf8BOM) {
+		data = data[len(utf8BOM):]
+		d.BOM = true
+	}
+	d.Delimiter = delimiter
+	if d.Delimiter == 0 {
+		d.Delimiter = sniffDelimiter(data)
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = d.Delimiter
+	reader.FieldsPerRecord = -1
+
+	var records []record
+	var mapping []int
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return records, d, nil
+		}
+		if err != nil {
+			return records, d, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(records) == 0 && mapping == nil && !d.Header {
+			if m, ok := headerMapping(row, columns); ok {
+				d.Header = true
+				mapping = m
+				continue
+			}
+		}
+		if mapping != nil {
+			row = rearrange(row, mapping)
+		}
+		records = append(records, record{Line: line, Fields: row})
+	}
+}
+
+// sniffDelimiter returns the delimiter that best splits the first records of data,
+// defaulting to a comma. Only delimiters that parse these records with strict
+// quoting are considered, so that delimiters within quoted fields do not count.
+// A delimiter giving every record the same number of fields is preferred, then the
+// one splitting the most records, then the one giving the most fields. Ties go to
+// the first delimiter of delimiters.
+func sniffDelimiter(data []byte) rune {
+	best, bestScore := ',', [3]int{}
+	for _, delimiter := range delimiters {
+		reader := csv.NewReader(bytes.NewReader(data))
+		reader.Comma = delimiter
+		reader.FieldsPerRecord = -1
+
+		// score holds whether the field count is consistent, the number of records
+		// split and the number of extra fields.
+		score, fields, valid := [3]int{1, 0, 0}, -1, true
+		for n := 0; n < 20; n++ {
+			row, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				valid = false
+				break
+			}
+			if fields != -1 && len(row) != fields {
+				score[0] = 0
+			}
+			fields = len(row)
+			if len(row) > 1 {
+				score[1]++
+			}
+			score[2] += len(row) - 1
+		}
+		if valid && score[1] > 0 && slices.Compare(score[:], bestScore[:]) > 0 {
+			best, bestScore = delimiter, score
+		}
+	}
+	return best
+}
+
+// headerMapping tells whether row is a header naming the expected columns. If so,
+// it returns, for each column, the position of its field in the row, or -1.
+// Columns the header does not name keep their position when it is not taken.
+func headerMapping(row []string, columns []column) ([]int, bool) {
+	if len(row) == 0 || entityID.MatchString(strings.TrimSpace(row[0])) {
+		return nil, false
+	}
+
+	mapping := make([]int, len(columns))
+	for i := range mapping {
+		mapping[i] = -1
+	}
+	taken := make(map[int]bool)
+	for pos, cell := range row {
+		name := normalizeHeader(cell)
+		if name == "" {
+			continue
+		}
+		for i, col := range columns {
+			if mapping[i] == -1 && col.matches(name) {
+				mapping[i] = pos
+				taken[pos] = true
+				break
+			}
+		}
+	}
+	if len(taken) == 0 {
+		return nil, false
+	}
+
+	for i := range mapping {
+		if mapping[i] == -1 && !taken[i] {
+			mapping[i] = i
+		}
+	}
+	return mapping, true
+}
+
+func (c column) matches(name string) bool {
+	if normalizeHeader(c.Name) == name {
+		return true
+	}
+	for _, alias := range c.Aliases {
+		if normalizeHeader(alias) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHeader lowercases a header name and drops everything but letters and
+// digits, so that "Relationship type" and "relationship_type" are the same name.
+func normalizeHeader(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// rearrange returns the fields of row in the order given by mapping.
+func rearrange(row []string, mapping []int) []string {
+	fields := make([]string, len(mapping))
+	for i, pos := range mapping {
+		if pos >= 0 && pos < len(row) {
+			fields[i] = row[pos]
+		}
+	}
+	return fields
+}
+
+// relationshipColumns returns the columns of a relationship sheet: the two IDs can
+// also be named after their entity type, e.g. "DT" and "ST" in dt_st.csv.
+func relationshipColumns(table string) []column {
+	types := strings.Split(strings.ToLower(table), "_")
+	return []column{
+		{Name: "id1", Aliases: []string{"from", "source", types[0], types[0] + " id"}},
+		{Name: "relationship_type", Aliases: []string{"relationship", "relation", "type"}},
+		{Name: "id2", Aliases: []string{"to", "target", types[1], types[1] + " id"}},
+	}
+}
+
+// wfColumns are the columns of wf.csv.
+var wfColumns = []column{
+	{Name: "name", Aliases: []string{"id", "wf", "wf id", "workflow", "workflow id"}},
+	{Name: "description", Aliases: []string{"desc"}},
+	{Name: "author", Aliases: []string{"authors"}},
+}
+
+// entitySheetColumns returns the columns of dt.csv, st.csv or ss.csv.
+func entitySheetColumns(table string) []column {
+	aliases := map[string][]string{
+		"format":  {"encoding format"},
+		"url":     {"link", "website"},
+		"license": {"licence"},
+		"contact": {"email", "author"},
+		"epos_id": {"epos identifier", "epos"},
+	}
+	columns := []column{{Name: "id", Aliases: []string{strings.ToLower(table), strings.ToLower(table) + " id"}}}
+	for _, name := range entityColumns {
+		columns = append(columns, column{Name: name, Aliases: aliases[name]})
+	}
+	return columns
+}
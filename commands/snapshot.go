@@ -0,0 +1,350 @@
+package commands
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"dt-geo-converter/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestFile is the name of the manifest written at the root of a snapshot.
+const manifestFile = "manifest.json"
+
+// Manifest describes a snapshot of remote spreadsheets: where each file was fetched
+// from, when, and its SHA-256 hash.
+type Manifest struct {
+	Created      time.Time             `json:"created"`
+	Registry     string                `json:"registry"`
+	Spreadsheets []ManifestSpreadsheet `json:"spreadsheets"`
+}
+
+// ManifestSpreadsheet lists the files of a work package of a snapshot.
+type ManifestSpreadsheet struct {
+	Name  string         `json:"name"`
+	ID    string         `json:"id"`
+	Files []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes a CSV file of a snapshot. Path is relative to the root of
+// the snapshot, with forward slashes.
+type ManifestFile struct {
+	Tab     string    `json:"tab"`
+	Gid     string    `json:"gid,omitempty"`
+	Path    string    `json:"path"`
+	URL     string    `json:"url"`
+	Fetched time.Time `json:"fetched"`
+	SHA256  string    `json:"sha256"`
+	Size    int       `json:"size"`
+}
+
+func writeManifest(dir string, manifest Manifest) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestFile), buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// readManifest returns the manifest of a snapshot directory, or nil if it has none.
+func readManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", manifestFile, err)
+	}
+	return &manifest, nil
+}
+
+// checkManifest warns about the files of a snapshot directory that are missing or
+// were modified since they were fetched. Edited snapshots are still imported.
+func checkManifest(dir string) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		logger.Warning("Ignoring the manifest of", dir, ":", err)
+		return
+	}
+	if manifest == nil {
+		return
+	}
+	for _, s := range manifest.Spreadsheets {
+		for _, f := range s.Files {
+			data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(f.Path)))
+			if err != nil {
+				logger.Warning("File", f.Path, "listed in the manifest is missing")
+			} else if hashOf(data) != f.SHA256 {
+				logger.Warning("File", f.Path, "was modified after it was fetched on", f.Fetched.Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+// IsArchive tells whether path names a .zip, .tar.gz or .tgz file.
+func IsArchive(path string) bool {
+	name := strings.ToLower(path)
+	return strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// SaveSnapshot saves a directory returned by Downloader.Download to 'out': a
+// .zip, .tar.gz or .tgz archive, or a directory otherwise. An existing directory is
+// only written to if it is empty or holds a previous snapshot, whose work packages
+// are replaced.
+func SaveSnapshot(dir, out string) error {
+	if IsArchive(out) {
+		return writeArchive(dir, out)
+	}
+
+	entries, err := os.ReadDir(out)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read directory %s: %w", out, err)
+	}
+	if len(entries) > 0 {
+		previous, err := readManifest(out)
+		if err != nil {
+			return err
+		}
+		if previous == nil {
+			return fmt.Errorf("%s is not empty and does not hold a snapshot (no %s)", out, manifestFile)
+		}
+		for _, s := range previous.Spreadsheets {
+			if err := os.RemoveAll(filepath.Join(out, filepath.Base(s.Name))); err != nil {
+				return fmt.Errorf("failed to remove the previous snapshot of %s: %w", s.Name, err)
+			}
+		}
+	}
+
+	return walkFiles(dir, func(name string, file *os.File, info os.FileInfo) error {
+		target := filepath.Join(out, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		w, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		if _, err := io.Copy(w, file); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// writeArchive packs the files of dir into a .zip or gzipped tar archive.
+func writeArchive(dir, out string) (err error) {
+	f, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(out)
+		}
+	}()
+
+	if strings.HasSuffix(strings.ToLower(out), ".zip") {
+		zw := zip.NewWriter(f)
+		err = walkFiles(dir, func(name string, file *os.File, info os.FileInfo) error {
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			header.Method = zip.Deflate
+			w, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, file)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+		return zw.Close()
+	}
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	err = walkFiles(dir, func(name string, file *os.File, info os.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// walkFiles calls fn for every regular file under dir, in lexical order, with its
+// slash-separated path relative to dir.
+func walkFiles(dir string, fn func(name string, file *os.File, info os.FileInfo) error) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return fn(filepath.ToSlash(rel), file, info)
+	})
+}
+
+// ExtractArchive extracts a .zip, .tar.gz or .tgz snapshot into a temporary
+// directory that InitDatabase can read. When every file of the archive is under the
+// same directory, e.g. because a snapshot directory was archived as a whole, that
+// directory is stripped. The caller must remove the returned directory.
+func ExtractArchive(archive string) (string, error) {
+	files, err := readArchive(archive)
+	if err != nil {
+		return "", fmt.Errorf("failed to read archive %s: %w", archive, err)
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("archive %s is empty", archive)
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	prefix := commonDirectory(names)
+
+	dir, err := os.MkdirTemp("", "snapshot-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	for name, data := range files {
+		target := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(name, prefix)))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return dir, err
+		}
+		if err := os.WriteFile(target, data, 0644); err != nil {
+			return dir, fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+	}
+	return dir, nil
+}
+
+// readArchive returns the content of the regular files of an archive by name.
+// Names that would be extracted outside of the target directory are rejected.
+func readArchive(archive string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	add := func(name string, r io.Reader) error {
+		name = path.Clean(strings.ReplaceAll(name, "\\", "/"))
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		files[name] = data
+		return nil
+	}
+
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") {
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			err = add(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return files, nil
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := add(header.Name, tr); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// commonDirectory returns the directory, with a trailing slash, that all names are
+// under, or "" if there is none or it directly holds wf.csv.
+func commonDirectory(names []string) string {
+	first, _, ok := strings.Cut(names[0], "/")
+	if !ok {
+		return ""
+	}
+	prefix := first + "/"
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || name == prefix+"wf.csv" {
+			return ""
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,309 @@
+package commands
+
+import (
+	"bytes"
+	"dt-geo-converter/logger"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Source provides work packages as directories of CSV files, laid out as described
+// in InitDatabase.
+type Source interface {
+	// Name describes the source in summaries, e.g. "dir ./data".
+	Name() string
+	// Fetch returns the directory holding the work packages of the source.
+	Fetch() (string, error)
+	// Close removes the temporary files created by Fetch.
+	Close() error
+}
+
+// fixedDelimiter is implemented by sources whose CSV files are written with a
+// known delimiter, which is used instead of sniffing it: a cell holding another
+// delimiter is not quoted and could otherwise be mistaken for one.
+type fixedDelimiter interface {
+	Delimiter() rune
+}
+
+// DirSource is a local directory of CSV files.
+type DirSource struct {
+	Dir string
+}
+
+func (s *DirSource) Name() string { return "dir " + s.Dir }
+
+func (s *DirSource) Fetch() (string, error) {
+	info, err := os.Stat(s.Dir)
+	if err != nil {
+		return "", fmt.Errorf("directory does not exist: %s", s.Dir)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", s.Dir)
+	}
+	return s.Dir, nil
+}
+
+func (s *DirSource) Close() error { return nil }
+
+// ArchiveSource is a .zip, .tar.gz or .tgz snapshot, as written by fetch.
+type ArchiveSource struct {
+	Path string
+	dir  string
+}
+
+func (s *ArchiveSource) Name() string { return "archive " + s.Path }
+
+func (s *ArchiveSource) Fetch() (string, error) {
+	dir, err := ExtractArchive(s.Path)
+	s.dir = dir
+	return dir, err
+}
+
+func (s *ArchiveSource) Close() error { return removeTemp(s.dir) }
+
+// WorkbookSource is a set of .xlsx or .ods workbooks, one per work package.
+type WorkbookSource struct {
+	Paths []string
+	dir   string
+}
+
+func (s *WorkbookSource) Name() string { return "workbook " + strings.Join(s.Paths, ",") }
+
+func (s *WorkbookSource) Fetch() (string, error) {
+	dir, err := ExtractWorkbooks(s.Paths)
+	s.dir = dir
+	return dir, err
+}
+
+func (s *WorkbookSource) Close() error { return removeTemp(s.dir) }
+
+// Delimiter is the comma used by ExtractWorkbooks.
+func (s *WorkbookSource) Delimiter() rune { return ',' }
+
+// RemoteSource is a set of spreadsheets of a registry, fetched from Google Sheets.
+type RemoteSource struct {
+	Registry *Registry
+	// WorkPackages are the names of the spreadsheets to fetch, or "all".
+	WorkPackages []string
+	Downloader   *Downloader
+	dir          string
+}
+
+func (s *RemoteSource) Name() string { return "remote " + strings.Join(s.WorkPackages, ",") }
+
+func (s *RemoteSource) Fetch() (string, error) {
+	dir, err := s.Downloader.Download(s.Registry, s.WorkPackages)
+	s.dir = dir
+	return dir, err
+}
+
+func (s *RemoteSource) Close() error { return removeTemp(s.dir) }
+
+// Delimiter is the comma of the CSV export of Google Sheets.
+func (s *RemoteSource) Delimiter() rune { return ',' }
+
+// HTTPSource is a snapshot published on a web server: BaseURL is the URL of the
+// directory holding its manifest.json, which lists the files to fetch.
+type HTTPSource struct {
+	BaseURL    string
+	Downloader *Downloader
+	dir        string
+}
+
+func (s *HTTPSource) Name() string { return "url " + s.BaseURL }
+
+func (s *HTTPSource) Fetch() (string, error) {
+	base := strings.TrimSuffix(s.BaseURL, "/")
+	resp, err := s.Downloader.fetch(base+"/"+manifestFile, manifestFile, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch %s/%s: %w", base, manifestFile, err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(resp.Data, &manifest); err != nil {
+		return "", fmt.Errorf("invalid %s/%s: %w", base, manifestFile, err)
+	}
+
+	// The manifest becomes a registry whose spreadsheets are the work package
+	// directories and whose tabs are their files.
+	registry := &Registry{Source: base}
+	files := make(map[string]ManifestFile)
+	for _, spreadsheet := range manifest.Spreadsheets {
+		entry := Spreadsheet{Name: spreadsheet.Name, Id: spreadsheet.Name}
+		for _, file := range spreadsheet.Files {
+			entry.Sheets = append(entry.Sheets, Sheet{Name: file.Tab, Gid: file.Gid})
+			files[spreadsheet.Name+"/"+file.Tab] = file
+		}
+		registry.Spreadsheets = append(registry.Spreadsheets, entry)
+	}
+	if err := registry.validate(); err != nil {
+		return "", fmt.Errorf("invalid %s/%s: %w", base, manifestFile, err)
+	}
+
+	downloader := *s.Downloader
+	downloader.BaseURL = base
+	downloader.Cache = nil
+	downloader.URL = func(spreadsheet Spreadsheet, sheet Sheet) string {
+		return base + "/" + files[spreadsheet.Name+"/"+sheet.Name].Path
+	}
+	dir, err := downloader.Download(registry, []string{"all"})
+	s.dir = dir
+	if err != nil {
+		return dir, err
+	}
+
+	for key, file := range files {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(key)+".csv"))
+		if err == nil && hashOf(data) != file.SHA256 {
+			logger.Warning("File", file.Path, "of", base, "does not match the hash of its manifest")
+		}
+	}
+	return dir, nil
+}
+
+func (s *HTTPSource) Close() error { return removeTemp(s.dir) }
+
+func removeTemp(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
+
+// provenance records, for each work package and CSV file, where it came from.
+type provenance map[string]map[string]origin
+
+// origin is the source a CSV file came from, and its name in that source, e.g.
+// "wp5/dt_st.csv": the work package directory keeps the case it has on disk.
+type origin struct {
+	source Source
+	file   string
+}
+
+// combineSources fetches the sources in order and merges their work packages into a
+// temporary directory, file by file: a file provided by a later source replaces the
+// one of an earlier source, so that e.g. a local folder holding a corrected dt_st.csv
+// for WP7 overrides the downloaded one. What each source provided is printed. The
+// caller must close the sources and remove the returned directory.
+func combineSources(sources []Source) (string, provenance, error) {
+	dir, err := os.MkdirTemp("", "sources-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	known := make(map[string]bool)
+	for _, tab := range workbookTabs() {
+		known[tab+".csv"] = true
+	}
+
+	provided := make(provenance)
+	var report bytes.Buffer
+	for _, source := range sources {
+		logger.Info("Reading", source.Name())
+		srcDir, err := source.Fetch()
+		if err != nil {
+			return dir, nil, fmt.Errorf("%s: %w", source.Name(), err)
+		}
+		checkManifest(srcDir)
+		wpDirs, err := workPackageDirs(srcDir)
+		if err != nil {
+			return dir, nil, fmt.Errorf("%s: %w", source.Name(), err)
+		}
+
+		fmt.Fprintf(&report, "%s:", source.Name())
+		for _, wpDir := range wpDirs {
+			wp := workPackageName(wpDir)
+			entries, err := os.ReadDir(wpDir)
+			if err != nil {
+				return dir, nil, fmt.Errorf("error reading directory: %w", err)
+			}
+			if provided[wp] == nil {
+				provided[wp] = make(map[string]origin)
+			}
+			files, overridden := 0, 0
+			for _, entry := range entries {
+				name := strings.ToLower(entry.Name())
+				if entry.IsDir() || !known[name] {
+					continue
+				}
+				if previous, ok := provided[wp][name]; ok {
+					logger.Info(source.Name(), "overrides", wp+"/"+name, "of", previous.source.Name())
+					overridden++
+				}
+				if err := copyFile(filepath.Join(wpDir, entry.Name()), filepath.Join(dir, wp, name)); err != nil {
+					return dir, nil, err
+				}
+				provided[wp][name] = origin{source: source, file: path.Join(filepath.Base(wpDir), entry.Name())}
+				files++
+			}
+			fmt.Fprintf(&report, " %s (%d %s", wp, files, plural(files, "file"))
+			if overridden > 0 {
+				fmt.Fprintf(&report, ", %d overriding earlier sources", overridden)
+			}
+			report.WriteString(")")
+		}
+		report.WriteString("\n")
+	}
+
+	fmt.Print("Sources:\n" + indent(report.String()))
+	return dir, provided, nil
+}
+
+// sourceOf returns the name of the source a file of a work package came from.
+func (p provenance) sourceOf(wp, file string) string {
+	if origin, ok := p[wp][strings.ToLower(file)]; ok {
+		return origin.source.Name()
+	}
+	return ""
+}
+
+// fileOf returns the name a file of a work package has in its source, or "" when
+// it was not provided by any.
+func (p provenance) fileOf(wp, file string) string {
+	return p[wp][strings.ToLower(file)].file
+}
+
+// delimiterOf returns the delimiter of a file of a work package when its source
+// writes it with a known one, or 0 when it must be sniffed.
+func (p provenance) delimiterOf(wp, file string) rune {
+	if source, ok := p[wp][strings.ToLower(file)].source.(fixedDelimiter); ok {
+		return source.Delimiter()
+	}
+	return 0
+}
+
+func copyFile(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	r, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", from, err)
+	}
+	return w.Close()
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
+
+func indent(text string) string {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	return "  " + strings.Join(lines, "\n  ") + "\n"
+}
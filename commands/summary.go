@@ -0,0 +1,90 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// tableStats counts what happened to the rows of one sheet of a work package.
+type tableStats struct {
+	Imported   int
+	Skipped    int // incomplete rows
+	Duplicates int
+	// Dialect describes how the sheet was written, e.g. "semicolon+BOM+header".
+	Dialect string
+	// Source is the source the sheet came from, e.g. "dir ./data".
+	Source string
+}
+
+// importSummary collects the outcome of an import run, per work package and table.
+type importSummary struct {
+	stats map[string]map[string]*tableStats
+	// failed holds the error of every work package that was rolled back.
+	failed map[string]error
+}
+
+func newImportSummary() *importSummary {
+	return &importSummary{
+		stats:  make(map[string]map[string]*tableStats),
+		failed: make(map[string]error),
+	}
+}
+
+// table returns the counters of a table of a work package, creating them if needed.
+func (s *importSummary) table(wp, table string) *tableStats {
+	tables, ok := s.stats[wp]
+	if !ok {
+		tables = make(map[string]*tableStats)
+		s.stats[wp] = tables
+	}
+	stats, ok := tables[table]
+	if !ok {
+		stats = &tableStats{}
+		tables[table] = stats
+	}
+	return stats
+}
+
+// print writes the summary as a table, one row per work package and table, followed
+// by the work packages that were rolled back.
+func (s *importSummary) print() {
+	wps := make([]string, 0, len(s.stats))
+	for wp := range s.stats {
+		wps = append(wps, wp)
+	}
+	sort.Strings(wps)
+
+	fmt.Println("Import summary:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WP\tTABLE\tIMPORTED\tSKIPPED\tDUPLICATES\tFORMAT\tSOURCE")
+	total := tableStats{}
+	for _, wp := range wps {
+		tables := make([]string, 0, len(s.stats[wp]))
+		for table := range s.stats[wp] {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			stats := s.stats[wp][table]
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n", wp, table, stats.Imported, stats.Skipped, stats.Duplicates, stats.Dialect, stats.Source)
+			if _, failed := s.failed[wp]; !failed {
+				total.Imported += stats.Imported
+				total.Skipped += stats.Skipped
+				total.Duplicates += stats.Duplicates
+			}
+		}
+	}
+	fmt.Fprintf(w, "TOTAL\t\t%d\t%d\t%d\n", total.Imported, total.Skipped, total.Duplicates)
+	w.Flush()
+
+	failed := make([]string, 0, len(s.failed))
+	for wp := range s.failed {
+		failed = append(failed, wp)
+	}
+	sort.Strings(failed)
+	for _, wp := range failed {
+		fmt.Printf("%s was rolled back: %v\n", wp, s.failed[wp])
+	}
+}
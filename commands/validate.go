@@ -0,0 +1,337 @@
+package commands
+
+import (
+	"dt-geo-converter/vocabulary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Severity tells whether a validation issue prevents a correct import.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Issue is a problem found in a spreadsheet export.
+type Issue struct {
+	WP       string
+	File     string
+	Line     int // 0 when the issue concerns the whole file
+	Severity Severity
+	Message  string
+}
+
+// reference is an ID used by a relationship that must be declared in another sheet.
+type reference struct {
+	ID       string
+	Type     string
+	Severity Severity
+	Issue    Issue
+}
+
+// declaringSheets tells, for each entity type, which sheet declares its IDs.
+var declaringSheets = map[string]string{
+	"WF": "wf.csv",
+	"ST": "st_wf.csv",
+	"SS": "ss_st.csv",
+}
+
+// validator checks the CSV files of one or more work packages.
+type validator struct {
+	vocab      *vocabulary.Vocabulary
+	issues     []Issue
+	declared   map[string]map[string]bool
+	references []reference
+	// delimiter is the delimiter of the files, or 0 to sniff it.
+	delimiter rune
+}
+
+// ValidateCSV checks the CSV files in 'dir' (laid out as for InitDatabase) without
+// touching any database, prints the issues grouped by work package and file, and
+// returns the number of errors found. The delimiter of the files is sniffed unless
+// one is given, e.g. for a download of the remote spreadsheets.
+func ValidateCSV(dir string, vocab *vocabulary.Vocabulary, delimiter rune) (int, error) {
+	dirs, err := workPackageDirs(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	v := &validator{
+		vocab:     vocab,
+		declared:  map[string]map[string]bool{"WF": {}, "ST": {}, "SS": {}},
+		delimiter: delimiter,
+	}
+	for _, d := range dirs {
+		v.validateWorkPackage(d)
+	}
+	v.resolveReferences()
+
+	return printIssues(v.issues), nil
+}
+
+// validateWorkPackage checks every sheet of a work package directory.
+func (v *validator) validateWorkPackage(dir string) {
+	wp := workPackageName(dir)
+
+	v.validateWF(wp, filepath.Join(dir, "wf.csv"))
+	for _, sheet := range relationshipSheets {
+		file := filepath.Join(dir, sheet.File)
+		if _, err := os.Stat(file); os.IsNotExist(err) && sheet.Optional {
+			continue
+		}
+		v.validateRelationships(wp, sheet, file)
+	}
+	for _, sheet := range entitySheets {
+		file := filepath.Join(dir, sheet.File)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		v.validateEntities(wp, sheet, file)
+	}
+}
+
+// read returns the records of a file, reporting missing files and malformed rows.
+func (v *validator) read(wp, file string, columns []column) []record {
+	name := filepath.Base(file)
+	records, _, err := readRecords(file, columns, v.delimiter)
+	if err != nil {
+		issue := Issue{WP: wp, File: name, Severity: SeverityError}
+		var parseErr *csv.ParseError
+		switch {
+		case os.IsNotExist(err):
+			issue.Message = "file is missing"
+		case errors.As(err, &parseErr):
+			issue.Line = parseErr.Line
+			issue.Message = fmt.Sprintf("malformed CSV, the rest of the file would be ignored: %v", parseErr.Err)
+		default:
+			issue.Message = err.Error()
+		}
+		v.issues = append(v.issues, issue)
+	}
+	return records
+}
+
+// validateWF checks the workflows declared in wf.csv.
+func (v *validator) validateWF(wp, file string) {
+	name := filepath.Base(file)
+	seen := make(map[string]int)
+	for _, rec := range v.read(wp, file, wfColumns) {
+		if isBlank(rec.Fields) {
+			continue
+		}
+		issue := Issue{WP: wp, File: name, Line: rec.Line}
+		v.checkWhitespace(issue, rec.Fields, 3)
+
+		id := safeAccess(rec.Fields, 0)
+		if id == "" {
+			v.add(issue, SeverityError, "workflow ID is empty")
+			continue
+		}
+		v.checkIDType(issue, id, "WF", 1)
+		if line, ok := seen[id]; ok {
+			v.add(issue, SeverityWarning, fmt.Sprintf("duplicate of line %d, it would be skipped", line))
+			continue
+		}
+		seen[id] = rec.Line
+		v.declared["WF"][id] = true
+	}
+}
+
+// validateEntities checks an entity attribute sheet.
+func (v *validator) validateEntities(wp string, sheet entitySheet, file string) {
+	seen := make(map[string]int)
+	for _, rec := range v.read(wp, file, entitySheetColumns(sheet.Table)) {
+		if isBlank(rec.Fields) {
+			continue
+		}
+		issue := Issue{WP: wp, File: sheet.File, Line: rec.Line}
+		v.checkWhitespace(issue, rec.Fields, len(entityColumns)+1)
+
+		id := safeAccess(rec.Fields, 0)
+		if id == "" {
+			v.add(issue, SeverityError, "ID is empty, the row would be skipped")
+			continue
+		}
+		v.checkIDType(issue, id, sheet.Table, 1)
+		if line, ok := seen[id]; ok {
+			v.add(issue, SeverityWarning, fmt.Sprintf("duplicate of line %d, it would be skipped", line))
+			continue
+		}
+		seen[id] = rec.Line
+	}
+}
+
+// validateRelationships checks a relationship sheet.
+func (v *validator) validateRelationships(wp string, sheet relationshipSheet, file string) {
+	types := strings.Split(sheet.Table, "_")
+	seen := make(map[string]int)
+	for _, rec := range v.read(wp, file, relationshipColumns(sheet.Table)) {
+		if isBlank(rec.Fields) {
+			continue
+		}
+		issue := Issue{WP: wp, File: sheet.File, Line: rec.Line}
+		v.checkWhitespace(issue, rec.Fields, 3)
+
+		if len(rec.Fields) < 3 {
+			v.add(issue, SeverityError, fmt.Sprintf("row has %d columns instead of 3, it would be skipped", len(rec.Fields)))
+			continue
+		}
+		id1, relType, id2 := safeAccess(rec.Fields, 0), safeAccess(rec.Fields, 1), safeAccess(rec.Fields, 2)
+		if id1 == "" || relType == "" || id2 == "" {
+			v.add(issue, SeverityError, "row has empty values, it would be skipped")
+			continue
+		}
+
+		// The vocabulary only allows reversed aliases in tables with the same type on
+		// both sides, so the columns can be checked before canonicalization.
+		v.checkIDType(issue, id1, types[0], 1)
+		v.checkIDType(issue, id2, types[1], 3)
+
+		term, ok := v.vocab.Lookup(sheet.Table, relType)
+		if !ok {
+			v.add(issue, SeverityError, fmt.Sprintf("unknown relationship type %q", relType))
+			continue
+		}
+		if term.Reverse {
+			id1, id2 = id2, id1
+		}
+
+		key := id1 + "\x00" + string(term.Kind) + "\x00" + id2
+		if line, ok := seen[key]; ok {
+			v.add(issue, SeverityWarning, fmt.Sprintf("duplicate of line %d, it would be skipped", line))
+			continue
+		}
+		seen[key] = rec.Line
+
+		v.collect(sheet.Table, id1, id2, issue)
+	}
+}
+
+// collect records the IDs declared and referenced by a canonical relationship row.
+func (v *validator) collect(table, id1, id2 string, issue Issue) {
+	switch table {
+	case "ST_WF":
+		v.declared["ST"][id1] = true
+		v.reference(id2, "WF", SeverityError, issue)
+	case "SS_ST":
+		v.declared["SS"][id1] = true
+		v.reference(id2, "ST", SeverityError, issue)
+	case "DT_ST":
+		v.reference(id2, "ST", SeverityError, issue)
+	case "DT_SS":
+		v.reference(id2, "SS", SeverityError, issue)
+	case "ST_ST":
+		v.reference(id1, "ST", SeverityError, issue)
+		v.reference(id2, "ST", SeverityError, issue)
+	case "SS_SS":
+		v.reference(id1, "SS", SeverityError, issue)
+		v.reference(id2, "SS", SeverityError, issue)
+	case "WF_WF":
+		// Workflows often feed workflows of other work packages.
+		v.reference(id1, "WF", SeverityWarning, issue)
+		v.reference(id2, "WF", SeverityWarning, issue)
+	}
+}
+
+func (v *validator) reference(id, idType string, severity Severity, issue Issue) {
+	v.references = append(v.references, reference{ID: id, Type: idType, Severity: severity, Issue: issue})
+}
+
+// resolveReferences reports the IDs that are used but never declared in any of the
+// validated work packages.
+func (v *validator) resolveReferences() {
+	for _, ref := range v.references {
+		if v.declared[ref.Type][ref.ID] {
+			continue
+		}
+		v.add(ref.Issue, ref.Severity, fmt.Sprintf("%s is not declared in %s", ref.ID, declaringSheets[ref.Type]))
+	}
+}
+
+// checkIDType reports IDs whose prefix does not match the entity type expected in their column.
+func (v *validator) checkIDType(issue Issue, id, expected string, column int) {
+	if !strings.HasPrefix(strings.ToUpper(id), expected) {
+		v.add(issue, SeverityError, fmt.Sprintf("%s in column %d should be a %s ID", id, column, expected))
+	}
+}
+
+// checkWhitespace reports values polluted by leading, trailing or repeated whitespace
+// among the first n fields.
+func (v *validator) checkWhitespace(issue Issue, fields []string, n int) {
+	for i, f := range fields {
+		if i >= n {
+			break
+		}
+		if f != strings.Join(strings.Fields(f), " ") && strings.TrimSpace(f) != "" {
+			v.add(issue, SeverityWarning, fmt.Sprintf("value %q in column %d has extra whitespace", f, i+1))
+		}
+	}
+}
+
+func (v *validator) add(issue Issue, severity Severity, message string) {
+	issue.Severity = severity
+	issue.Message = message
+	v.issues = append(v.issues, issue)
+}
+
+func isBlank(fields []string) bool {
+	for _, f := range fields {
+		if strings.TrimSpace(f) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// printIssues prints the issues grouped by work package and file, and returns the
+// number of errors.
+func printIssues(issues []Issue) int {
+	sort.SliceStable(issues, func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		if a.WP != b.WP {
+			return a.WP < b.WP
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+
+	errorCount, warningCount := 0, 0
+	lastWP, lastFile := "", ""
+	for _, issue := range issues {
+		if issue.WP != lastWP {
+			fmt.Println(issue.WP)
+			lastWP, lastFile = issue.WP, ""
+		}
+		if issue.File != lastFile {
+			fmt.Println("  " + issue.File)
+			lastFile = issue.File
+		}
+		location := "file"
+		if issue.Line > 0 {
+			location = fmt.Sprintf("line %d", issue.Line)
+		}
+		fmt.Printf("    %s: %s: %s\n", location, issue.Severity, issue.Message)
+
+		if issue.Severity == SeverityError {
+			errorCount++
+		} else {
+			warningCount++
+		}
+	}
+
+	if len(issues) == 0 {
+		fmt.Println("No problems found.")
+	} else {
+		fmt.Printf("Found %d errors and %d warnings.\n", errorCount, warningCount)
+	}
+	return errorCount
+}
@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"dt-geo-converter/logger"
+	"dt-geo-converter/workbook"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractWorkbooks writes the tabs of the given .xlsx or .ods workbooks as CSV files
+// in a temporary directory laid out as expected by InitDatabase: each workbook is a
+// work package named after its file, e.g. "WP5.xlsx" becomes the WP5 directory.
+// Tabs are found by name (wf, wf_wf, st_wf, ...); the ones that are missing are left
+// to the import to report. The caller must remove the directory.
+func ExtractWorkbooks(paths []string) (string, error) {
+	dir, err := os.MkdirTemp("", "workbooks-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	for _, path := range paths {
+		wp := workPackageName(strings.TrimSuffix(path, filepath.Ext(path)))
+		wpDir := filepath.Join(dir, wp)
+		if err := os.Mkdir(wpDir, 0755); err != nil {
+			if os.IsExist(err) {
+				return dir, fmt.Errorf("more than one workbook for work package %s", wp)
+			}
+			return dir, fmt.Errorf("failed to create directory for workbook %s: %w", path, err)
+		}
+
+		logger.Info("Reading workbook", path, "for work package", wp)
+		sheets, err := workbook.Read(path)
+		if err != nil {
+			return dir, err
+		}
+		for _, name := range workbookTabs() {
+			sheet, ok := workbook.Find(sheets, name)
+			if !ok {
+				logger.Debug("Workbook", path, "has no", name, "tab")
+				continue
+			}
+			if err := writeCSV(filepath.Join(wpDir, name+".csv"), sheet.Rows); err != nil {
+				return dir, fmt.Errorf("failed to extract tab %s of %s: %w", name, path, err)
+			}
+		}
+	}
+	return dir, nil
+}
+
+// workbookTabs returns the names of the tabs read from a workbook: one per CSV file
+// of a work package directory.
+func workbookTabs() []string {
+	tabs := []string{"wf"}
+	for _, sheet := range relationshipSheets {
+		tabs = append(tabs, strings.TrimSuffix(sheet.File, ".csv"))
+	}
+	for _, sheet := range entitySheets {
+		tabs = append(tabs, strings.TrimSuffix(sheet.File, ".csv"))
+	}
+	return tabs
+}
+
+// writeCSV writes rows to a CSV file, one line per row, so that line numbers match
+// the spreadsheet rows.
+func writeCSV(filename string, rows [][]string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+	return file.Close()
+}
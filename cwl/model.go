@@ -9,8 +9,10 @@ import (
 
 // Cwl represents the top-level CWL workflow.
 type Cwl struct {
-	CWLVersion   string                       `yaml:"cwlVersion"`
+	CWLVersion   string                       `yaml:"cwlVersion,omitempty"` // left out of workflows written inline in a step
 	Class        string                       `yaml:"class"`
+	Label        string                       `yaml:"label,omitempty"`
+	Doc          string                       `yaml:"doc,omitempty"`
 	Inputs       map[string]any               `yaml:"inputs"` // TODO find a better way to represent both IOType and Dataset instead of any
 	Outputs      map[string]Output            `yaml:"outputs"`
 	Requirements map[string]map[string]string `yaml:"requirements,omitempty"`
@@ -22,13 +24,17 @@ type Output struct {
 	Type         IOType `yaml:"type"`
 	OutputSource any    `yaml:"outputSource"`
 	LinkMerge    string `yaml:"linkMerge,omitempty"`
+	Label        string `yaml:"label,omitempty"`
+	Doc          string `yaml:"doc,omitempty"`
 }
 
 // Step represents a step in the CWL workflow.
 type Step struct {
-	Run any               `yaml:"run,omitempty"` // TODO find a better way to represent both Run and string objects instead of any
-	In  map[string]string `yaml:"in"`
-	Out []string          `yaml:"out"`
+	Run   any               `yaml:"run,omitempty"` // TODO find a better way to represent both Run and string objects instead of any
+	Label string            `yaml:"label,omitempty"`
+	Doc   string            `yaml:"doc,omitempty"`
+	In    map[string]string `yaml:"in"`
+	Out   []string          `yaml:"out"`
 }
 
 // Run represents the run section of a step.
@@ -42,8 +48,9 @@ type Run struct {
 type IOType string
 
 type Input struct {
-	Type IOType `yaml:"type"`
-	Docs string `yaml:"docs,omitempty"`
+	Type  IOType `yaml:"type"`
+	Label string `yaml:"label,omitempty"`
+	Doc   string `yaml:"doc,omitempty"`
 }
 
 const (
@@ -52,8 +59,14 @@ const (
 	FileArray IOType = "File[]"
 )
 
+// Marshal returns the YAML document of the CWL description. Maps are written with
+// their keys sorted, so the same description always gives the same bytes.
+func (c Cwl) Marshal() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
 func (c Cwl) SaveToFile(name string) error {
-	v, err := yaml.Marshal(c)
+	v, err := c.Marshal()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,271 @@
+// Package googleauth authorizes requests to Google APIs with the credentials of a
+// service account or of a user, so that spreadsheets that are not shared publicly
+// can be exported. Access tokens are obtained and refreshed as needed, and are
+// never logged.
+package googleauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scope gives read access to the spreadsheets the credentials can open.
+const Scope = "https://www.googleapis.com/auth/drive.readonly"
+
+const defaultTokenURL = "https://oauth2.googleapis.com/token"
+
+// Environment variables read by FromEnv: the path of a credentials file, or the
+// content of one.
+const (
+	EnvFile    = "GOOGLE_APPLICATION_CREDENTIALS"
+	EnvContent = "DT_GEO_GOOGLE_CREDENTIALS"
+)
+
+// credentialsFile holds the fields of the supported credential files: a service
+// account key ("type": "service_account"), the credentials of a user
+// ("type": "authorized_user"), or an OAuth token ("access_token", with an optional
+// refresh token and client to refresh it).
+type credentialsFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+	AccessToken  string `json:"access_token"`
+	Expiry       string `json:"expiry"`
+}
+
+// Credentials issues the access tokens that authorize requests. It is safe for
+// concurrent use.
+type Credentials struct {
+	// Description tells what the credentials are, without revealing any secret,
+	// e.g. "service account robot@project.iam.gserviceaccount.com".
+	Description string
+
+	file credentialsFile
+	// Client sends the token requests.
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// Load reads the credentials file at path.
+func Load(path string) (*Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+	c, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// FromEnv returns the credentials given by the environment: the content of
+// DT_GEO_GOOGLE_CREDENTIALS, or the file named by GOOGLE_APPLICATION_CREDENTIALS.
+// It returns nil when neither is set.
+func FromEnv() (*Credentials, error) {
+	if content := os.Getenv(EnvContent); content != "" {
+		c, err := Parse([]byte(content))
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials in %s: %w", EnvContent, err)
+		}
+		return c, nil
+	}
+	if path := os.Getenv(EnvFile); path != "" {
+		return Load(path)
+	}
+	return nil, nil
+}
+
+// Parse decodes a credentials file. Errors never include the secrets of the file.
+func Parse(data []byte) (*Credentials, error) {
+	var f credentialsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		// The JSON error may quote part of the file.
+		return nil, errors.New("not a JSON credentials file")
+	}
+	if f.TokenURI == "" {
+		f.TokenURI = defaultTokenURL
+	}
+
+	c := &Credentials{file: f, client: &http.Client{Timeout: 30 * time.Second}}
+	switch {
+	case f.Type == "service_account":
+		if f.ClientEmail == "" || f.PrivateKey == "" {
+			return nil, errors.New("service account key without client_email or private_key")
+		}
+		if _, err := parsePrivateKey(f.PrivateKey); err != nil {
+			return nil, err
+		}
+		c.Description = "service account " + f.ClientEmail
+	case f.Type == "authorized_user":
+		if !f.canRefresh() {
+			return nil, errors.New("user credentials without client_id, client_secret or refresh_token")
+		}
+		c.Description = "user credentials of client " + f.ClientID
+	case f.AccessToken != "" || f.RefreshToken != "":
+		if f.AccessToken == "" && !f.canRefresh() {
+			return nil, errors.New("OAuth token without access_token, or without client_id and client_secret to refresh it")
+		}
+		if f.Expiry != "" {
+			expiry, err := time.Parse(time.RFC3339, f.Expiry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid expiry %q", f.Expiry)
+			}
+			c.expiry = expiry
+		}
+		c.token = f.AccessToken
+		c.Description = "OAuth token"
+	default:
+		return nil, errors.New("unsupported credentials, expected a service account key, user credentials or an OAuth token")
+	}
+	return c, nil
+}
+
+func (f credentialsFile) canRefresh() bool {
+	return f.ClientID != "" && f.ClientSecret != "" && f.RefreshToken != ""
+}
+
+// String describes the credentials without revealing any secret.
+func (c *Credentials) String() string {
+	return c.Description
+}
+
+// SetTokenURL replaces the token endpoint of the credentials, e.g. with a local
+// server in tests.
+func (c *Credentials) SetTokenURL(tokenURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.file.TokenURI = tokenURL
+}
+
+// Token returns a valid access token, requesting a new one when the current one is
+// missing or about to expire.
+func (c *Credentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && (c.expiry.IsZero() || time.Until(c.expiry) > time.Minute) {
+		return c.token, nil
+	}
+
+	var form url.Values
+	switch {
+	case c.file.Type == "service_account":
+		assertion, err := c.file.assertion(time.Now())
+		if err != nil {
+			return "", err
+		}
+		form = url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+	case c.file.canRefresh():
+		form = url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {c.file.ClientID},
+			"client_secret": {c.file.ClientSecret},
+			"refresh_token": {c.file.RefreshToken},
+		}
+	default:
+		return "", fmt.Errorf("the OAuth token expired on %s and cannot be refreshed", c.expiry.Format(time.RFC3339))
+	}
+
+	token, expiry, err := c.requestToken(ctx, form)
+	if err != nil {
+		return "", err
+	}
+	c.token, c.expiry = token, expiry
+	return token, nil
+}
+
+// tokenResponse is the answer of the token endpoint.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// requestToken posts a token request. Only the error code of a failed request is
+// reported, as the response may echo parts of the request.
+func (c *Credentials) requestToken(ctx context.Context, form url.Values) (string, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.file.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid token endpoint: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body tokenResponse
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token request failed: %w", err)
+	}
+	_ = json.Unmarshal(data, &body)
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		if body.Error != "" {
+			return "", time.Time{}, fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, body.Error)
+		}
+		return "", time.Time{}, fmt.Errorf("token request failed with status %d", resp.StatusCode)
+	}
+
+	expiry := time.Time{}
+	if body.ExpiresIn > 0 {
+		expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return body.AccessToken, expiry, nil
+}
+
+// Client returns an HTTP client that authorizes every request it sends with the
+// credentials, using base for the requests. It must only be used for requests to
+// Google, or to a local server in tests.
+func (c *Credentials) Client(base *http.Client) *http.Client {
+	if base == nil {
+		base = http.DefaultClient
+	}
+	client := *base
+	transport := base.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	client.Transport = &authTransport{credentials: c, base: transport}
+	return &client
+}
+
+// authTransport adds the Authorization header to requests. Being a transport, it
+// also authorizes the redirects of the export endpoints.
+type authTransport struct {
+	credentials *Credentials
+	base        http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.credentials.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,303 @@
+package googleauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTokenServer is a token endpoint answering every request with handle, and
+// counting the requests.
+type fakeTokenServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+}
+
+func newFakeTokenServer(t *testing.T, handle func(w http.ResponseWriter, form map[string]string)) *fakeTokenServer {
+	server := &fakeTokenServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mu.Lock()
+		server.requests++
+		server.mu.Unlock()
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		form := make(map[string]string)
+		for key := range r.PostForm {
+			form[key] = r.PostForm.Get(key)
+		}
+		handle(w, form)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *fakeTokenServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func writeToken(w http.ResponseWriter, token string, expiresIn int) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"access_token": token, "expires_in": expiresIn, "token_type": "Bearer"})
+}
+
+// serviceAccountKey returns a service account key file with a new RSA key.
+func serviceAccountKey(t *testing.T) ([]byte, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "robot@project.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, key
+}
+
+// verifyAssertion checks the signature of a JWT and returns its claims.
+func verifyAssertion(assertion string, key *rsa.PublicKey) (map[string]any, error) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the assertion is not a JWT")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]any
+	return claims, json.Unmarshal(payload, &claims)
+}
+
+func TestServiceAccountExchangesSignedAssertion(t *testing.T) {
+	data, key := serviceAccountKey(t)
+	c, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	var claims map[string]any
+	var verifyErr error
+	server := newFakeTokenServer(t, func(w http.ResponseWriter, form map[string]string) {
+		if form["grant_type"] != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+			return
+		}
+		claims, verifyErr = verifyAssertion(form["assertion"], &key.PublicKey)
+		writeToken(w, "service-account-token", 3600)
+	})
+	c.SetTokenURL(server.URL + "/token")
+
+	for range 2 {
+		token, err := c.Token(context.Background())
+		if err != nil {
+			t.Fatalf("Token failed: %v", err)
+		}
+		if token != "service-account-token" {
+			t.Errorf("Token = %q, want service-account-token", token)
+		}
+	}
+	if verifyErr != nil {
+		t.Fatalf("invalid assertion: %v", verifyErr)
+	}
+	if claims["iss"] != "robot@project.iam.gserviceaccount.com" || claims["aud"] != server.URL+"/token" || claims["scope"] != Scope {
+		t.Errorf("unexpected claims %v", claims)
+	}
+	if got := server.count(); got != 1 {
+		t.Errorf("%d token requests, want 1 as the token is still valid", got)
+	}
+}
+
+func TestRefreshTokenRenewedOnExpiry(t *testing.T) {
+	data, err := json.Marshal(map[string]string{
+		"access_token":  "expired-token",
+		"expiry":        time.Now().Add(-time.Hour).Format(time.RFC3339),
+		"refresh_token": "refresh-token",
+		"client_id":     "client-id",
+		"client_secret": "client-secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	server := newFakeTokenServer(t, func(w http.ResponseWriter, form map[string]string) {
+		if form["grant_type"] != "refresh_token" || form["refresh_token"] != "refresh-token" ||
+			form["client_id"] != "client-id" || form["client_secret"] != "client-secret" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		// The token expires within the renewal margin, so it is renewed every time.
+		writeToken(w, "renewed-token", 30)
+	})
+	c.SetTokenURL(server.URL)
+
+	for range 2 {
+		token, err := c.Token(context.Background())
+		if err != nil {
+			t.Fatalf("Token failed: %v", err)
+		}
+		if token != "renewed-token" {
+			t.Errorf("Token = %q, want renewed-token", token)
+		}
+	}
+	if got := server.count(); got != 2 {
+		t.Errorf("%d token requests, want 2", got)
+	}
+}
+
+func TestUnexpiredTokenUsedAsIs(t *testing.T) {
+	data, err := json.Marshal(map[string]string{
+		"access_token": "current-token",
+		"expiry":       time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	server := newFakeTokenServer(t, func(w http.ResponseWriter, form map[string]string) {
+		writeToken(w, "unexpected-token", 3600)
+	})
+	c.SetTokenURL(server.URL)
+
+	if token, err := c.Token(context.Background()); err != nil || token != "current-token" {
+		t.Errorf("Token = %q, %v; want current-token", token, err)
+	}
+	if got := server.count(); got != 0 {
+		t.Errorf("%d token requests, want none", got)
+	}
+}
+
+func TestClientAuthorizesExportRequests(t *testing.T) {
+	data, _ := serviceAccountKey(t)
+	c, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	tokens := newFakeTokenServer(t, func(w http.ResponseWriter, form map[string]string) {
+		writeToken(w, "export-token", 3600)
+	})
+	c.SetTokenURL(tokens.URL)
+
+	export := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer export-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write([]byte("WF5101,Workflow,Author\n"))
+	}))
+	defer export.Close()
+
+	resp, err := c.Client(export.Client()).Get(export.URL + "/spreadsheets/d/id/export?format=csv&gid=0")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("export answered with status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestErrorsDoNotRevealSecrets(t *testing.T) {
+	const secret = "do-not-print-this-secret"
+
+	t.Run("malformed file", func(t *testing.T) {
+		_, err := Parse([]byte(`{"type": "authorized_user", "client_secret": "` + secret + `", "refresh_token": 42}`))
+		if err == nil {
+			t.Fatal("Parse succeeded, want an error")
+		}
+		if strings.Contains(err.Error(), secret) {
+			t.Errorf("error %q reveals the secret", err)
+		}
+	})
+
+	t.Run("invalid private key", func(t *testing.T) {
+		block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte(secret)})
+		data, _ := json.Marshal(map[string]string{
+			"type":         "service_account",
+			"client_email": "robot@project.iam.gserviceaccount.com",
+			"private_key":  string(block),
+		})
+		_, err := Parse(data)
+		if err == nil {
+			t.Fatal("Parse succeeded, want an error")
+		}
+		if strings.Contains(err.Error(), secret) || strings.Contains(err.Error(), base64.StdEncoding.EncodeToString([]byte(secret))) {
+			t.Errorf("error %q reveals the private key", err)
+		}
+	})
+
+	t.Run("rejected token request", func(t *testing.T) {
+		data, _ := json.Marshal(map[string]string{
+			"type":          "authorized_user",
+			"client_id":     "client-id",
+			"client_secret": secret,
+			"refresh_token": secret + "-refresh",
+		})
+		c, err := Parse(data)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		server := newFakeTokenServer(t, func(w http.ResponseWriter, form map[string]string) {
+			// The endpoint echoes the request in its description.
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error":             "invalid_grant",
+				"error_description": "bad refresh token " + form["refresh_token"] + " for " + form["client_secret"],
+			})
+		})
+		c.SetTokenURL(server.URL)
+
+		_, err = c.Token(context.Background())
+		if err == nil {
+			t.Fatal("Token succeeded, want an error")
+		}
+		if !strings.Contains(err.Error(), "invalid_grant") {
+			t.Errorf("error %q does not report the error code", err)
+		}
+		if strings.Contains(err.Error(), secret) {
+			t.Errorf("error %q reveals the secret", err)
+		}
+	})
+}
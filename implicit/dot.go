@@ -0,0 +1,104 @@
+package implicit
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"text/template"
+
+	"github.com/dominikbraun/graph"
+)
+
+// dotTemplate is the layout of draw.DOT from github.com/dominikbraun/graph, which
+// lists vertices and edges in map order. writeDOT sorts them instead, so that the
+// same graph always gives the same file.
+const dotTemplate = `strict {{.GraphType}} {
+{{range $k, $v := .Attributes}}
+	{{$k}}="{{$v}}";
+{{end}}
+{{range $s := .Statements}}
+	"{{.Source}}" {{if .Target}}{{$.EdgeOperator}} "{{.Target}}" [ {{range $k, $v := .EdgeAttributes}}{{$k}}="{{$v}}", {{end}} weight={{.EdgeWeight}} ]{{else}}[ {{range $k, $v := .SourceAttributes}}{{$k}}="{{$v}}", {{end}} weight={{.SourceWeight}} ]{{end}};
+{{end}}
+{{- range .Clusters}}{{template "cluster" .}}
+{{end}}
+}
+{{define "cluster"}}
+	subgraph "cluster_{{.Name}}" {
+		label="{{.Name}}";
+		style="rounded";
+{{- range .Vertices}}
+		"{{.}}";
+{{- end}}
+{{- range .Clusters}}{{template "cluster" .}}{{end}}
+	}
+{{- end}}`
+
+type dotDescription struct {
+	GraphType    string
+	Attributes   map[string]string
+	EdgeOperator string
+	Statements   []dotStatement
+	Clusters     []dotCluster
+}
+
+// dotCluster draws vertices of a graph in a box, e.g. the children of a step in
+// the box of their parent. Clusters can be nested.
+type dotCluster struct {
+	Name     string
+	Vertices []string
+	Clusters []dotCluster
+}
+
+type dotStatement struct {
+	Source           string
+	Target           string
+	SourceWeight     int
+	SourceAttributes map[string]string
+	EdgeWeight       int
+	EdgeAttributes   map[string]string
+}
+
+var dotTmpl = template.Must(template.New("dot").Parse(dotTemplate))
+
+// writeDOT renders a graph in the DOT language, with its vertices and their edges
+// sorted by hash, and the given clusters after them.
+func writeDOT[T any](g graph.Graph[string, T], w io.Writer, clusters ...dotCluster) error {
+	desc := dotDescription{
+		GraphType:    "graph",
+		Attributes:   make(map[string]string),
+		EdgeOperator: "--",
+		Clusters:     clusters,
+	}
+	if g.Traits().IsDirected {
+		desc.GraphType = "digraph"
+		desc.EdgeOperator = "->"
+	}
+
+	adjacencyMap, err := g.AdjacencyMap()
+	if err != nil {
+		return fmt.Errorf("failed to generate DOT description: %w", err)
+	}
+	for _, vertex := range slices.Sorted(maps.Keys(adjacencyMap)) {
+		_, properties, err := g.VertexWithProperties(vertex)
+		if err != nil {
+			return fmt.Errorf("failed to generate DOT description: %w", err)
+		}
+		desc.Statements = append(desc.Statements, dotStatement{
+			Source:           vertex,
+			SourceWeight:     properties.Weight,
+			SourceAttributes: properties.Attributes,
+		})
+		adjacencies := adjacencyMap[vertex]
+		for _, target := range slices.Sorted(maps.Keys(adjacencies)) {
+			edge := adjacencies[target]
+			desc.Statements = append(desc.Statements, dotStatement{
+				Source:         vertex,
+				Target:         target,
+				EdgeWeight:     edge.Properties.Weight,
+				EdgeAttributes: edge.Properties.Attributes,
+			})
+		}
+	}
+	return dotTmpl.Execute(w, desc)
+}
@@ -5,47 +5,41 @@ import (
 	"dt-geo-converter/cwl"
 	"dt-geo-converter/logger"
 	"dt-geo-converter/model"
+	"dt-geo-converter/vocabulary"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/dominikbraun/graph"
 )
 
-// WorkflowToCWL converts a workflow to a CWL description.
-func WorkflowToCWL(workflow Workflow, db *sql.DB) (cwl.Cwl, error) {
+// WorkflowToCWL converts a workflow to a CWL description. stepCWLs holds the CWL
+// descriptions of its steps, by ID, as generated by StepToCWL.
+func WorkflowToCWL(workflow Workflow, db *sql.DB, stepCWLs map[string]cwl.Cwl) (cwl.Cwl, error) {
 	logger.Debug("Starting conversion for workflow", workflow.Name)
 	cwlInputs := make(map[string]any)
 	cwlOutputs := make(map[string]cwl.Output)
 	steps := make(map[string]cwl.Step)
 
-	// Retrieve DT-ST relationships for the workflow.
-	dtst, err := model.GetDTSTRelationshipsForWF(db, workflow.Name)
+	// The datasets generated by the steps are outputs of the workflow, the others inputs.
+	inputIDs, outputIDs, err := workflowInterface(db, workflow.Name)
 	if err != nil {
-		logger.Error("Failed to retrieve DT-ST relationships for workflow", workflow.Name, ":", err)
+		logger.Error("Failed to retrieve the datasets of workflow", workflow.Name, ":", err)
 		return cwl.Cwl{}, err
 	}
-
-	// Build maps of dataset IDs for inputs and outputs.
 	inputs, outputs := make(map[string]string), make(map[string]string)
-	for _, relationship := range dtst {
-		switch relationship.RelationshipType {
-		case "is input to", "is the input to", "is input from":
-			// Inputs will be processed later.
-			continue
-		case "is output to", "is updated by", "is the output from", "is generated by", "is output from":
-			outputs[relationship.DTID] = relationship.DTID
-		default:
-			logger.Debug("Unknown DT-ST relationship type:", relationship.RelationshipType)
-		}
+	for _, dt := range inputIDs {
+		inputs[dt] = dt
+	}
+	for _, dt := range outputIDs {
+		outputs[dt] = dt
 	}
-
-	// Identify inputs as datasets that are not outputs.
 	dts, err := model.GetDTsForWF(db, workflow.Name)
 	if err != nil {
 		logger.Error("Failed to retrieve datasets for workflow", workflow.Name, ":", err)
 		return cwl.Cwl{}, err
 	}
-	for _, dt := range dts {
-		if _, found := outputs[dt.ID]; !found {
-			inputs[dt.ID] = dt.ID
-		}
-	}
 
 	// Process dataset sources and determine if multiple sources are detected.
 	outputSources := make(map[string][]string)
@@ -61,7 +55,7 @@ func WorkflowToCWL(workflow Workflow, db *sql.DB) (cwl.Cwl, error) {
 			continue
 		}
 
-		// For inputs, assign the first available source.
+		// For inputs, assign the first source in topological order.
 		if _, isInput := inputs[dt.ID]; isInput {
 			inputs[dt.ID] = ds[0] + "/" + inputs[dt.ID]
 			logger.Debug("Input dataset", dt.ID, "assigned source", ds[0])
@@ -81,9 +75,25 @@ func WorkflowToCWL(workflow Workflow, db *sql.DB) (cwl.Cwl, error) {
 		}
 	}
 
+	// Describe dataset composition and derivation in the documentation of inputs and outputs.
+	dtdt, err := model.GetDTDTRelationshipsForWF(db, workflow.Name)
+	if err != nil {
+		logger.Error("Failed to retrieve DT-DT relationships for workflow", workflow.Name, ":", err)
+		return cwl.Cwl{}, err
+	}
+	lineage := datasetLineage(dtdt)
+	datasets := make(map[string]model.Attributes, len(dts))
+	for _, dt := range dts {
+		datasets[dt.ID] = dt.Attributes
+	}
+
 	// Build CWL inputs.
 	for dt := range inputs {
-		cwlInputs[dt] = cwl.Input{Type: cwl.Directory}
+		cwlInputs[dt] = cwl.Input{
+			Type:  cwl.Directory,
+			Label: datasets[dt].Name,
+			Doc:   describe(datasets[dt], lineage[dt]),
+		}
 	}
 
 	// Build CWL outputs.
@@ -94,6 +104,8 @@ func WorkflowToCWL(workflow Workflow, db *sql.DB) (cwl.Cwl, error) {
 				Type:         newType,
 				OutputSource: []any{},
 				LinkMerge:    "merge_flattened",
+				Label:        datasets[dt].Name,
+				Doc:          describe(datasets[dt], lineage[dt]),
 			}
 			tmp := cwlOutputs[dt]
 			for _, src := range sources {
@@ -102,15 +114,26 @@ func WorkflowToCWL(workflow Workflow, db *sql.DB) (cwl.Cwl, error) {
 			cwlOutputs[dt] = tmp
 			logger.Debug("Output dataset", dt, "assigned multiple sources", sources)
 		} else if sources, exists := outputSources[dt]; exists {
-			cwlOutputs[dt] = cwl.Output{
+			out := cwl.Output{
 				Type:         cwl.Directory,
 				OutputSource: []any{sources[0]},
+				Label:        datasets[dt].Name,
+				Doc:          describe(datasets[dt], lineage[dt]),
+			}
+			// A step merging a dataset from several sources, e.g. its children or a
+			// manager of software services, outputs an array: so does the workflow.
+			step, _, _ := strings.Cut(sources[0], "/")
+			if stepOut, exists := stepCWLs[step].Outputs[dt]; exists && stepOut.LinkMerge != "" {
+				out.Type, out.LinkMerge = stepOut.Type, stepOut.LinkMerge
 			}
+			cwlOutputs[dt] = out
 			logger.Debug("Output dataset", dt, "assigned single source", sources[0])
 		} else {
 			cwlOutputs[dt] = cwl.Output{
 				Type:         cwl.Directory,
 				OutputSource: []any{dtVal},
+				Label:        datasets[dt].Name,
+				Doc:          describe(datasets[dt], lineage[dt]),
 			}
 			logger.Debug("Output dataset", dt, "using fallback source", dtVal)
 		}
@@ -123,12 +146,16 @@ func WorkflowToCWL(workflow Workflow, db *sql.DB) (cwl.Cwl, error) {
 		return cwl.Cwl{}, err
 	}
 
-	// Process each step.
+	// Process each step; the children of a step are run by the CWL of their parent.
 	for _, step := range sts {
+		if parent, isChild := workflow.Parents[step.Id]; isChild {
+			logger.Debug("Step", step.Id, "is run by its parent", parent)
+			continue
+		}
 		stepInputs := make(map[string]string)
 		var stepOutputs []string
 
-		relationships, err := model.GetDTSTRelationships(db, step.Id)
+		relationships, err := effectiveRelationships(db, step)
 		if err != nil {
 			logger.Error("Error retrieving DT-ST relationships for step", step.Id, ":", err)
 			return cwl.Cwl{}, err
@@ -146,28 +173,38 @@ func WorkflowToCWL(workflow Workflow, db *sql.DB) (cwl.Cwl, error) {
 			}
 
 			switch relationship.RelationshipType {
-			case "is input to", "is the input to", "is input from":
+			case vocabulary.Input:
 				stepInputs[relationship.DTID] = stepInput
-			case "is output to", "is the output from", "is generated by", "is output from":
+			case vocabulary.Output:
 				stepOutputs = append(stepOutputs, relationship.DTID)
-			case "is updated by":
+			case vocabulary.Update:
 				stepOutputs = append(stepOutputs, relationship.STID+"/"+relationship.DTID)
 			default:
-				logger.Debug("Unrecognized DT-ST relationship type:", relationship.RelationshipType)
+				logger.Debug("Unrecognized DT-ST relationship type:", relationship.RelationshipType, at(relationship.Source))
 			}
 		}
 
 		if len(stepInputs) == 0 && len(stepOutputs) == 0 {
-			logger.Warning("Step", step.Id, "has no inputs or outputs")
+			logger.Warning("Step", step.Id, "has no inputs or outputs", at(step.Source))
 		}
 
 		steps[step.Id] = cwl.Step{
-			Run: step.Id + ".cwl",
-			In:  stepInputs,
-			Out: stepOutputs,
+			Run:   step.Id + ".cwl",
+			Label: step.Attributes.Name,
+			Doc:   describe(step.Attributes),
+			In:    stepInputs,
+			Out:   stepOutputs,
 		}
 	}
 
+	// Run the workflows declared part of this one as sub-workflows.
+	componentSources, err := addComponentSteps(workflow, db, cwlInputs, cwlOutputs, steps)
+	if err != nil {
+		logger.Error("Failed to add the component workflows of", workflow.Name, ":", err)
+		return cwl.Cwl{}, err
+	}
+	multipleSourcesFound = multipleSourcesFound || componentSources
+
 	// Build requirements; include MultipleInputFeatureRequirement only if needed.
 	reqs := map[string]map[string]string{
 		"SubworkflowFeatureRequirement": {},
@@ -188,6 +225,78 @@ func WorkflowToCWL(workflow Workflow, db *sql.DB) (cwl.Cwl, error) {
 	}, nil
 }
 
+// workflowInterface returns the inputs and outputs of the CWL of a workflow, sorted:
+// the datasets output or updated by its steps are outputs, the others inputs.
+func workflowInterface(db *sql.DB, wf string) (inputs, outputs []string, err error) {
+	dtst, err := model.GetDTSTRelationshipsForWF(db, wf)
+	if err != nil {
+		return nil, nil, err
+	}
+	generated := make(map[string]bool)
+	for _, relationship := range dtst {
+		switch relationship.RelationshipType {
+		case vocabulary.Input:
+			// Inputs are the datasets that are not outputs.
+			continue
+		case vocabulary.Output, vocabulary.Update:
+			generated[relationship.DTID] = true
+		default:
+			logger.Debug("Unknown DT-ST relationship type:", relationship.RelationshipType, at(relationship.Source))
+		}
+	}
+
+	dts, err := model.GetDTsForWF(db, wf)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dt := range dts {
+		if !generated[dt.ID] {
+			inputs = append(inputs, dt.ID)
+		}
+	}
+	outputs = slices.Sorted(maps.Keys(generated))
+	sort.Strings(inputs)
+	return inputs, outputs, nil
+}
+
+// composedInterface returns the inputs and outputs of the CWL of a workflow running
+// its components, as listed in components, sorted. The outputs of the components are
+// outputs of the workflow, and their inputs are inputs of the workflow unless one of
+// its steps or another component generates them.
+func composedInterface(db *sql.DB, wf string, components map[string][]string) (inputs, outputs []string, err error) {
+	inputs, outputs, err = workflowInterface(db, wf)
+	if err != nil {
+		return nil, nil, err
+	}
+	own := slices.Clone(outputs)
+	componentInputs := make(map[string][]string, len(components[wf]))
+	componentOutputs := make(map[string][]string, len(components[wf]))
+	for _, component := range components[wf] {
+		if componentInputs[component], componentOutputs[component], err = composedInterface(db, component, components); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, component := range components[wf] {
+		for _, dt := range componentInputs[component] {
+			generated := slices.Contains(own, dt)
+			for _, other := range components[wf] {
+				generated = generated || other != component && slices.Contains(componentOutputs[other], dt)
+			}
+			if !generated && !slices.Contains(inputs, dt) {
+				inputs = append(inputs, dt)
+			}
+		}
+		for _, dt := range componentOutputs[component] {
+			if !slices.Contains(outputs, dt) {
+				outputs = append(outputs, dt)
+			}
+		}
+	}
+	sort.Strings(inputs)
+	sort.Strings(outputs)
+	return inputs, outputs, nil
+}
+
 // StepToCWL converts a step to a CWL description.
 func StepToCWL(step Step, db *sql.DB) (cwl.Cwl, error) {
 	logger.Debug("Starting conversion for step", step.Id)
@@ -201,17 +310,24 @@ func StepToCWL(step Step, db *sql.DB) (cwl.Cwl, error) {
 		logger.Error("Failed to retrieve DT-ST relationships for step", step.Id, ":", err)
 		return cwl.Cwl{}, err
 	}
+	relationships := dtst
+	if len(step.Children) > 0 {
+		if relationships, err = effectiveRelationships(db, step); err != nil {
+			logger.Error("Failed to retrieve DT-ST relationships for the children of step", step.Id, ":", err)
+			return cwl.Cwl{}, err
+		}
+	}
 
-	// Process inputs and outputs.
-	for _, relationship := range dtst {
+	// Process inputs and outputs, including those of the children.
+	for _, relationship := range relationships {
 		switch relationship.RelationshipType {
-		case "is input to", "is the input to":
+		case vocabulary.Input:
 			if _, exists := inputs[relationship.DTID]; !exists {
-				inputs[relationship.DTID] = cwl.Directory
+				inputs[relationship.DTID] = cwl.Input{Type: cwl.Directory}
 			} else {
-				logger.Warning("Duplicate input detected for dataset", relationship.DTID, "in step", step.Id)
+				logger.Warning("Duplicate input detected for dataset", relationship.DTID, "in step", step.Id, at(relationship.Source))
 			}
-		case "is output to", "is updated by", "is the output from", "is generated by", "is output from":
+		case vocabulary.Output, vocabulary.Update:
 			if out, exists := outputs[relationship.DTID]; exists {
 				// Convert type to an array on first duplicate.
 				if len(out.OutputSource.([]any)) == 1 {
@@ -235,6 +351,16 @@ func StepToCWL(step Step, db *sql.DB) (cwl.Cwl, error) {
 		}
 	}
 
+	// Describe the datasets of the step with their attributes.
+	for dt := range inputs {
+		dataset, err := model.GetDT(db, dt)
+		if err != nil {
+			logger.Error("Failed to retrieve attributes of dataset", dt, ":", err)
+			return cwl.Cwl{}, err
+		}
+		inputs[dt] = cwl.Input{Type: cwl.Directory, Label: dataset.Name, Doc: describe(dataset.Attributes)}
+	}
+
 	// Retrieve inner and outer steps.
 	_, sts, sss, err := step.getVertices()
 	if err != nil {
@@ -242,66 +368,60 @@ func StepToCWL(step Step, db *sql.DB) (cwl.Cwl, error) {
 		return cwl.Cwl{}, err
 	}
 
-	// Process inner steps.
+	// Process inner steps; managed software services are run by their manager.
+	multipleSourcesFound := false
 	for _, innerStep := range sss {
-		stepInputs := make(map[string]string)
-		var stepOutputs []string
-		runInputs := make(map[string]cwl.IOType)
-		runOutputs := make(map[string]cwl.IOType)
-
-		dtss, err := model.GetDTSSRelationshipsForSS(db, innerStep)
+		if manager, managed := step.Managers[innerStep]; managed {
+			logger.Debug("Software service", innerStep, "is run by its manager", manager)
+			continue
+		}
+		cwlStep, multiple, err := serviceStep(step, db, innerStep, "")
 		if err != nil {
-			logger.Error("Failed to retrieve DT-SS relationships for inner step", innerStep, ":", err)
 			return cwl.Cwl{}, err
 		}
-		for _, relationship := range dtss {
-			ds, err := getDTSource(step, relationship.DTID)
+		multipleSourcesFound = multipleSourcesFound || multiple
+		steps[innerStep] = cwlStep
+
+		// Update global outputs if applicable, for every dataset related to the service.
+		datasets := append(slices.Sorted(maps.Keys(cwlStep.In)), cwlStep.Out...)
+		subWorkflow, isManager := cwlStep.Run.(cwl.Cwl)
+		if !isManager {
+			dtss, err := model.GetDTSSRelationshipsForSS(db, innerStep)
 			if err != nil {
-				logger.Error("Error obtaining sources for dataset", relationship.DTID, "in inner step", innerStep, ":", err)
+				logger.Error("Failed to retrieve DT-SS relationships for inner step", innerStep, ":", err)
 				return cwl.Cwl{}, err
 			}
-			stepInput := relationship.DTID
-			if len(ds) > 0 {
-				stepInput = ds[0] + "/" + relationship.DTID
+			datasets = nil
+			for _, relationship := range dtss {
+				datasets = append(datasets, relationship.DTID)
 			}
-
-			// Update global outputs if applicable.
-			if _, exists := outputs[relationship.DTID]; exists {
-				out := cwl.Output{
-					Type:         cwl.Directory,
-					OutputSource: []any{stepInput},
-				}
-				outputs[relationship.DTID] = out
-				logger.Debug("Updated global output for dataset", relationship.DTID, "in inner step", innerStep)
+		}
+		for _, dt := range datasets {
+			current, exists := outputs[dt]
+			if !exists {
+				continue
 			}
-
-			switch relationship.RelationshipType {
-			case "is input to", "is the input to", "is input from":
-				stepInputs[relationship.DTID] = stepInput
-				runInputs[relationship.DTID] = cwl.Directory
-			case "is output to", "is the output from", "is generated by", "is output from":
-				stepOutputs = append(stepOutputs, relationship.DTID)
-				runOutputs[relationship.DTID] = cwl.Directory
-			case "is updated by":
-				stepOutputs = append(stepOutputs, relationship.DTID)
-				runOutputs[relationship.DTID] = cwl.Directory
-			default:
-				logger.Debug("Unrecognized DT-SS relationship type:", relationship.RelationshipType)
+			source, err := inputSource(step, dt, "", "")
+			if err != nil {
+				logger.Error("Error obtaining sources for dataset", dt, "in inner step", innerStep, ":", err)
+				return cwl.Cwl{}, err
 			}
-		}
-
-		if len(stepInputs) == 0 && len(stepOutputs) == 0 {
-			logger.Warning("Inner step", step.Id, "has no inputs or outputs; please verify its configuration")
-		}
-
-		steps[innerStep] = cwl.Step{
-			Run: cwl.Run{
-				Class:   "Operation",
-				Inputs:  runInputs,
-				Outputs: runOutputs,
-			},
-			In:  stepInputs,
-			Out: stepOutputs,
+			// A manager merges the dataset generated by several services into an array,
+			// which the services processed later must not turn back into a directory.
+			sub, merged := subWorkflow.Outputs[dt]
+			merged = merged && source == innerStep+"/"+dt
+			if !merged && slices.Equal(current.OutputSource.([]any), []any{source}) {
+				continue
+			}
+			out := cwl.Output{
+				Type:         cwl.Directory,
+				OutputSource: []any{source},
+			}
+			if merged {
+				out.Type, out.LinkMerge = sub.Type, sub.LinkMerge
+			}
+			outputs[dt] = out
+			logger.Debug("Updated global output for dataset", dt, "in inner step", innerStep)
 		}
 	}
 
@@ -313,18 +433,15 @@ func StepToCWL(step Step, db *sql.DB) (cwl.Cwl, error) {
 		runOutputs := make(map[string]cwl.IOType)
 
 		for _, relationship := range dtst {
-			ds, err := getDTSource(step, relationship.DTID)
+			stepInput, err := inputSource(step, relationship.DTID, "", "")
 			if err != nil {
 				logger.Error("Error obtaining sources for dataset", relationship.DTID, "in step", step.Id, ":", err)
 				return cwl.Cwl{}, err
 			}
-			stepInput := relationship.DTID
-			if len(ds) > 0 {
-				stepInput = ds[0] + "/" + relationship.DTID
-			}
 
-			// Update global outputs if dataset exists.
-			if _, exists := outputs[relationship.DTID]; exists {
+			// Update global outputs if dataset exists, keeping the type of those already
+			// taken from the same source, e.g. the merged array of a manager.
+			if out, exists := outputs[relationship.DTID]; exists && !slices.Equal(out.OutputSource.([]any), []any{stepInput}) {
 				out := cwl.Output{
 					Type:         cwl.Directory,
 					OutputSource: []any{stepInput},
@@ -334,13 +451,13 @@ func StepToCWL(step Step, db *sql.DB) (cwl.Cwl, error) {
 			}
 
 			switch relationship.RelationshipType {
-			case "is input to", "is the input to", "is input from":
+			case vocabulary.Input:
 				stepInputs[relationship.DTID] = stepInput
 				runInputs[relationship.DTID] = cwl.Directory
-			case "is output to", "is the output from", "is generated by", "is output from":
+			case vocabulary.Output:
 				stepOutputs = append(stepOutputs, relationship.DTID)
 				runOutputs[relationship.DTID] = cwl.Directory
-			case "is updated by":
+			case vocabulary.Update:
 				stepOutputs = append(stepOutputs, relationship.STID+"/"+relationship.DTID)
 				runOutputs[relationship.DTID] = cwl.Directory
 			default:
@@ -359,17 +476,497 @@ func StepToCWL(step Step, db *sql.DB) (cwl.Cwl, error) {
 		}
 	}
 
+	// Process children, run as sub-workflows.
+	multipleChildSources, err := addChildSteps(step, db, inputs, outputs, steps)
+	if err != nil {
+		return cwl.Cwl{}, err
+	}
+	multipleSourcesFound = multipleSourcesFound || multipleChildSources
+
+	// Describe the outputs with the attributes of their datasets.
+	for dt, out := range outputs {
+		dataset, err := model.GetDT(db, dt)
+		if err != nil {
+			logger.Error("Failed to retrieve attributes of dataset", dt, ":", err)
+			return cwl.Cwl{}, err
+		}
+		out.Label = dataset.Name
+		out.Doc = describe(dataset.Attributes)
+		outputs[dt] = out
+	}
+
+	var reqs map[string]map[string]string
+	if len(step.Children) > 0 || len(step.Managers) > 0 {
+		reqs = map[string]map[string]string{"SubworkflowFeatureRequirement": {}}
+		if multipleSourcesFound {
+			reqs["MultipleInputFeatureRequirement"] = map[string]string{}
+		}
+	}
+
 	logger.Debug("Completed conversion for step", step.Id)
 	return cwl.Cwl{
-		CWLVersion: "v1.2",
-		Class:      "Workflow",
-		Inputs:     inputs,
-		Outputs:    outputs,
-		Steps:      steps,
+		CWLVersion:   "v1.2",
+		Class:        "Workflow",
+		Label:        step.Attributes.Name,
+		Doc:          describe(step.Attributes),
+		Inputs:       inputs,
+		Outputs:      outputs,
+		Requirements: reqs,
+		Steps:        steps,
 	}, nil
 }
 
-// getDTSource returns all sources generating the given dataset within a step.
+// addChildSteps adds a step running the CWL of each child of a step. A child takes
+// each of its inputs from the software service or manual step of the parent that
+// generates it, else from the first other child generating it, else from the inputs
+// of the parent. The outputs of the children become outputs of the parent. It
+// reports whether an output has several sources.
+func addChildSteps(step Step, db *sql.DB, inputs map[string]any, outputs map[string]cwl.Output, steps map[string]cwl.Step) (bool, error) {
+	childRelationships := make(map[string][]model.DTSTRelationship, len(step.Children))
+	producers := make(map[string][]string)
+	for _, child := range step.Children {
+		relationships, err := effectiveRelationships(db, child)
+		if err != nil {
+			logger.Error("Failed to retrieve DT-ST relationships for step", child.Id, ":", err)
+			return false, err
+		}
+		childRelationships[child.Id] = relationships
+		for _, relationship := range relationships {
+			if relationship.RelationshipType == vocabulary.Output || relationship.RelationshipType == vocabulary.Update {
+				if !slices.Contains(producers[relationship.DTID], child.Id) {
+					producers[relationship.DTID] = append(producers[relationship.DTID], child.Id)
+				}
+			}
+		}
+	}
+
+	multipleSourcesFound := false
+	for _, child := range step.Children {
+		stepInputs := make(map[string]string)
+		var stepOutputs []string
+		for _, relationship := range childRelationships[child.Id] {
+			switch relationship.RelationshipType {
+			case vocabulary.Input:
+				source, err := childInputSource(step, child.Id, relationship.DTID, producers[relationship.DTID])
+				if err != nil {
+					logger.Error("Error obtaining sources for dataset", relationship.DTID, "in step", child.Id, ":", err)
+					return false, err
+				}
+				if _, isOutput := outputs[relationship.DTID]; source == relationship.DTID && isOutput {
+					logger.Warning("Dataset", relationship.DTID, "is an output of", step.Id, "but none of its software services generates it;",
+						child.Id, "takes it as an input of", step.Id, at(relationship.Source))
+				}
+				if _, exists := inputs[relationship.DTID]; source == relationship.DTID && !exists {
+					dataset, err := model.GetDT(db, relationship.DTID)
+					if err != nil {
+						logger.Error("Failed to retrieve attributes of dataset", relationship.DTID, ":", err)
+						return false, err
+					}
+					inputs[relationship.DTID] = cwl.Input{Type: cwl.Directory, Label: dataset.Name, Doc: describe(dataset.Attributes)}
+				}
+				stepInputs[relationship.DTID] = source
+			case vocabulary.Output, vocabulary.Update:
+				if slices.Contains(stepOutputs, relationship.DTID) {
+					continue
+				}
+				stepOutputs = append(stepOutputs, relationship.DTID)
+
+				// A source naming the parent itself means that none of its software
+				// services generates the dataset: the child replaces it.
+				source := child.Id + "/" + relationship.DTID
+				out, exists := outputs[relationship.DTID]
+				if !exists || slices.Equal(out.OutputSource.([]any), []any{step.Id + "/" + relationship.DTID}) {
+					outputs[relationship.DTID] = cwl.Output{Type: cwl.Directory, OutputSource: []any{source}}
+					continue
+				}
+				out.Type = cwl.IOType(string(cwl.Directory) + "[]")
+				out.OutputSource = append(out.OutputSource.([]any), source)
+				out.LinkMerge = "merge_flattened"
+				outputs[relationship.DTID] = out
+				multipleSourcesFound = true
+				logger.Debug("Appended output source", source, "for dataset", relationship.DTID, "in step", step.Id)
+			default:
+				logger.Debug("Unrecognized DT-ST relationship type:", relationship.RelationshipType, at(relationship.Source))
+			}
+		}
+
+		if len(stepInputs) == 0 && len(stepOutputs) == 0 {
+			logger.Warning("Step", child.Id, "has no inputs or outputs", at(child.Source))
+		}
+
+		steps[child.Id] = cwl.Step{
+			Run:   child.Id + ".cwl",
+			Label: child.Attributes.Name,
+			Doc:   describe(child.Attributes),
+			In:    stepInputs,
+			Out:   stepOutputs,
+		}
+		logger.Debug("Added child step", child.Id, "to step", step.Id)
+	}
+	return multipleSourcesFound, nil
+}
+
+// addComponentSteps adds a step running the CWL of each workflow declared part of a
+// workflow, from the directory next to that of the workflow. A component takes each
+// of its inputs from the first step of the workflow generating it, else from the
+// first other component generating it, else from the inputs of the workflow. The
+// outputs of the components become outputs of the workflow. It reports whether an
+// output has several sources.
+func addComponentSteps(workflow Workflow, db *sql.DB, inputs map[string]any, outputs map[string]cwl.Output, steps map[string]cwl.Step) (bool, error) {
+	componentInputs := make(map[string][]string, len(workflow.Components))
+	componentOutputs := make(map[string][]string, len(workflow.Components))
+	producers := make(map[string][]string)
+	for _, component := range workflow.Components {
+		var err error
+		if componentInputs[component.Name], componentOutputs[component.Name], err = composedInterface(db, component.Name, workflow.workflowComponents); err != nil {
+			logger.Error("Failed to retrieve the datasets of workflow", component.Name, ":", err)
+			return false, err
+		}
+		for _, dt := range componentOutputs[component.Name] {
+			producers[dt] = append(producers[dt], component.Name)
+		}
+	}
+
+	multipleSourcesFound := false
+	for _, component := range workflow.Components {
+		stepInputs := make(map[string]string)
+		for _, dt := range componentInputs[component.Name] {
+			ds, err := getDTSourceWorkflow(workflow, dt)
+			if err != nil {
+				logger.Error("Error obtaining sources for dataset", dt, "in workflow", component.Name, ":", err)
+				return false, err
+			}
+			source := dt
+			if len(ds) > 0 {
+				source = ds[0] + "/" + dt
+			} else if i := slices.IndexFunc(producers[dt], func(p string) bool { return p != component.Name }); i >= 0 {
+				source = producers[dt][i] + "/" + dt
+			}
+			if _, exists := inputs[dt]; source == dt && !exists {
+				dataset, err := model.GetDT(db, dt)
+				if err != nil {
+					logger.Error("Failed to retrieve attributes of dataset", dt, ":", err)
+					return false, err
+				}
+				inputs[dt] = cwl.Input{Type: cwl.Directory, Label: dataset.Name, Doc: describe(dataset.Attributes)}
+			}
+			stepInputs[dt] = source
+		}
+
+		for _, dt := range componentOutputs[component.Name] {
+			source := component.Name + "/" + dt
+			out, exists := outputs[dt]
+			if !exists {
+				dataset, err := model.GetDT(db, dt)
+				if err != nil {
+					logger.Error("Failed to retrieve attributes of dataset", dt, ":", err)
+					return false, err
+				}
+				outputs[dt] = cwl.Output{Type: cwl.Directory, OutputSource: []any{source}, Label: dataset.Name, Doc: describe(dataset.Attributes)}
+				continue
+			}
+			out.Type = cwl.IOType(string(cwl.Directory) + "[]")
+			out.OutputSource = append(out.OutputSource.([]any), source)
+			out.LinkMerge = "merge_flattened"
+			outputs[dt] = out
+			multipleSourcesFound = true
+			logger.Debug("Appended output source", source, "for dataset", dt, "in workflow", workflow.Name)
+		}
+
+		if len(stepInputs) == 0 && len(componentOutputs[component.Name]) == 0 {
+			logger.Warning("Workflow", component.Name, "has no inputs or outputs")
+		}
+
+		steps[component.Name] = cwl.Step{
+			Run: "../" + component.Name + "/" + component.Name + ".cwl",
+			Doc: component.Description,
+			In:  stepInputs,
+			Out: componentOutputs[component.Name],
+		}
+		logger.Debug("Added component workflow", component.Name, "to workflow", workflow.Name)
+	}
+	return multipleSourcesFound, nil
+}
+
+// childInputSource returns the source of an input dataset of a child step within
+// its parent: the first step of the parent generating it, else the first other
+// child in producers, else the dataset itself as an input of the parent.
+func childInputSource(parent Step, child, dt string, producers []string) (string, error) {
+	source, err := inputSource(parent, dt, "", "")
+	if err != nil || source != dt {
+		return source, err
+	}
+	for _, producer := range producers {
+		if producer != child {
+			return producer + "/" + dt, nil
+		}
+	}
+	return dt, nil
+}
+
+// serviceStep returns the CWL step running a software service within scope: the
+// manager whose sub-workflow runs the service, or "" for the step itself. A manager
+// is run as a sub-workflow of the services it manages, other services as an
+// operation. It reports whether an output of the sub-workflow has several sources.
+func serviceStep(step Step, db *sql.DB, service, scope string) (cwl.Step, bool, error) {
+	attributes, err := model.GetSS(db, service)
+	if err != nil {
+		logger.Error("Failed to retrieve attributes of software service", service, ":", err)
+		return cwl.Step{}, false, err
+	}
+	stepInputs := make(map[string]string)
+	var stepOutputs []string
+
+	if service != scope && len(children(step.Managers)[service]) > 0 {
+		run, multipleSourcesFound, err := serviceWorkflow(step, db, service)
+		if err != nil {
+			return cwl.Step{}, false, err
+		}
+		for _, dt := range slices.Sorted(maps.Keys(run.Inputs)) {
+			if stepInputs[dt], err = inputSource(step, dt, scope, service); err != nil {
+				logger.Error("Error obtaining sources for dataset", dt, "in inner step", service, ":", err)
+				return cwl.Step{}, false, err
+			}
+		}
+		return cwl.Step{
+			Run:   run,
+			Label: attributes.Name,
+			Doc:   describe(attributes.Attributes),
+			In:    stepInputs,
+			Out:   slices.Sorted(maps.Keys(run.Outputs)),
+		}, multipleSourcesFound, nil
+	}
+
+	runInputs := make(map[string]cwl.IOType)
+	runOutputs := make(map[string]cwl.IOType)
+	dtss, err := model.GetDTSSRelationshipsForSS(db, service)
+	if err != nil {
+		logger.Error("Failed to retrieve DT-SS relationships for inner step", service, ":", err)
+		return cwl.Step{}, false, err
+	}
+	for _, relationship := range dtss {
+		switch relationship.RelationshipType {
+		case vocabulary.Input:
+			source, err := inputSource(step, relationship.DTID, scope, service)
+			if err != nil {
+				logger.Error("Error obtaining sources for dataset", relationship.DTID, "in inner step", service, ":", err)
+				return cwl.Step{}, false, err
+			}
+			stepInputs[relationship.DTID] = source
+			runInputs[relationship.DTID] = cwl.Directory
+		case vocabulary.Output, vocabulary.Update:
+			stepOutputs = append(stepOutputs, relationship.DTID)
+			runOutputs[relationship.DTID] = cwl.Directory
+		default:
+			logger.Debug("Unrecognized DT-SS relationship type:", relationship.RelationshipType)
+		}
+	}
+
+	if len(stepInputs) == 0 && len(stepOutputs) == 0 {
+		logger.Warning("Inner step", step.Id, "has no inputs or outputs; please verify its configuration")
+	}
+
+	return cwl.Step{
+		Run: cwl.Run{
+			Class:   "Operation",
+			Inputs:  runInputs,
+			Outputs: runOutputs,
+		},
+		Label: attributes.Name,
+		Doc:   describe(attributes.Attributes),
+		In:    stepInputs,
+		Out:   stepOutputs,
+	}, false, nil
+}
+
+// serviceWorkflow returns the sub-workflow of a manager, running the manager and
+// the services it manages. The datasets that none of them generates are inputs of
+// the sub-workflow, and those they generate are its outputs. It reports whether an
+// output has several sources.
+func serviceWorkflow(step Step, db *sql.DB, manager string) (cwl.Cwl, bool, error) {
+	inputs := make(map[string]any)
+	outputs := make(map[string]cwl.Output)
+	steps := make(map[string]cwl.Step)
+
+	multipleSourcesFound := false
+	for _, member := range append([]string{manager}, children(step.Managers)[manager]...) {
+		cwlStep, multiple, err := serviceStep(step, db, member, manager)
+		if err != nil {
+			return cwl.Cwl{}, false, err
+		}
+		multipleSourcesFound = multipleSourcesFound || multiple
+		steps[member] = cwlStep
+
+		for dt, source := range cwlStep.In {
+			if source == dt {
+				inputs[dt] = cwl.Input{Type: cwl.Directory}
+			}
+		}
+		for _, dt := range cwlStep.Out {
+			source := member + "/" + dt
+			out, exists := outputs[dt]
+			switch {
+			case !exists:
+				outputs[dt] = cwl.Output{Type: cwl.Directory, OutputSource: []any{source}}
+			case !slices.Contains(out.OutputSource.([]any), any(source)):
+				out.Type = cwl.IOType(string(cwl.Directory) + "[]")
+				out.OutputSource = append(out.OutputSource.([]any), source)
+				out.LinkMerge = "merge_flattened"
+				outputs[dt] = out
+				multipleSourcesFound = true
+			}
+		}
+	}
+
+	service, err := model.GetSS(db, manager)
+	if err != nil {
+		logger.Error("Failed to retrieve attributes of software service", manager, ":", err)
+		return cwl.Cwl{}, false, err
+	}
+	logger.Debug("Software service", manager, "runs", len(steps)-1, "managed services")
+	return cwl.Cwl{
+		Class:   "Workflow",
+		Label:   service.Name,
+		Doc:     describe(service.Attributes),
+		Inputs:  inputs,
+		Outputs: outputs,
+		Steps:   steps,
+	}, multipleSourcesFound, nil
+}
+
+// inputSource returns the source of a dataset used by consumer within scope, a
+// manager or "" for the step itself: the first member of the scope other than the
+// consumer that generates it, in topological order, as "member/dataset", or else
+// the dataset itself.
+func inputSource(step Step, dt, scope, consumer string) (string, error) {
+	ds, err := getDTSource(step, dt)
+	if err != nil {
+		return "", err
+	}
+	for _, source := range ds {
+		if member, ok := step.memberOf(source, scope); ok && member != consumer {
+			return member + "/" + dt, nil
+		}
+	}
+	return dt, nil
+}
+
+// memberOf returns the member of scope, a manager or "" for the step itself, that
+// runs the given software service or manual step: the service itself, or the
+// manager it is nested in. ok is false when the service is not in the scope.
+func (s *Step) memberOf(id, scope string) (member string, ok bool) {
+	for {
+		if id == scope {
+			return id, true
+		}
+		manager, managed := s.Managers[id]
+		if !managed {
+			return id, scope == ""
+		}
+		if manager == scope {
+			return id, true
+		}
+		id = manager
+	}
+}
+
+// effectiveRelationships returns the DT-ST relationships of a step as seen by the
+// workflow or parent running it: its own and, with the step as their ST, those of
+// its children. A dataset output by the step or one of its children is not an
+// input of the whole. They are sorted by dataset.
+func effectiveRelationships(db *sql.DB, step Step) ([]model.DTSTRelationship, error) {
+	relationships, err := model.GetDTSTRelationships(db, step.Id)
+	if err != nil {
+		return nil, err
+	}
+	if len(step.Children) == 0 {
+		return relationships, nil
+	}
+	for _, child := range step.Children {
+		childRelationships, err := effectiveRelationships(db, child)
+		if err != nil {
+			return nil, err
+		}
+		for _, relationship := range childRelationships {
+			relationship.STID = step.Id
+			relationships = append(relationships, relationship)
+		}
+	}
+
+	produced := make(map[string]bool)
+	for _, relationship := range relationships {
+		if relationship.RelationshipType == vocabulary.Output {
+			produced[relationship.DTID] = true
+		}
+	}
+	type key struct {
+		dt   string
+		kind vocabulary.Kind
+	}
+	seen := make(map[key]bool)
+	var effective []model.DTSTRelationship
+	for _, relationship := range relationships {
+		k := key{relationship.DTID, relationship.RelationshipType}
+		if seen[k] || (relationship.RelationshipType == vocabulary.Input && produced[relationship.DTID]) {
+			continue
+		}
+		seen[k] = true
+		effective = append(effective, relationship)
+	}
+	sort.SliceStable(effective, func(i, j int) bool {
+		if effective[i].DTID != effective[j].DTID {
+			return effective[i].DTID < effective[j].DTID
+		}
+		return effective[i].RelationshipType < effective[j].RelationshipType
+	})
+	return effective, nil
+}
+
+// describe builds the CWL documentation of an entity from its attributes, followed
+// by any additional notes such as the dataset lineage. Empty parts are left out.
+func describe(attributes model.Attributes, notes ...string) string {
+	var parts []string
+	if attributes.Description != "" {
+		parts = append(parts, attributes.Description)
+	}
+	for _, field := range []struct{ name, value string }{
+		{"Format", attributes.Format},
+		{"URL", attributes.URL},
+		{"License", attributes.License},
+		{"Contact", attributes.Contact},
+		{"EPOS identifier", attributes.EPOSID},
+	} {
+		if field.value != "" {
+			parts = append(parts, field.name+": "+field.value)
+		}
+	}
+	for _, note := range notes {
+		if note != "" {
+			parts = append(parts, note)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// datasetLineage builds, for each dataset, a human readable summary of the DT-DT
+// relationships it takes part in.
+func datasetLineage(relationships []model.DTDTRelationship) map[string]string {
+	statements := make(map[string][]string)
+	for _, relationship := range relationships {
+		statement := relationship.DTID1 + " " + relationship.RelationshipType.Phrase() + " " + relationship.DTID2
+		statements[relationship.DTID1] = append(statements[relationship.DTID1], statement)
+		statements[relationship.DTID2] = append(statements[relationship.DTID2], statement)
+	}
+
+	lineage := make(map[string]string, len(statements))
+	for dt, s := range statements {
+		lineage[dt] = "Dataset lineage: " + strings.Join(s, "; ")
+	}
+	return lineage
+}
+
+// getDTSource returns all sources generating the given dataset within a step, in
+// topological order.
 func getDTSource(step Step, dt string) ([]string, error) {
 	predecessorsMap, err := step.Graph.PredecessorMap()
 	if err != nil {
@@ -387,6 +984,10 @@ func getDTSource(step Step, dt string) ([]string, error) {
 	for predID := range predecessors {
 		sources = append(sources, predID)
 	}
+	if err := sortTopologically(step.Graph, sources); err != nil {
+		logger.Error("Failed to order the sources of dataset", dt, "in step", step.Id, ":", err)
+		return nil, err
+	}
 
 	if len(sources) > 1 {
 		logger.Debug("Dataset", dt, "generated from multiple sources:", sources)
@@ -395,7 +996,9 @@ func getDTSource(step Step, dt string) ([]string, error) {
 	return sources, nil
 }
 
-// getDTSourceWorkflow returns all sources generating the given dataset within a workflow.
+// getDTSourceWorkflow returns all steps generating the given dataset within a
+// workflow, in topological order. A child step is replaced by the step running it
+// in the workflow CWL.
 func getDTSourceWorkflow(workflow Workflow, dt string) ([]string, error) {
 	predecessorsMap, err := workflow.Graph.PredecessorMap()
 	if err != nil {
@@ -411,8 +1014,23 @@ func getDTSourceWorkflow(workflow Workflow, dt string) ([]string, error) {
 
 	var sources []string
 	for predID := range predecessors {
+		// Datasets can precede other datasets through DT-DT lineage edges; only steps are sources.
+		if vertex, err := workflow.Graph.Vertex(predID); err == nil && vertex.Graph == nil {
+			continue
+		}
 		sources = append(sources, predID)
 	}
+	if err := sortTopologically(workflow.Graph, sources); err != nil {
+		logger.Error("Failed to order the sources of dataset", dt, "in workflow", workflow.Name, ":", err)
+		return nil, err
+	}
+	var topLevel []string
+	for _, source := range sources {
+		if step := workflow.topLevel(source); !slices.Contains(topLevel, step) {
+			topLevel = append(topLevel, step)
+		}
+	}
+	sources = topLevel
 
 	if len(sources) > 1 {
 		logger.Debug("Dataset", dt, "generated from multiple sources in workflow", workflow.Name, ":", sources)
@@ -420,3 +1038,20 @@ func getDTSourceWorkflow(workflow Workflow, dt string) ([]string, error) {
 
 	return sources, nil
 }
+
+// sortTopologically sorts vertices of a graph in topological order, vertices that
+// are not ordered relative to each other being sorted by ID. The sources of a
+// dataset are listed in this order, and the first one is used where a single
+// source is needed, so that the conversion output is the same on every run.
+func sortTopologically[T any](g graph.Graph[string, T], vertices []string) error {
+	order, err := graph.StableTopologicalSort(g, func(a, b string) bool { return a < b })
+	if err != nil {
+		return err
+	}
+	rank := make(map[string]int, len(order))
+	for i, vertex := range order {
+		rank[vertex] = i
+	}
+	sort.Slice(vertices, func(i, j int) bool { return rank[vertices[i]] < rank[vertices[j]] })
+	return nil
+}
@@ -1,33 +1,69 @@
 package implicit
 
 import (
+	"bytes"
 	"database/sql"
+	"dt-geo-converter/cwl"
 	"dt-geo-converter/logger"
 	"dt-geo-converter/model"
 	"dt-geo-converter/rocrate"
-	"os"
+	"dt-geo-converter/vocabulary"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"sort"
 	"strings"
 
 	"github.com/dominikbraun/graph"
-	"github.com/dominikbraun/graph/draw"
 )
 
 // Workflow represents the complete workflow; its graph is the structure of the workflow, with each node being a Step.
 type Workflow struct {
 	Name  string
 	Graph graph.Graph[string, Step]
+	// Parents maps each step declared as a child in ST_ST ("ST510103 is parent of
+	// ST510104") to its parent step.
+	Parents map[string]string
+	// Parent is the workflow this one is declared part of in WF_WF, if any.
+	Parent string
+	// Components are the workflows declared part of this one, sorted by ID. The
+	// workflow runs them as sub-workflows.
+	Components []model.WF
+	// workflowComponents lists the components of each workflow connected to this
+	// one through WF_WF "is part of" relationships.
+	workflowComponents map[string][]string
 }
 
 // Step represents a workflow step; its graph is used to represent subcomponents (SS or datasets).
 type Step struct {
 	Id    string
 	Graph graph.Graph[string, string]
+	// Source lists the spreadsheet locations the step was declared at.
+	Source string
+	// Attributes describes the step, or the dataset when Graph is nil.
+	Attributes model.Attributes
+	// Children are the steps the step is parent of, sorted by ID. The step runs them
+	// as sub-workflows.
+	Children []Step
+	// Managers maps each software service of the step declared as managed in SS_SS
+	// ("SS5201 is manager of SS5202") to its manager.
+	Managers map[string]string
 }
 
 func stepHash(st Step) string {
 	return st.Id
 }
 
+// at formats the spreadsheet location of a row for log messages, e.g. "(at wp5/dt_st.csv:17)",
+// so that issues reported in the README point to the cell to fix.
+func at(source string) string {
+	if source == "" {
+		return "(at unknown location)"
+	}
+	return "(at " + source + ")"
+}
+
 // GetWorkflowGraph creates the main workflow graph using steps and dataset nodes.
 func GetWorkflowGraph(wf string, db *sql.DB) (Workflow, error) {
 	logger.Debug("Creating main workflow graph for", wf)
@@ -39,12 +75,26 @@ func GetWorkflowGraph(wf string, db *sql.DB) (Workflow, error) {
 		return Workflow{}, err
 	}
 
-	// Add each step's subgraph to the main graph.
+	stst, err := model.GetSTSTRelationshipsForWF(db, wf)
+	if err != nil {
+		logger.Error("Failed to retrieve ST-ST relationships for workflow", wf, ":", err)
+		return Workflow{}, err
+	}
+	parents := hierarchy(stRelations(stst), vocabulary.ParentOf)
+	stepChildren := children(parents)
+
+	subgraphs := make(map[string]Step, len(steps))
 	for _, step := range steps {
 		sg, err := generateStepGraph(step, db)
 		if err != nil {
 			logger.Error("Failed to generate subgraph for step", step.ID, ":", err)
 		}
+		subgraphs[step.ID] = sg
+	}
+
+	// Add each step's subgraph to the main graph, with its children nested in it.
+	for _, step := range steps {
+		sg := nestChildren(step.ID, subgraphs, stepChildren)
 		if err = g.AddVertex(sg,
 			graph.VertexAttribute("colorscheme", "ylorbr3"),
 			graph.VertexAttribute("style", "filled"),
@@ -64,8 +114,9 @@ func GetWorkflowGraph(wf string, db *sql.DB) (Workflow, error) {
 	}
 	for _, dt := range dts {
 		if err = g.AddVertex(Step{
-			Id:    dt.ID,
-			Graph: nil,
+			Id:         dt.ID,
+			Graph:      nil,
+			Attributes: dt.Attributes,
 		},
 			graph.VertexAttribute("colorscheme", "blues3"),
 			graph.VertexAttribute("style", "filled"),
@@ -86,39 +137,295 @@ func GetWorkflowGraph(wf string, db *sql.DB) (Workflow, error) {
 		}
 
 		for _, relationship := range dtst {
-			labelText := relationship.DTID + " - " + relationship.RelationshipType + " - " + relationship.STID
+			labelText := relationship.DTID + " - " + relationship.RelationshipType.Phrase() + " - " + relationship.STID
 			switch relationship.RelationshipType {
-			case "is input to", "is the input to", "is input from":
+			case vocabulary.Input:
 				err = g.AddEdge(relationship.DTID, relationship.STID,
-					graph.EdgeAttribute("label", relationship.RelationshipType),
+					graph.EdgeAttribute("label", relationship.RelationshipType.Phrase()),
 					graph.EdgeAttribute("labeltooltip", labelText))
 				if err != nil {
-					logger.Warning("Failed to add edge", relationship.DTID, "->", relationship.STID, ":", err)
+					logger.Warning("Failed to add edge", relationship.DTID, "->", relationship.STID, at(relationship.Source), ":", err)
 				} else {
 					logger.Debug("Added edge", relationship.DTID, "->", relationship.STID)
 				}
-			case "is output to", "is updated by", "is the output from", "is generated by", "is output from":
+			case vocabulary.Output, vocabulary.Update:
 				err = g.AddEdge(relationship.STID, relationship.DTID,
-					graph.EdgeAttribute("label", relationship.RelationshipType),
+					graph.EdgeAttribute("label", relationship.RelationshipType.Phrase()),
 					graph.EdgeAttribute("labeltooltip", labelText))
 				if err != nil {
-					logger.Warning("Failed to add edge", relationship.STID, "->", relationship.DTID, ":", err)
+					logger.Warning("Failed to add edge", relationship.STID, "->", relationship.DTID, at(relationship.Source), ":", err)
 				} else {
 					logger.Debug("Added edge", relationship.STID, "->", relationship.DTID)
 				}
 			default:
-				logger.Warning("Unknown DT_ST relationship type:", relationship.RelationshipType)
+				logger.Warning("Unknown DT_ST relationship type:", relationship.RelationshipType, at(relationship.Source))
 			}
 		}
 	}
 
+	// Add dashed lineage edges between the datasets of the workflow based on DT-DT relationships.
+	dtdt, err := model.GetDTDTRelationshipsForWF(db, wf)
+	if err != nil {
+		logger.Error("Failed to retrieve DT-DT relationships for workflow", wf, ":", err)
+		return Workflow{}, err
+	}
+	for _, relationship := range dtdt {
+		// Reversed aliases such as "is derived from" are swapped at import time, so
+		// lineage always flows from DTID1 to DTID2.
+		source, target := relationship.DTID1, relationship.DTID2
+		switch relationship.RelationshipType {
+		case vocabulary.Input, vocabulary.Precedes, vocabulary.PartOf:
+		default:
+			logger.Warning("Unknown DT_DT relationship type:", relationship.RelationshipType, at(relationship.Source))
+			continue
+		}
+		if _, err := g.Vertex(source); err != nil {
+			logger.Debug("Skipping DT-DT edge", source, "->", target, ":", source, "is not part of workflow", wf)
+			continue
+		}
+		if _, err := g.Vertex(target); err != nil {
+			logger.Debug("Skipping DT-DT edge", source, "->", target, ":", target, "is not part of workflow", wf)
+			continue
+		}
+		labelText := relationship.DTID1 + " - " + relationship.RelationshipType.Phrase() + " - " + relationship.DTID2
+		if err = g.AddEdge(source, target,
+			graph.EdgeAttribute("label", relationship.RelationshipType.Phrase()),
+			graph.EdgeAttribute("labeltooltip", labelText),
+			graph.EdgeAttribute("style", "dashed")); err != nil {
+			logger.Warning("Failed to add dataset lineage edge", source, "->", target, at(relationship.Source), ":", err)
+		} else {
+			logger.Debug("Added dataset lineage edge", source, "->", target)
+		}
+	}
+
+	// Add control-order edges between the steps based on ST-ST relationships.
+	addOrderEdges(g, stRelations(stst), "ST_ST")
+
+	// Find the workflow this one is part of, and the workflows part of it.
+	workflows, err := workflowHierarchy(wf, db)
+	if err != nil {
+		logger.Error("Failed to retrieve WF-WF relationships for workflow", wf, ":", err)
+		return Workflow{}, err
+	}
+	workflowComponents := children(workflows)
+	var components []model.WF
+	for _, component := range workflowComponents[wf] {
+		attributes, err := model.GetWF(db, component)
+		if err != nil {
+			logger.Error("Failed to retrieve workflow", component, ":", err)
+			return Workflow{}, err
+		}
+		components = append(components, attributes)
+	}
+
 	logger.Debug("Main workflow graph created successfully for", wf)
 	return Workflow{
-		Name:  wf,
-		Graph: g,
+		Name:               wf,
+		Graph:              g,
+		Parents:            parents,
+		Parent:             workflows[wf],
+		Components:         components,
+		workflowComponents: workflowComponents,
 	}, nil
 }
 
+// relation is a relationship declared between two steps in ST_ST, two software
+// services of a step in SS_SS, or two workflows in WF_WF.
+type relation struct {
+	From, To string
+	Kind     vocabulary.Kind
+	Source   string
+}
+
+func stRelations(relationships []model.STSTRelationship) []relation {
+	relations := make([]relation, len(relationships))
+	for i, relationship := range relationships {
+		relations[i] = relation{relationship.STID1, relationship.STID2, relationship.RelationshipType, relationship.Source}
+	}
+	return relations
+}
+
+func ssRelations(relationships []model.SSSSRelationship) []relation {
+	relations := make([]relation, len(relationships))
+	for i, relationship := range relationships {
+		relations[i] = relation{relationship.SSID1, relationship.SSID2, relationship.RelationshipType, relationship.Source}
+	}
+	return relations
+}
+
+// hierarchy maps the lower element of each relation of the given kind, e.g. the
+// child of "is parent of", the managed service of "is manager of" or the component
+// of "is part of", to the upper one. A relation is left out, with a warning, when
+// the element is already under another one or when it would make an element its
+// own ancestor.
+func hierarchy(relations []relation, kind vocabulary.Kind) map[string]string {
+	parents := make(map[string]string)
+	for _, r := range relations {
+		if r.Kind != kind {
+			continue
+		}
+		// "is part of" names the lower element first.
+		upper, lower := r.From, r.To
+		if kind == vocabulary.PartOf {
+			upper, lower = r.To, r.From
+		}
+		if other, found := parents[lower]; found {
+			logger.Warning(lower, "is already under", other+", ignoring", r.From, r.Kind.Phrase(), r.To, at(r.Source))
+			continue
+		}
+		cyclic := false
+		for ancestor, found := upper, true; found; ancestor, found = parents[ancestor] {
+			if ancestor == lower {
+				cyclic = true
+				break
+			}
+		}
+		if cyclic {
+			logger.Warning("The declared relationship", r.From, r.Kind.Phrase(), r.To,
+				"would make", lower, "its own ancestor", at(r.Source))
+			continue
+		}
+		parents[lower] = upper
+		logger.Debug(lower, "is under", upper)
+	}
+	return parents
+}
+
+// workflowHierarchy maps each workflow declared part of another one in WF_WF
+// ("WF7602 is part of WF7601") to that workflow. Only the relationships connected
+// to wf are considered, so that their issues are reported by the workflows they
+// concern.
+func workflowHierarchy(wf string, db *sql.DB) (map[string]string, error) {
+	wfs, err := model.GetWFs(db)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(wfs))
+	for _, w := range wfs {
+		known[w.Name] = true
+	}
+	wfwf, err := model.GetWFWFRelationships(db)
+	if err != nil {
+		return nil, err
+	}
+
+	connected := map[string]bool{wf: true}
+	for added := true; added; {
+		added = false
+		for _, relationship := range wfwf {
+			if relationship.RelationshipType == vocabulary.PartOf && connected[relationship.WFID1] != connected[relationship.WFID2] {
+				connected[relationship.WFID1], connected[relationship.WFID2] = true, true
+				added = true
+			}
+		}
+	}
+
+	var relations []relation
+	for _, relationship := range wfwf {
+		if relationship.RelationshipType != vocabulary.PartOf || !connected[relationship.WFID1] {
+			continue
+		}
+		if unknown := slices.DeleteFunc([]string{relationship.WFID1, relationship.WFID2}, func(w string) bool { return known[w] }); len(unknown) > 0 {
+			logger.Warning("Skipping", relationship.WFID1, relationship.RelationshipType.Phrase(), relationship.WFID2, ":",
+				unknown[0], "is not a workflow of the database", at(relationship.Source))
+			continue
+		}
+		relations = append(relations, relation{relationship.WFID1, relationship.WFID2, relationship.RelationshipType, relationship.Source})
+	}
+	return hierarchy(relations, vocabulary.PartOf), nil
+}
+
+// children inverts a hierarchy, listing the elements under each one sorted by ID.
+func children(parents map[string]string) map[string][]string {
+	children := make(map[string][]string)
+	for _, child := range slices.Sorted(maps.Keys(parents)) {
+		children[parents[child]] = append(children[parents[child]], child)
+	}
+	return children
+}
+
+// nestChildren returns the subgraph of a step with its children, and theirs,
+// nested in it.
+func nestChildren(id string, subgraphs map[string]Step, children map[string][]string) Step {
+	step := subgraphs[id]
+	for _, child := range children[id] {
+		step.Children = append(step.Children, nestChildren(child, subgraphs, children))
+	}
+	return step
+}
+
+// topLevel returns the ancestor of a step that is not the child of another step,
+// i.e. the step that runs it in the workflow CWL.
+func (w *Workflow) topLevel(step string) string {
+	for parent, found := w.Parents[step]; found; parent, found = w.Parents[step] {
+		step = parent
+	}
+	return step
+}
+
+// addOrderEdges adds a bold edge from each step, or software service, to those
+// declared to come after it in table. Reversed aliases such as "follows" are
+// swapped at import time, so the order always goes from the first element to the
+// second. An order is left out, with a warning, when data flows the other way
+// between the two, or when it contradicts other orders.
+func addOrderEdges[T any](g graph.Graph[string, T], relations []relation, table string) {
+	// Check every order against the data flow before any order edge is added.
+	var orders []relation
+	for _, r := range relations {
+		if r.Kind != vocabulary.Precedes {
+			continue
+		}
+		againstData, err := graph.CreatesCycle(g, r.From, r.To)
+		if err != nil {
+			logger.Warning("Failed to add order edge", r.From, "->", r.To, at(r.Source), ":", err)
+			continue
+		}
+		if againstData {
+			logger.Warning("Data flows from", r.To, "to", r.From, "against the declared order",
+				r.From, r.Kind.Phrase(), r.To, at(r.Source))
+			continue
+		}
+		orders = append(orders, r)
+	}
+
+	for _, r := range orders {
+		labelText := r.From + " - " + r.Kind.Phrase() + " - " + r.To
+		err := g.AddEdge(r.From, r.To,
+			graph.EdgeAttribute("label", r.Kind.Phrase()),
+			graph.EdgeAttribute("labeltooltip", labelText),
+			graph.EdgeAttribute("style", "bold"),
+			graph.EdgeAttribute("color", "darkorange"))
+		switch {
+		case errors.Is(err, graph.ErrEdgeCreatesCycle):
+			logger.Warning("The declared order", r.From, r.Kind.Phrase(), r.To,
+				"contradicts other", table, "orders", at(r.Source))
+		case err != nil:
+			logger.Warning("Failed to add order edge", r.From, "->", r.To, at(r.Source), ":", err)
+		default:
+			logger.Debug("Added order edge", r.From, "->", r.To)
+		}
+	}
+}
+
+// StepOrder returns the IDs of the steps of the workflow in execution order: a
+// topological order of the data flow and the declared ST-ST orders, steps that are
+// not ordered relative to each other being sorted by ID.
+func (w *Workflow) StepOrder() ([]string, error) {
+	vertices, err := w.getVertices()
+	if err != nil {
+		return nil, err
+	}
+	steps := make([]string, len(vertices))
+	for i, vertex := range vertices {
+		steps[i] = vertex.Id
+	}
+	if err := sortTopologically(w.Graph, steps); err != nil {
+		logger.Error("Failed to order the steps of workflow", w.Name, ":", err)
+		return nil, err
+	}
+	return steps, nil
+}
+
 // generateStepGraph creates the subgraph for a given step.
 func generateStepGraph(step model.ST, db *sql.DB) (Step, error) {
 	logger.Debug("Generating subgraph for step", step.ID)
@@ -191,137 +498,136 @@ func generateStepGraph(step model.ST, db *sql.DB) (Step, error) {
 				graph.VertexAttribute("fillcolor", "1")); err != nil {
 				logger.Error("Failed to add dataset node", relationship.DTID, "to manual step subgraph", step.ID, ":", err)
 			}
-			labelText := relationship.DTID + " - " + relationship.RelationshipType + " - " + relationship.STID
+			labelText := relationship.DTID + " - " + relationship.RelationshipType.Phrase() + " - " + relationship.STID
 			switch relationship.RelationshipType {
-			case "is input to", "is the input to", "is input from":
+			case vocabulary.Input:
 				if err = g.AddEdge(relationship.DTID, relationship.STID,
-					graph.EdgeAttribute("label", relationship.RelationshipType),
+					graph.EdgeAttribute("label", relationship.RelationshipType.Phrase()),
 					graph.EdgeAttribute("labeltooltip", labelText)); err != nil {
-					logger.Warning("Failed to add edge", relationship.DTID, "->", relationship.STID, "in manual step subgraph", step.ID, ":", err)
+					logger.Warning("Failed to add edge", relationship.DTID, "->", relationship.STID, "in manual step subgraph", step.ID, at(relationship.Source), ":", err)
 				}
-			case "is output to", "is updated by", "is the output from", "is generated by", "is output from":
+			case vocabulary.Output, vocabulary.Update:
 				if err = g.AddEdge(relationship.STID, relationship.DTID,
-					graph.EdgeAttribute("label", relationship.RelationshipType),
+					graph.EdgeAttribute("label", relationship.RelationshipType.Phrase()),
 					graph.EdgeAttribute("labeltooltip", labelText)); err != nil {
-					logger.Warning("Failed to add edge", relationship.STID, "->", relationship.DTID, "in manual step subgraph", step.ID, ":", err)
+					logger.Warning("Failed to add edge", relationship.STID, "->", relationship.DTID, "in manual step subgraph", step.ID, at(relationship.Source), ":", err)
 				}
 			default:
-				logger.Warning("Unknown DT_ST relationship type:", relationship.RelationshipType)
+				logger.Warning("Unknown DT_ST relationship type:", relationship.RelationshipType, at(relationship.Source))
 			}
 		}
 	}
 
 	// Process DT-SS relationships for non-manual steps.
 	for _, relationship := range relationships {
-		labelText := relationship.DTID + " - " + relationship.RelationshipType + " - " + relationship.SSID
+		labelText := relationship.DTID + " - " + relationship.RelationshipType.Phrase() + " - " + relationship.SSID
 		switch relationship.RelationshipType {
-		case "is input to", "is the input to", "is input from":
+		case vocabulary.Input:
 			if err = g.AddEdge(relationship.DTID, relationship.SSID,
-				graph.EdgeAttribute("label", relationship.RelationshipType),
+				graph.EdgeAttribute("label", relationship.RelationshipType.Phrase()),
 				graph.EdgeAttribute("labeltooltip", labelText)); err != nil {
-				logger.Warning("Failed to add edge", relationship.DTID, "->", relationship.SSID, "in subgraph", step.ID, ":", err)
+				logger.Warning("Failed to add edge", relationship.DTID, "->", relationship.SSID, "in subgraph", step.ID, at(relationship.Source), ":", err)
 			} else {
 				logger.Debug("Added edge", relationship.DTID, "->", relationship.SSID, "in subgraph", step.ID)
 			}
-		case "is output to", "is updated by", "is the output from", "is generated by", "is output from":
+		case vocabulary.Output, vocabulary.Update:
 			if err = g.AddEdge(relationship.SSID, relationship.DTID,
-				graph.EdgeAttribute("label", relationship.RelationshipType),
+				graph.EdgeAttribute("label", relationship.RelationshipType.Phrase()),
 				graph.EdgeAttribute("labeltooltip", labelText)); err != nil {
-				logger.Warning("Failed to add edge", relationship.SSID, "->", relationship.DTID, "in subgraph", step.ID, ":", err)
+				logger.Warning("Failed to add edge", relationship.SSID, "->", relationship.DTID, "in subgraph", step.ID, at(relationship.Source), ":", err)
 			} else {
 				logger.Debug("Added edge", relationship.SSID, "->", relationship.DTID, "in subgraph", step.ID)
 			}
 		default:
-			logger.Warning("Unknown SS_DT relationship type:", relationship.RelationshipType)
+			logger.Warning("Unknown SS_DT relationship type:", relationship.RelationshipType, at(relationship.Source))
 		}
 	}
 
+	// Add the order and hierarchy of the software services based on SS-SS relationships.
+	ssss, err := model.GetSSSSRelationshipsForST(db, step.ID)
+	if err != nil {
+		logger.Error("Failed to retrieve SS-SS relationships for step", step.ID, ":", err)
+		return Step{}, err
+	}
+	addOrderEdges(g, ssRelations(ssss), "SS_SS")
+
 	logger.Debug("Subgraph generated for step", step.ID)
 	return Step{
-		Id:    step.ID,
-		Graph: g,
+		Id:         step.ID,
+		Graph:      g,
+		Source:     step.Source,
+		Attributes: step.Attributes,
+		Managers:   hierarchy(ssRelations(ssss), vocabulary.Manages),
 	}, nil
 }
 
-// SaveToFile writes workflow files (DOT and CWL) and RO-Crate metadata.
-func (w *Workflow) SaveToFile(db *sql.DB) error {
+// Files generates the workflow files (DOT and CWL) and RO-Crate metadata, by name,
+// without writing them.
+func (w *Workflow) Files(db *sql.DB) (map[string][]byte, error) {
 	vertices, err := w.getVertices()
 	if err != nil {
 		logger.Error("Failed to retrieve vertices for workflow", w.Name, ":", err)
-		return err
+		return nil, err
 	}
 
-	path := "workflows/" + w.Name + "/"
+	files := make(map[string][]byte)
+	stepCWLs := make(map[string]cwl.Cwl, len(vertices))
 	for _, vertex := range vertices {
-		if vertex.Graph == nil {
-			logger.Debug("Skipping vertex", vertex.Id, "with no graph")
-			continue
-		}
-		if err = os.MkdirAll(path, os.ModePerm); err != nil {
-			logger.Error("Failed to create directory", path, ":", err)
-			return err
-		}
-
-		file, err := os.Create(path + vertex.Id + ".dot")
-		if err != nil {
-			logger.Error("Failed to create file", path+vertex.Id+".dot", ":", err)
-			return err
-		}
-
-		if err = draw.DOT(vertex.Graph, file); err != nil {
-			logger.Error("Failed to save DOT file", path+vertex.Id+".dot", ":", err)
-			return err
+		var dot bytes.Buffer
+		if err = vertex.writeDOT(&dot); err != nil {
+			logger.Error("Failed to generate DOT file", vertex.Id+".dot", ":", err)
+			return nil, err
 		}
-		file.Close()
-		logger.Debug("Saved DOT file for vertex", vertex.Id)
+		files[vertex.Id+".dot"] = dot.Bytes()
+		logger.Debug("Generated DOT file for vertex", vertex.Id)
 
 		cwlObj, err := StepToCWL(vertex, db)
 		if err != nil {
 			logger.Error("Failed to convert step", vertex.Id, "to CWL:", err)
-			return err
+			return nil, err
 		}
-		if err = cwlObj.SaveToFile(path + vertex.Id + ".cwl"); err != nil {
-			logger.Error("Failed to save CWL file for vertex", vertex.Id, ":", err)
-			return err
+		stepCWLs[vertex.Id] = cwlObj
+		if files[vertex.Id+".cwl"], err = cwlObj.Marshal(); err != nil {
+			logger.Error("Failed to generate CWL file for vertex", vertex.Id, ":", err)
+			return nil, err
 		}
-		logger.Debug("Saved CWL file for vertex", vertex.Id)
+		logger.Debug("Generated CWL file for vertex", vertex.Id)
 	}
 
-	file, err := os.Create(path + w.Name + ".dot")
-	if err != nil {
-		logger.Error("Failed to create file", path+"steps.dot", ":", err)
-		return err
-	}
-	defer file.Close()
-
-	if err = draw.DOT(w.Graph, file); err != nil {
-		logger.Error("Failed to save steps DOT file:", err)
-		return err
+	var dot bytes.Buffer
+	if err = writeDOT(w.Graph, &dot, hierarchyClusters(w.Parents)...); err != nil {
+		logger.Error("Failed to generate steps DOT file:", err)
+		return nil, err
 	}
+	files[w.Name+".dot"] = dot.Bytes()
 
-	cwlObj, err := WorkflowToCWL(*w, db)
+	cwlObj, err := WorkflowToCWL(*w, db, stepCWLs)
 	if err != nil {
 		logger.Error("Failed to convert workflow", w.Name, "to CWL:", err)
-		return err
+		return nil, err
 	}
-	if err = cwlObj.SaveToFile(path + w.Name + ".cwl"); err != nil {
-		logger.Error("Failed to save workflow CWL file", path+w.Name+".cwl", ":", err)
-		return err
+	if files[w.Name+".cwl"], err = cwlObj.Marshal(); err != nil {
+		logger.Error("Failed to generate workflow CWL file", w.Name+".cwl", ":", err)
+		return nil, err
 	}
-	logger.Debug("Saved workflow CWL file", path+w.Name+".cwl")
+	logger.Debug("Generated workflow CWL file", w.Name+".cwl")
 
-	crate, err := rocrate.WorkflowToRoCrate(w.Name, cwlObj, db)
+	order, err := w.StepOrder()
+	if err != nil {
+		return nil, err
+	}
+	crate, err := rocrate.WorkflowToRoCrate(w.Name, cwlObj, db, order, w.Components)
 	if err != nil {
 		logger.Error("Failed to generate RO-Crate for workflow", w.Name, ":", err)
-		return err
+		return nil, err
 	}
-	if err = crate.SaveToFile(path + "ro-crate-metadata.json"); err != nil {
-		logger.Error("Failed to save RO-Crate metadata file", path+"ro-crate-metadata.json", ":", err)
-		return err
+	if files["ro-crate-metadata.json"], err = crate.Marshal(); err != nil {
+		logger.Error("Failed to generate RO-Crate metadata file:", err)
+		return nil, err
 	}
-	logger.Debug("Saved RO-Crate metadata file", path+"ro-crate-metadata.json")
+	logger.Debug("Generated RO-Crate metadata file")
 
-	return nil
+	return files, nil
 }
 
 // getVertices returns all non-dataset vertices from the workflow graph.
@@ -345,6 +651,7 @@ func (w *Workflow) getVertices() ([]Step, error) {
 		}
 		vertices = append(vertices, vertex)
 	}
+	sort.Slice(vertices, func(i, j int) bool { return vertices[i].Id < vertices[j].Id })
 	logger.Debug("Collected", len(vertices), "vertices for workflow", w.Name)
 	return vertices, nil
 }
@@ -377,6 +684,103 @@ func (s *Step) getVertices() (dts []string, sts []string, sss []string, err erro
 			sss = append(sss, vertex)
 		}
 	}
+	sort.Strings(dts)
+	sort.Strings(sts)
+	sort.Strings(sss)
 	logger.Debug("Step", s.Id, "has", len(dts), "DTs,", len(sts), "STs, and", len(sss), "SSs")
 	return dts, sts, sss, nil
 }
+
+// hierarchyClusters draws each element of a hierarchy, e.g. a parent step or a
+// manager service, in a box holding it and the elements under it. Elements that
+// have elements under them are drawn in a nested box.
+func hierarchyClusters(parents map[string]string) []dotCluster {
+	below := children(parents)
+	var clusters []dotCluster
+	for _, root := range slices.Sorted(maps.Keys(below)) {
+		if _, nested := parents[root]; !nested {
+			clusters = append(clusters, hierarchyCluster(root, below))
+		}
+	}
+	return clusters
+}
+
+func hierarchyCluster(root string, below map[string][]string) dotCluster {
+	cluster := dotCluster{Name: root, Vertices: []string{root}}
+	for _, child := range below[root] {
+		if len(below[child]) > 0 {
+			cluster.Clusters = append(cluster.Clusters, hierarchyCluster(child, below))
+		} else {
+			cluster.Vertices = append(cluster.Vertices, child)
+		}
+	}
+	return cluster
+}
+
+// writeDOT renders the subgraph of a step in the DOT language, each manager service
+// being drawn in a box with the services it manages. The subgraphs of its children
+// are merged in it, their software services and manual steps being drawn in a box
+// for each child.
+func (s *Step) writeDOT(w io.Writer) error {
+	clusters := hierarchyClusters(s.Managers)
+	if len(s.Children) == 0 {
+		return writeDOT(s.Graph, w, clusters...)
+	}
+	g, err := s.Graph.Clone()
+	if err != nil {
+		return err
+	}
+	for _, child := range s.Children {
+		cluster, err := mergeChild(g, child)
+		if err != nil {
+			return err
+		}
+		clusters = append(clusters, cluster)
+	}
+	return writeDOT(g, w, clusters...)
+}
+
+// mergeChild adds the subgraph of a child step, and those of its own children, to
+// the graph of its parent, and returns the box of the child. Datasets shared with
+// the parent or other children are drawn once.
+func mergeChild(g graph.Graph[string, string], child Step) (dotCluster, error) {
+	cluster := dotCluster{Name: child.Id}
+	adjacencyMap, err := child.Graph.AdjacencyMap()
+	if err != nil {
+		return dotCluster{}, err
+	}
+	for _, vertex := range slices.Sorted(maps.Keys(adjacencyMap)) {
+		_, properties, err := child.Graph.VertexWithProperties(vertex)
+		if err != nil {
+			return dotCluster{}, err
+		}
+		err = g.AddVertex(vertex, graph.VertexAttributes(properties.Attributes), graph.VertexWeight(properties.Weight))
+		if err != nil && !errors.Is(err, graph.ErrVertexAlreadyExists) {
+			return dotCluster{}, err
+		}
+		_, managed := child.Managers[vertex]
+		if !strings.Contains(vertex, "DT") && !managed && !slices.Contains(slices.Collect(maps.Values(child.Managers)), vertex) {
+			cluster.Vertices = append(cluster.Vertices, vertex)
+		}
+	}
+	for _, vertex := range slices.Sorted(maps.Keys(adjacencyMap)) {
+		for _, target := range slices.Sorted(maps.Keys(adjacencyMap[vertex])) {
+			edge := adjacencyMap[vertex][target]
+			err := g.AddEdge(vertex, target, graph.EdgeAttributes(edge.Properties.Attributes), graph.EdgeWeight(edge.Properties.Weight))
+			switch {
+			case errors.Is(err, graph.ErrEdgeAlreadyExists):
+			case err != nil:
+				logger.Warning("Failed to draw edge", vertex, "->", target, "of step", child.Id, ":", err)
+			}
+		}
+	}
+	cluster.Clusters = hierarchyClusters(child.Managers)
+	for _, grandchild := range child.Children {
+		nested, err := mergeChild(g, grandchild)
+		if err != nil {
+			return dotCluster{}, err
+		}
+		cluster.Clusters = append(cluster.Clusters, nested)
+	}
+	return cluster, nil
+}
@@ -0,0 +1,293 @@
+package implicit
+
+import (
+	"bytes"
+	"database/sql"
+	"dt-geo-converter/cwl"
+	"dt-geo-converter/logger"
+	"dt-geo-converter/model"
+	"dt-geo-converter/vocabulary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/dominikbraun/graph"
+)
+
+// MetaWorkflow runs workflows linked by WF-WF "is input to" relationships as the
+// sub-workflows of a single CWL workflow, wired by the datasets they share.
+type MetaWorkflow struct {
+	Name string
+	// Graph holds the workflows taking part, with an edge from each workflow to
+	// those it is declared input to.
+	Graph graph.Graph[string, string]
+	// workflows describes the workflows taking part.
+	workflows map[string]model.WF
+	// inputs and outputs are the datasets of the CWL of each workflow, including
+	// those of its components.
+	inputs, outputs map[string][]string
+}
+
+// GetMetaWorkflow creates the meta-workflow ending at target: the target and the
+// workflows it takes input from, directly or through other workflows. With target
+// "all", it holds every workflow declared input to another one.
+func GetMetaWorkflow(name, target string, db *sql.DB) (MetaWorkflow, error) {
+	logger.Debug("Creating meta-workflow", name)
+	wfs, err := model.GetWFs(db)
+	if err != nil {
+		logger.Error("Failed to retrieve workflows:", err)
+		return MetaWorkflow{}, err
+	}
+	known := make(map[string]model.WF, len(wfs))
+	for _, wf := range wfs {
+		known[wf.Name] = wf
+	}
+	if _, found := known[target]; !found && target != "all" {
+		return MetaWorkflow{}, fmt.Errorf("workflow %s is not in the database", target)
+	}
+
+	relationships, err := model.GetWFWFRelationships(db)
+	if err != nil {
+		logger.Error("Failed to retrieve WF-WF relationships:", err)
+		return MetaWorkflow{}, err
+	}
+	var links []model.WFWFRelationship
+	for _, relationship := range relationships {
+		if relationship.RelationshipType == vocabulary.Input {
+			links = append(links, relationship)
+		}
+	}
+
+	// Collect the workflows taking part, walking the links upstream from the target.
+	participants := make(map[string]bool)
+	if target == "all" {
+		for _, link := range links {
+			participants[link.WFID1] = true
+			participants[link.WFID2] = true
+		}
+	} else {
+		participants[target] = true
+		for added := true; added; {
+			added = false
+			for _, link := range links {
+				if participants[link.WFID2] && !participants[link.WFID1] {
+					participants[link.WFID1] = true
+					added = true
+				}
+			}
+		}
+	}
+	for _, link := range links {
+		for _, wf := range []string{link.WFID1, link.WFID2} {
+			if _, found := known[wf]; !found && participants[link.WFID2] {
+				logger.Warning("Skipping", link.WFID1, link.RelationshipType.Phrase(), link.WFID2, ":",
+					wf, "is not a workflow of the database", at(link.Source))
+			}
+		}
+	}
+	for wf := range participants {
+		if _, found := known[wf]; !found {
+			delete(participants, wf)
+		}
+	}
+	if len(participants) < 2 && target == "all" {
+		return MetaWorkflow{}, errors.New("no workflow is declared input to another one")
+	}
+	if len(participants) < 2 {
+		return MetaWorkflow{}, fmt.Errorf("no workflow is declared input to %s", target)
+	}
+
+	m := MetaWorkflow{
+		Name:      name,
+		Graph:     graph.New(graph.StringHash, graph.Directed(), graph.PreventCycles()),
+		workflows: make(map[string]model.WF),
+		inputs:    make(map[string][]string),
+		outputs:   make(map[string][]string),
+	}
+	for _, wf := range wfs {
+		if !participants[wf.Name] {
+			continue
+		}
+		m.workflows[wf.Name] = wf
+		workflows, err := workflowHierarchy(wf.Name, db)
+		if err != nil {
+			logger.Error("Failed to retrieve WF-WF relationships for workflow", wf.Name, ":", err)
+			return MetaWorkflow{}, err
+		}
+		if m.inputs[wf.Name], m.outputs[wf.Name], err = composedInterface(db, wf.Name, children(workflows)); err != nil {
+			logger.Error("Failed to retrieve the datasets of workflow", wf.Name, ":", err)
+			return MetaWorkflow{}, err
+		}
+		if err = m.Graph.AddVertex(wf.Name,
+			graph.VertexAttribute("colorscheme", "ylorbr3"),
+			graph.VertexAttribute("style", "filled"),
+			graph.VertexAttribute("color", "2"),
+			graph.VertexAttribute("fillcolor", "1"),
+			graph.VertexAttribute("shape", "box")); err != nil {
+			logger.Error("Failed to add workflow node", wf.Name, "to meta-workflow graph:", err)
+		}
+	}
+
+	// Add an edge for each link, labelled with the datasets carried by the link.
+	for _, link := range links {
+		if !participants[link.WFID1] || !participants[link.WFID2] {
+			continue
+		}
+		labelText := link.WFID1 + " - " + link.RelationshipType.Phrase() + " - " + link.WFID2
+		shared := m.shared(link.WFID1, link.WFID2)
+		attributes := []func(*graph.EdgeProperties){
+			graph.EdgeAttribute("label", strings.Join(shared, ", ")),
+			graph.EdgeAttribute("labeltooltip", labelText),
+		}
+		if len(shared) == 0 {
+			logger.Warning("No dataset carries", labelText+":", "none of the outputs of", link.WFID1, "is an input of", link.WFID2, at(link.Source))
+			attributes = []func(*graph.EdgeProperties){
+				graph.EdgeAttribute("label", link.RelationshipType.Phrase()),
+				graph.EdgeAttribute("labeltooltip", labelText),
+				graph.EdgeAttribute("style", "dashed"),
+				graph.EdgeAttribute("color", "red"),
+			}
+		}
+		switch err := m.Graph.AddEdge(link.WFID1, link.WFID2, attributes...); {
+		case errors.Is(err, graph.ErrEdgeCreatesCycle):
+			logger.Warning("The declared relationship", link.WFID1, link.RelationshipType.Phrase(), link.WFID2,
+				"makes a cycle of workflows and is left out", at(link.Source))
+		case err != nil:
+			logger.Warning("Failed to add workflow edge", link.WFID1, "->", link.WFID2, at(link.Source), ":", err)
+		default:
+			logger.Debug("Added workflow edge", link.WFID1, "->", link.WFID2)
+		}
+	}
+
+	logger.Debug("Meta-workflow", name, "created with", len(participants), "workflows")
+	return m, nil
+}
+
+// shared returns the outputs of a workflow that are inputs of another one.
+func (m *MetaWorkflow) shared(from, to string) []string {
+	var shared []string
+	for _, dt := range m.outputs[from] {
+		if slices.Contains(m.inputs[to], dt) {
+			shared = append(shared, dt)
+		}
+	}
+	return shared
+}
+
+// Workflows returns the IDs of the workflows of the meta-workflow, in execution
+// order.
+func (m *MetaWorkflow) Workflows() ([]string, error) {
+	return graph.StableTopologicalSort(m.Graph, func(a, b string) bool { return a < b })
+}
+
+// Files generates the CWL and DOT files of the meta-workflow, by name, without
+// writing them. Its steps run the CWL of each workflow from the directory next to
+// that of the meta-workflow.
+func (m *MetaWorkflow) Files(db *sql.DB) (map[string][]byte, error) {
+	order, err := m.Workflows()
+	if err != nil {
+		logger.Error("Failed to order the workflows of meta-workflow", m.Name, ":", err)
+		return nil, err
+	}
+	predecessors, err := m.Graph.PredecessorMap()
+	if err != nil {
+		return nil, err
+	}
+	successors, err := m.Graph.AdjacencyMap()
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := make(map[string]any)
+	outputs := make(map[string]cwl.Output)
+	steps := make(map[string]cwl.Step)
+	multipleSourcesFound := false
+	for _, wf := range order {
+		stepInputs := make(map[string]string)
+		for _, dt := range m.inputs[wf] {
+			// Take the dataset from the first workflow, in execution order, declared
+			// input to this one and generating it, or else from the meta-workflow inputs.
+			source := ""
+			for _, upstream := range order {
+				if _, linked := predecessors[wf][upstream]; linked && slices.Contains(m.outputs[upstream], dt) {
+					source = upstream + "/" + dt
+					break
+				}
+			}
+			if source == "" {
+				source = dt
+				if _, exists := inputs[dt]; !exists {
+					dataset, err := model.GetDT(db, dt)
+					if err != nil {
+						logger.Error("Failed to retrieve attributes of dataset", dt, ":", err)
+						return nil, err
+					}
+					inputs[dt] = cwl.Input{Type: cwl.Directory, Label: dataset.Name, Doc: describe(dataset.Attributes)}
+				}
+			}
+			stepInputs[dt] = source
+		}
+		steps[wf] = cwl.Step{
+			Run: "../" + wf + "/" + wf + ".cwl",
+			Doc: m.workflows[wf].Description,
+			In:  stepInputs,
+			Out: m.outputs[wf],
+		}
+
+		// The outputs of the last workflows of the chains are the outputs of the meta-workflow.
+		if len(successors[wf]) > 0 {
+			continue
+		}
+		for _, dt := range m.outputs[wf] {
+			out, exists := outputs[dt]
+			if !exists {
+				dataset, err := model.GetDT(db, dt)
+				if err != nil {
+					logger.Error("Failed to retrieve attributes of dataset", dt, ":", err)
+					return nil, err
+				}
+				outputs[dt] = cwl.Output{
+					Type:         cwl.Directory,
+					OutputSource: []any{wf + "/" + dt},
+					Label:        dataset.Name,
+					Doc:          describe(dataset.Attributes),
+				}
+				continue
+			}
+			out.Type = cwl.IOType(string(cwl.Directory) + "[]")
+			out.OutputSource = append(out.OutputSource.([]any), wf+"/"+dt)
+			out.LinkMerge = "merge_flattened"
+			outputs[dt] = out
+			multipleSourcesFound = true
+		}
+	}
+
+	reqs := map[string]map[string]string{
+		"SubworkflowFeatureRequirement": {},
+	}
+	if multipleSourcesFound {
+		reqs["MultipleInputFeatureRequirement"] = map[string]string{}
+	}
+	cwlObj := cwl.Cwl{
+		CWLVersion:   "v1.2",
+		Class:        "Workflow",
+		Inputs:       inputs,
+		Outputs:      outputs,
+		Requirements: reqs,
+		Steps:        steps,
+	}
+
+	files := make(map[string][]byte)
+	if files[m.Name+".cwl"], err = cwlObj.Marshal(); err != nil {
+		logger.Error("Failed to generate meta-workflow CWL file", m.Name+".cwl", ":", err)
+		return nil, err
+	}
+	var dot bytes.Buffer
+	if err = writeDOT(m.Graph, &dot); err != nil {
+		logger.Error("Failed to generate meta-workflow DOT file", m.Name+".dot", ":", err)
+		return nil, err
+	}
+	files[m.Name+".dot"] = dot.Bytes()
+	return files, nil
+}
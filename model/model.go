@@ -2,7 +2,11 @@ package model
 
 import (
 	"database/sql"
+	"dt-geo-converter/vocabulary"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 )
 
 type WF struct {
@@ -11,35 +15,145 @@ type WF struct {
 	Author      string
 }
 
+// Attributes describes a dataset, step or software service, as read from dt.csv,
+// st.csv and ss.csv. Every field is empty when the spreadsheets do not provide it.
+type Attributes struct {
+	Name        string
+	Description string
+	Format      string
+	URL         string
+	License     string
+	Contact     string
+	EPOSID      string
+}
+
 type ST struct {
 	ID string
+	// Source lists the "file:line" locations the step was declared at in ST_WF.
+	Source string
+	Attributes
 }
 
 type SS struct {
 	ID string
+	Attributes
 }
 
 type DT struct {
 	ID string
+	Attributes
 }
 
 type DTSTRelationship struct {
 	DTID             string
 	STID             string
-	RelationshipType string
+	RelationshipType vocabulary.Kind
+	Source           string
 }
 
 type DTSSRelationship struct {
 	DTID             string
 	SSID             string
-	RelationshipType string
+	RelationshipType vocabulary.Kind
+	Source           string
+}
+
+// DTDTRelationship describes the lineage between two datasets, as read from DT_DT
+// (e.g. "DT5102 part of DT5103").
+type DTDTRelationship struct {
+	DTID1            string
+	DTID2            string
+	RelationshipType vocabulary.Kind
+	Source           string
+}
+
+// STSTRelationship describes how two steps relate, as read from ST_ST (e.g.
+// "ST510101 is previous to ST510102").
+type STSTRelationship struct {
+	STID1            string
+	STID2            string
+	RelationshipType vocabulary.Kind
+	Source           string
+}
+
+// WFWFRelationship describes how two workflows relate, as read from WF_WF (e.g.
+// "WF7401 is input to WF6101").
+type WFWFRelationship struct {
+	WFID1            string
+	WFID2            string
+	RelationshipType vocabulary.Kind
+	Source           string
+}
+
+// SSSSRelationship describes how two software services of a step relate, as read
+// from SS_SS (e.g. "SS5201 is manager of SS5202").
+type SSSSRelationship struct {
+	SSID1            string
+	SSID2            string
+	RelationshipType vocabulary.Kind
+	Source           string
+}
+
+// sourceLocations turns the comma separated "file:line" list built by GROUP_CONCAT
+// into a sorted list, e.g. "wp5/dt_st.csv:17, wp6/dt_st.csv:17". Rows that appear in
+// several sheets are reported once with all their locations.
+func sourceLocations(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	locations := strings.Split(raw, ",")
+	sort.Strings(locations)
+	return strings.Join(locations, ", ")
+}
+
+// getAttributes returns the attributes of an entity from the DT, ST or SS table.
+// When several work packages describe the same entity, the first one in
+// alphabetical order wins.
+func getAttributes(db *sql.DB, table, id string) (Attributes, error) {
+	query := fmt.Sprintf(`
+		SELECT name, description, format, url, license, contact, epos_id
+		FROM %s
+		WHERE id = ?
+		ORDER BY wp
+		LIMIT 1
+	`, table)
+
+	var a Attributes
+	err := db.QueryRow(query, id).Scan(&a.Name, &a.Description, &a.Format, &a.URL, &a.License, &a.Contact, &a.EPOSID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Attributes{}, nil
+	}
+	if err != nil {
+		return Attributes{}, fmt.Errorf("failed to query %s attributes of %s: %v", table, id, err)
+	}
+	return a, nil
+}
+
+// GetDT returns a dataset with its attributes.
+func GetDT(db *sql.DB, dtID string) (DT, error) {
+	attributes, err := getAttributes(db, "DT", dtID)
+	return DT{ID: dtID, Attributes: attributes}, err
+}
+
+// GetST returns a step with its attributes.
+func GetST(db *sql.DB, stID string) (ST, error) {
+	attributes, err := getAttributes(db, "ST", stID)
+	return ST{ID: stID, Attributes: attributes}, err
+}
+
+// GetSS returns a software service with its attributes.
+func GetSS(db *sql.DB, ssID string) (SS, error) {
+	attributes, err := getAttributes(db, "SS", ssID)
+	return SS{ID: ssID, Attributes: attributes}, err
 }
 
 func GetSTsForWF(db *sql.DB, wfName string) ([]ST, error) {
 	query := `
-		SELECT DISTINCT id1 AS st_id
+		SELECT id1 AS st_id, COALESCE(GROUP_CONCAT(DISTINCT source_file || ':' || source_line), '')
 		FROM ST_WF
 		WHERE id2 = ?
+		GROUP BY id1
+		ORDER BY id1
 	`
 
 	rows, err := db.Query(query, wfName)
@@ -51,9 +165,10 @@ func GetSTsForWF(db *sql.DB, wfName string) ([]ST, error) {
 	var stateTransitions []ST
 	for rows.Next() {
 		var st ST
-		if err := rows.Scan(&st.ID); err != nil {
+		if err := rows.Scan(&st.ID, &st.Source); err != nil {
 			return nil, fmt.Errorf("failed to scan ST row: %v", err)
 		}
+		st.Source = sourceLocations(st.Source)
 		stateTransitions = append(stateTransitions, st)
 	}
 
@@ -61,14 +176,43 @@ func GetSTsForWF(db *sql.DB, wfName string) ([]ST, error) {
 		return nil, fmt.Errorf("error iterating ST rows: %v", err)
 	}
 
+	for i := range stateTransitions {
+		if stateTransitions[i].Attributes, err = getAttributes(db, "ST", stateTransitions[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
 	return stateTransitions, nil
 }
 
+// OrderSTs sorts steps by their position in order, e.g. the execution order of a
+// workflow. Steps missing from order come last, sorted by ID.
+func OrderSTs(steps []ST, order []string) {
+	rank := make(map[string]int, len(order))
+	for i, id := range order {
+		rank[id] = i
+	}
+	position := func(id string) int {
+		if r, ok := rank[id]; ok {
+			return r
+		}
+		return len(order)
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		if position(steps[i].ID) != position(steps[j].ID) {
+			return position(steps[i].ID) < position(steps[j].ID)
+		}
+		return steps[i].ID < steps[j].ID
+	})
+}
+
 func GetDTSTRelationships(db *sql.DB, stID string) ([]DTSTRelationship, error) {
 	query := `
-		SELECT id1, relationship_type, id2
+		SELECT id1, relationship_type, id2, COALESCE(GROUP_CONCAT(DISTINCT source_file || ':' || source_line), '')
 		FROM DT_ST
 		WHERE id2 = ?
+		GROUP BY id1, relationship_type, id2
+		ORDER BY id1, relationship_type
 	`
 
 	rows, err := db.Query(query, stID)
@@ -80,9 +224,10 @@ func GetDTSTRelationships(db *sql.DB, stID string) ([]DTSTRelationship, error) {
 	var relationships []DTSTRelationship
 	for rows.Next() {
 		var rel DTSTRelationship
-		if err := rows.Scan(&rel.DTID, &rel.RelationshipType, &rel.STID); err != nil {
+		if err := rows.Scan(&rel.DTID, &rel.RelationshipType, &rel.STID, &rel.Source); err != nil {
 			return nil, fmt.Errorf("failed to scan DT-ST relationship row: %v", err)
 		}
+		rel.Source = sourceLocations(rel.Source)
 		relationships = append(relationships, rel)
 	}
 
@@ -95,9 +240,10 @@ func GetDTSTRelationships(db *sql.DB, stID string) ([]DTSTRelationship, error) {
 
 func GetSSForST(db *sql.DB, stID string) ([]SS, error) {
 	query := `
-		SELECT id1 AS ss_id
+		SELECT DISTINCT id1 AS ss_id
 		FROM SS_ST
 		WHERE id2 = ?
+		ORDER BY id1
 	`
 
 	rows, err := db.Query(query, stID)
@@ -119,19 +265,28 @@ func GetSSForST(db *sql.DB, stID string) ([]SS, error) {
 		return nil, fmt.Errorf("error iterating SS rows: %v", err)
 	}
 
+	for i := range subStates {
+		if subStates[i].Attributes, err = getAttributes(db, "SS", subStates[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
 	return subStates, nil
 }
 
 func GetDTSSRelationshipsForST(db *sql.DB, stID string) ([]DTSSRelationship, error) {
 	query := `
-		SELECT DISTINCT dt_ss.id1 AS dt_id, dt_ss.id2 AS ss_id, dt_ss.relationship_type
+		SELECT dt_ss.id1 AS dt_id, dt_ss.id2 AS ss_id, dt_ss.relationship_type,
+			COALESCE(GROUP_CONCAT(DISTINCT dt_ss.source_file || ':' || dt_ss.source_line), '')
 		FROM DT_SS dt_ss
 		JOIN SS_ST ss_st ON dt_ss.id2 = ss_st.id1
 		WHERE ss_st.id2 = ?
-		AND ss_st.relationship_type = 'is part of'
+		AND ss_st.relationship_type = ?
+		GROUP BY dt_ss.id1, dt_ss.id2, dt_ss.relationship_type
+		ORDER BY dt_ss.id1, dt_ss.id2, dt_ss.relationship_type
 	`
 
-	rows, err := db.Query(query, stID)
+	rows, err := db.Query(query, stID, vocabulary.PartOf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query DT-SS relationships for ST: %v", err)
 	}
@@ -140,9 +295,10 @@ func GetDTSSRelationshipsForST(db *sql.DB, stID string) ([]DTSSRelationship, err
 	var relationships []DTSSRelationship
 	for rows.Next() {
 		var rel DTSSRelationship
-		if err := rows.Scan(&rel.DTID, &rel.SSID, &rel.RelationshipType); err != nil {
+		if err := rows.Scan(&rel.DTID, &rel.SSID, &rel.RelationshipType, &rel.Source); err != nil {
 			return nil, fmt.Errorf("failed to scan DT-SS relationship row: %v", err)
 		}
+		rel.Source = sourceLocations(rel.Source)
 		relationships = append(relationships, rel)
 	}
 
@@ -159,6 +315,7 @@ func GetDTsRelatedToSTviaSSs(db *sql.DB, stID string) ([]DT, error) {
 		FROM DT_SS dt_ss
 		JOIN SS_ST ss_st ON dt_ss.id2 = ss_st.id1
 		WHERE ss_st.id2 = ?
+		ORDER BY dt_ss.id1
 	`
 
 	rows, err := db.Query(query, stID)
@@ -180,14 +337,22 @@ func GetDTsRelatedToSTviaSSs(db *sql.DB, stID string) ([]DT, error) {
 		return nil, fmt.Errorf("error iterating DT rows: %v", err)
 	}
 
+	for i := range dataTypes {
+		if dataTypes[i].Attributes, err = getAttributes(db, "DT", dataTypes[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
 	return dataTypes, nil
 }
 
 func GetDTSSRelationshipsForSS(db *sql.DB, ssID string) ([]DTSSRelationship, error) {
 	query := `
-        SELECT id1 AS dt_id, id2 AS ss_id, relationship_type
+        SELECT id1 AS dt_id, id2 AS ss_id, relationship_type, COALESCE(GROUP_CONCAT(DISTINCT source_file || ':' || source_line), '')
         FROM DT_SS
         WHERE id2 = ?
+        GROUP BY id1, id2, relationship_type
+        ORDER BY id1, relationship_type
     `
 
 	rows, err := db.Query(query, ssID)
@@ -199,9 +364,10 @@ func GetDTSSRelationshipsForSS(db *sql.DB, ssID string) ([]DTSSRelationship, err
 	var relationships []DTSSRelationship
 	for rows.Next() {
 		var rel DTSSRelationship
-		if err := rows.Scan(&rel.DTID, &rel.SSID, &rel.RelationshipType); err != nil {
+		if err := rows.Scan(&rel.DTID, &rel.SSID, &rel.RelationshipType, &rel.Source); err != nil {
 			return nil, fmt.Errorf("failed to scan DT-SS relationship row: %v", err)
 		}
+		rel.Source = sourceLocations(rel.Source)
 		relationships = append(relationships, rel)
 	}
 
@@ -218,6 +384,7 @@ func GetDTsForWF(db *sql.DB, wfName string) ([]DT, error) {
         FROM DT_ST dt_st
         JOIN ST_WF st_wf ON dt_st.id2 = st_wf.id1
         WHERE st_wf.id2 = ?
+        ORDER BY dt_st.id1
     `
 
 	rows, err := db.Query(query, wfName)
@@ -239,15 +406,24 @@ func GetDTsForWF(db *sql.DB, wfName string) ([]DT, error) {
 		return nil, fmt.Errorf("error iterating DT rows: %v", err)
 	}
 
+	for i := range dataTypes {
+		if dataTypes[i].Attributes, err = getAttributes(db, "DT", dataTypes[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
 	return dataTypes, nil
 }
 
 func GetDTSTRelationshipsForWF(db *sql.DB, wfName string) ([]DTSTRelationship, error) {
 	query := `
-        SELECT dt_st.id1 AS dt_id, dt_st.relationship_type, dt_st.id2 AS st_id
+        SELECT dt_st.id1 AS dt_id, dt_st.relationship_type, dt_st.id2 AS st_id,
+            COALESCE(GROUP_CONCAT(DISTINCT dt_st.source_file || ':' || dt_st.source_line), '')
         FROM DT_ST dt_st
         JOIN ST_WF st_wf ON dt_st.id2 = st_wf.id1
         WHERE st_wf.id2 = ?
+        GROUP BY dt_st.id1, dt_st.relationship_type, dt_st.id2
+        ORDER BY dt_st.id1, dt_st.relationship_type, dt_st.id2
     `
 
 	rows, err := db.Query(query, wfName)
@@ -259,9 +435,10 @@ func GetDTSTRelationshipsForWF(db *sql.DB, wfName string) ([]DTSTRelationship, e
 	var relationships []DTSTRelationship
 	for rows.Next() {
 		var rel DTSTRelationship
-		if err := rows.Scan(&rel.DTID, &rel.RelationshipType, &rel.STID); err != nil {
+		if err := rows.Scan(&rel.DTID, &rel.RelationshipType, &rel.STID, &rel.Source); err != nil {
 			return nil, fmt.Errorf("failed to scan DT-ST relationship row: %v", err)
 		}
+		rel.Source = sourceLocations(rel.Source)
 		relationships = append(relationships, rel)
 	}
 
@@ -271,3 +448,195 @@ func GetDTSTRelationshipsForWF(db *sql.DB, wfName string) ([]DTSTRelationship, e
 
 	return relationships, nil
 }
+
+// GetDTDTRelationshipsForWF returns the DT_DT relationships in which at least one
+// of the two datasets is used by a step of the given workflow.
+func GetDTDTRelationshipsForWF(db *sql.DB, wfName string) ([]DTDTRelationship, error) {
+	query := `
+        SELECT dt_dt.id1, dt_dt.relationship_type, dt_dt.id2,
+            COALESCE(GROUP_CONCAT(DISTINCT dt_dt.source_file || ':' || dt_dt.source_line), '')
+        FROM DT_DT dt_dt
+        WHERE dt_dt.id1 IN (
+            SELECT dt_st.id1
+            FROM DT_ST dt_st
+            JOIN ST_WF st_wf ON dt_st.id2 = st_wf.id1
+            WHERE st_wf.id2 = ?
+        )
+        OR dt_dt.id2 IN (
+            SELECT dt_st.id1
+            FROM DT_ST dt_st
+            JOIN ST_WF st_wf ON dt_st.id2 = st_wf.id1
+            WHERE st_wf.id2 = ?
+        )
+        GROUP BY dt_dt.id1, dt_dt.relationship_type, dt_dt.id2
+        ORDER BY dt_dt.id1, dt_dt.relationship_type, dt_dt.id2
+    `
+
+	rows, err := db.Query(query, wfName, wfName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DT-DT relationships for WF: %v", err)
+	}
+	defer rows.Close()
+
+	var relationships []DTDTRelationship
+	for rows.Next() {
+		var rel DTDTRelationship
+		if err := rows.Scan(&rel.DTID1, &rel.RelationshipType, &rel.DTID2, &rel.Source); err != nil {
+			return nil, fmt.Errorf("failed to scan DT-DT relationship row: %v", err)
+		}
+		rel.Source = sourceLocations(rel.Source)
+		relationships = append(relationships, rel)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating DT-DT relationship rows: %v", err)
+	}
+
+	return relationships, nil
+}
+
+// GetSTSTRelationshipsForWF returns the ST_ST relationships between two steps of the
+// given workflow.
+func GetSTSTRelationshipsForWF(db *sql.DB, wfName string) ([]STSTRelationship, error) {
+	query := `
+        SELECT st_st.id1, st_st.relationship_type, st_st.id2,
+            COALESCE(GROUP_CONCAT(DISTINCT st_st.source_file || ':' || st_st.source_line), '')
+        FROM ST_ST st_st
+        WHERE st_st.id1 IN (SELECT id1 FROM ST_WF WHERE id2 = ?)
+        AND st_st.id2 IN (SELECT id1 FROM ST_WF WHERE id2 = ?)
+        GROUP BY st_st.id1, st_st.relationship_type, st_st.id2
+        ORDER BY st_st.id1, st_st.relationship_type, st_st.id2
+    `
+
+	rows, err := db.Query(query, wfName, wfName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ST-ST relationships for WF: %v", err)
+	}
+	defer rows.Close()
+
+	var relationships []STSTRelationship
+	for rows.Next() {
+		var rel STSTRelationship
+		if err := rows.Scan(&rel.STID1, &rel.RelationshipType, &rel.STID2, &rel.Source); err != nil {
+			return nil, fmt.Errorf("failed to scan ST-ST relationship row: %v", err)
+		}
+		rel.Source = sourceLocations(rel.Source)
+		relationships = append(relationships, rel)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating ST-ST relationship rows: %v", err)
+	}
+
+	return relationships, nil
+}
+
+// GetSSSSRelationshipsForST returns the SS_SS relationships between two software
+// services of the given step.
+func GetSSSSRelationshipsForST(db *sql.DB, stID string) ([]SSSSRelationship, error) {
+	query := `
+        SELECT ss_ss.id1, ss_ss.relationship_type, ss_ss.id2,
+            COALESCE(GROUP_CONCAT(DISTINCT ss_ss.source_file || ':' || ss_ss.source_line), '')
+        FROM SS_SS ss_ss
+        WHERE ss_ss.id1 IN (SELECT id1 FROM SS_ST WHERE id2 = ? AND relationship_type = ?)
+        AND ss_ss.id2 IN (SELECT id1 FROM SS_ST WHERE id2 = ? AND relationship_type = ?)
+        GROUP BY ss_ss.id1, ss_ss.relationship_type, ss_ss.id2
+        ORDER BY ss_ss.id1, ss_ss.relationship_type, ss_ss.id2
+    `
+
+	rows, err := db.Query(query, stID, vocabulary.PartOf, stID, vocabulary.PartOf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SS-SS relationships for ST: %v", err)
+	}
+	defer rows.Close()
+
+	var relationships []SSSSRelationship
+	for rows.Next() {
+		var rel SSSSRelationship
+		if err := rows.Scan(&rel.SSID1, &rel.RelationshipType, &rel.SSID2, &rel.Source); err != nil {
+			return nil, fmt.Errorf("failed to scan SS-SS relationship row: %v", err)
+		}
+		rel.Source = sourceLocations(rel.Source)
+		relationships = append(relationships, rel)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating SS-SS relationship rows: %v", err)
+	}
+
+	return relationships, nil
+}
+
+// GetWFs returns the workflows of the database, sorted by name.
+func GetWFs(db *sql.DB) ([]WF, error) {
+	query := `
+		SELECT name, COALESCE(description, ''), COALESCE(author, '')
+		FROM WF
+		ORDER BY name
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query WFs: %v", err)
+	}
+	defer rows.Close()
+
+	var workflows []WF
+	for rows.Next() {
+		var wf WF
+		if err := rows.Scan(&wf.Name, &wf.Description, &wf.Author); err != nil {
+			return nil, fmt.Errorf("failed to scan WF row: %v", err)
+		}
+		workflows = append(workflows, wf)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating WF rows: %v", err)
+	}
+
+	return workflows, nil
+}
+
+// GetWF returns a workflow with its description and author.
+func GetWF(db *sql.DB, wfName string) (WF, error) {
+	wf := WF{Name: wfName}
+	err := db.QueryRow(`SELECT COALESCE(description, ''), COALESCE(author, '') FROM WF WHERE name = ?`, wfName).
+		Scan(&wf.Description, &wf.Author)
+	if err != nil {
+		return WF{}, fmt.Errorf("failed to query WF %s: %v", wfName, err)
+	}
+	return wf, nil
+}
+
+// GetWFWFRelationships returns the WF_WF relationships of the database.
+func GetWFWFRelationships(db *sql.DB) ([]WFWFRelationship, error) {
+	query := `
+        SELECT id1, relationship_type, id2,
+            COALESCE(GROUP_CONCAT(DISTINCT source_file || ':' || source_line), '')
+        FROM WF_WF
+        GROUP BY id1, relationship_type, id2
+        ORDER BY id1, relationship_type, id2
+    `
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query WF-WF relationships: %v", err)
+	}
+	defer rows.Close()
+
+	var relationships []WFWFRelationship
+	for rows.Next() {
+		var rel WFWFRelationship
+		if err := rows.Scan(&rel.WFID1, &rel.RelationshipType, &rel.WFID2, &rel.Source); err != nil {
+			return nil, fmt.Errorf("failed to scan WF-WF relationship row: %v", err)
+		}
+		rel.Source = sourceLocations(rel.Source)
+		relationships = append(relationships, rel)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating WF-WF relationship rows: %v", err)
+	}
+
+	return relationships, nil
+}
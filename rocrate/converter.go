@@ -4,10 +4,16 @@ import (
 	"database/sql"
 	"dt-geo-converter/cwl"
 	"dt-geo-converter/model"
+	"maps"
+	"slices"
 	"strings"
 )
 
-func WorkflowToRoCrate(wf string, cwl cwl.Cwl, db *sql.DB) (RoCrate, error) {
+// WorkflowToRoCrate generates the RO-Crate metadata of a workflow. Its steps are
+// listed in stepOrder, the execution order of the workflow. The crates of the
+// component workflows, in the directories next to that of the workflow, are parts
+// of its crate.
+func WorkflowToRoCrate(wf string, cwl cwl.Cwl, db *sql.DB, stepOrder []string, components []model.WF) (RoCrate, error) {
 	datasets, err := model.GetDTsForWF(db, wf)
 	if err != nil {
 		return RoCrate{}, err
@@ -17,6 +23,7 @@ func WorkflowToRoCrate(wf string, cwl cwl.Cwl, db *sql.DB) (RoCrate, error) {
 	if err != nil {
 		return RoCrate{}, err
 	}
+	model.OrderSTs(steps, stepOrder)
 
 	var graph []any
 
@@ -38,6 +45,9 @@ func WorkflowToRoCrate(wf string, cwl cwl.Cwl, db *sql.DB) (RoCrate, error) {
 	for _, step := range steps {
 		workflowHasPart = append(workflowHasPart, IDRef{step.ID + ".cwl"})
 	}
+	for _, component := range components {
+		workflowHasPart = append(workflowHasPart, IDRef{componentCrate(component.Name)})
+	}
 
 	graph = append(graph, Workflow{
 		ID:          "./",
@@ -74,10 +84,11 @@ func WorkflowToRoCrate(wf string, cwl cwl.Cwl, db *sql.DB) (RoCrate, error) {
 
 	var workflowInputs []IDRef
 	var workflowOutputs []IDRef
-	for s := range cwl.Inputs {
+	// Map keys are sorted so that the metadata is the same on every run.
+	for _, s := range slices.Sorted(maps.Keys(cwl.Inputs)) {
 		workflowInputs = append(workflowInputs, IDRef{"#" + s + "-param"})
 	}
-	for s := range cwl.Outputs {
+	for _, s := range slices.Sorted(maps.Keys(cwl.Outputs)) {
 		workflowOutputs = append(workflowOutputs, IDRef{"#" + s + "-param"})
 	}
 
@@ -93,6 +104,10 @@ func WorkflowToRoCrate(wf string, cwl cwl.Cwl, db *sql.DB) (RoCrate, error) {
 	})
 
 	// Formal parameters
+	names := make(map[string]string, len(datasets))
+	for _, dataset := range datasets {
+		names[dataset.ID] = dataset.Name
+	}
 	for _, param := range workflowInputs {
 		graph = append(graph, FormalParameter{
 			ID:             param.ID,
@@ -100,8 +115,8 @@ func WorkflowToRoCrate(wf string, cwl cwl.Cwl, db *sql.DB) (RoCrate, error) {
 			AdditionalType: "Dataset",
 			ConformsTo:     IDRef{"https://bioschemas.org/profiles/FormalParameter/1.0-RELEASE"},
 			Description:    "TODO",
-			WorkExample:    IDRef{strings.ReplaceAll(strings.ReplaceAll(param.ID, "#", ""), "-param", "")},
-			Name:           "TODO",
+			WorkExample:    IDRef{paramDataset(param)},
+			Name:           orTODO(names[paramDataset(param)]),
 			ValueRequired:  true,
 		})
 	}
@@ -112,8 +127,8 @@ func WorkflowToRoCrate(wf string, cwl cwl.Cwl, db *sql.DB) (RoCrate, error) {
 			AdditionalType: "Dataset",
 			ConformsTo:     IDRef{"https://bioschemas.org/profiles/FormalParameter/1.0-RELEASE"},
 			Description:    "TODO",
-			WorkExample:    IDRef{strings.ReplaceAll(strings.ReplaceAll(param.ID, "#", ""), "-param", "")},
-			Name:           "TODO",
+			WorkExample:    IDRef{paramDataset(param)},
+			Name:           orTODO(names[paramDataset(param)]),
 			ValueRequired:  true,
 		})
 	}
@@ -131,21 +146,39 @@ func WorkflowToRoCrate(wf string, cwl cwl.Cwl, db *sql.DB) (RoCrate, error) {
 		graph = append(graph, SoftwareSourceCode{
 			ID:          step.ID,
 			Type:        "SoftwareSourceCode",
-			Name:        "TODO",
-			Description: "TODO",
+			Name:        orTODO(step.Name),
+			Description: orTODO(step.Description),
+			License:     step.License,
+			Url:         step.URL,
+			Identifier:  step.EPOSID,
 		})
 	}
 
 	// Datasets
 	for _, dataset := range datasets {
 		graph = append(graph, DatasetDetails{
-			ID:            dataset.ID,
-			Type:          "Dataset",
-			Name:          "TODO",
-			Abstract:      "TODO",
-			URL:           "TODO",
-			Author:        &IDRef{"TODO"},
-			ExampleOfWork: &IDRef{"#" + dataset.ID + "-param"},
+			ID:             dataset.ID,
+			Type:           "Dataset",
+			Name:           orTODO(dataset.Name),
+			Abstract:       orTODO(dataset.Description),
+			URL:            orTODO(dataset.URL),
+			EncodingFormat: dataset.Format,
+			License:        dataset.License,
+			Identifier:     dataset.EPOSID,
+			Author:         &IDRef{"TODO"},
+			ExampleOfWork:  &IDRef{"#" + dataset.ID + "-param"},
+		})
+	}
+
+	// Component workflows
+	for _, component := range components {
+		graph = append(graph, Crate{
+			ID:          componentCrate(component.Name),
+			Type:        "Dataset",
+			Name:        component.Name,
+			Description: orTODO(component.Description),
+			ConformsTo:  IDRef{"https://w3id.org/ro/crate"},
+			SubjectOf:   IDRef{componentCrate(component.Name) + "ro-crate-metadata.json"},
 		})
 	}
 
@@ -167,3 +200,23 @@ func WorkflowToRoCrate(wf string, cwl cwl.Cwl, db *sql.DB) (RoCrate, error) {
 		Graph:   graph,
 	}, nil
 }
+
+// componentCrate returns the ID of the crate of a component workflow, the directory
+// it is converted to.
+func componentCrate(wf string) string {
+	return "../" + wf + "/"
+}
+
+// paramDataset returns the dataset a formal parameter ID such as "#DT5101-param" refers to.
+func paramDataset(param IDRef) string {
+	return strings.ReplaceAll(strings.ReplaceAll(param.ID, "#", ""), "-param", "")
+}
+
+// orTODO returns the value read from the spreadsheets, or a TODO placeholder to be
+// completed manually when it is missing.
+func orTODO(value string) string {
+	if value == "" {
+		return "TODO"
+	}
+	return value
+}
@@ -3,6 +3,8 @@ package rocrate
 import (
 	"dt-geo-converter/cwl"
 	"dt-geo-converter/logger"
+	"maps"
+	"slices"
 )
 
 // GenerateRoCrate creates a RO-Crate metadata package from the given CWL.
@@ -90,7 +92,8 @@ func addWorkflowToRoCrate(rocrate *[]any, wf string, originalCwl cwl.Cwl) error
 		for _, dataset := range datasets {
 			workflowHasPart = append(workflowHasPart, IDRef{dataset})
 		}
-		for id, step := range originalCwl.Steps {
+		for _, id := range slices.Sorted(maps.Keys(originalCwl.Steps)) {
+			step := originalCwl.Steps[id]
 			if s, ok := step.Run.(string); ok {
 				workflowHasPart = append(workflowHasPart, IDRef{s})
 				logger.Debug("Detected sub-workflow step:", s)
@@ -124,12 +127,12 @@ func addWorkflowToRoCrate(rocrate *[]any, wf string, originalCwl cwl.Cwl) error
 	var workflowInputs []IDRef
 	workflowOutputsMap := make(map[string]string)
 	var workflowOutputs []IDRef
-	for s := range originalCwl.Inputs {
+	for _, s := range slices.Sorted(maps.Keys(originalCwl.Inputs)) {
 		workflowInputsMap[s] = "#" + s + "->" + wf
 		workflowInputs = append(workflowInputs, IDRef{workflowInputsMap[s]})
 		logger.Debug("Mapping input dataset", s, "to", workflowInputsMap[s])
 	}
-	for s := range originalCwl.Outputs {
+	for _, s := range slices.Sorted(maps.Keys(originalCwl.Outputs)) {
 		workflowOutputsMap[s] = "#" + wf + "->" + s
 		workflowOutputs = append(workflowOutputs, IDRef{workflowOutputsMap[s]})
 		logger.Debug("Mapping output dataset", s, "to", workflowOutputsMap[s])
@@ -147,7 +150,8 @@ func addWorkflowToRoCrate(rocrate *[]any, wf string, originalCwl cwl.Cwl) error
 	logger.Info("ComputationalWorkflowFile item added for workflow", wf)
 
 	// Add formal parameters for each input and output.
-	for id, param := range workflowInputsMap {
+	for _, id := range slices.Sorted(maps.Keys(workflowInputsMap)) {
+		param := workflowInputsMap[id]
 		if parameterExists(*rocrate, param) {
 			logger.Debug("Formal parameter", param, "already exists. Skipping.")
 			continue
@@ -164,7 +168,8 @@ func addWorkflowToRoCrate(rocrate *[]any, wf string, originalCwl cwl.Cwl) error
 		})
 		logger.Debug("Added formal parameter for input", id)
 	}
-	for id, param := range workflowOutputsMap {
+	for _, id := range slices.Sorted(maps.Keys(workflowOutputsMap)) {
+		param := workflowOutputsMap[id]
 		if parameterExists(*rocrate, param) {
 			logger.Debug("Formal parameter", param, "already exists. Skipping.")
 			continue
@@ -183,7 +188,8 @@ func addWorkflowToRoCrate(rocrate *[]any, wf string, originalCwl cwl.Cwl) error
 	}
 
 	// Add a SoftwareSourceCode item for each step.
-	for id, step := range originalCwl.Steps {
+	for _, id := range slices.Sorted(maps.Keys(originalCwl.Steps)) {
+		step := originalCwl.Steps[id]
 		if sw, ok := step.Run.(string); ok {
 			logger.Info("Processing sub-workflow step", id, "with CWL file", sw)
 			subWorkflowCwl, err := cwl.ImportCWL(sw)
@@ -262,20 +268,14 @@ func getAllDTs(cwlObj cwl.Cwl) []string {
 	for dt := range cwlObj.Outputs {
 		dts[dt] = true
 	}
-	datasets := make([]string, 0, len(dts))
-	for k := range dts {
-		datasets = append(datasets, k)
-	}
+	datasets := slices.Sorted(maps.Keys(dts))
 	logger.Debug("Collected", len(datasets), "datasets from CWL")
 	return datasets
 }
 
 // getAllSTs returns a list of all step IDs in the CWL.
 func getAllSTs(cwlObj cwl.Cwl) []string {
-	sts := make([]string, 0, len(cwlObj.Steps))
-	for k := range cwlObj.Steps {
-		sts = append(sts, k)
-	}
+	sts := slices.Sorted(maps.Keys(cwlObj.Steps))
 	logger.Debug("Collected", len(sts), "steps from CWL")
 	return sts
 }
@@ -75,6 +75,7 @@ type SoftwareSourceCode struct {
 	License             string `json:"license"`
 	ProgrammingLanguage string `json:"programmingLanguage"`
 	Url                 string `json:"url,omitempty"`
+	Identifier          string `json:"identifier,omitempty"`
 	// SoftwareVersion string `json:"softwareVersion"`
 }
 
@@ -84,11 +85,25 @@ type DatasetDetails struct {
 	Name     string `json:"name"`
 	Abstract string `json:"abstract,omitempty"`
 	URL      string `json:"url"`
+	// EncodingFormat, License and Identifier come from dt.csv, when provided.
+	EncodingFormat string `json:"encodingFormat,omitempty"`
+	License        string `json:"license,omitempty"`
+	Identifier     string `json:"identifier,omitempty"`
 	// need to be a pointer to make omitempty work correctly
 	Author        *IDRef `json:"author,omitempty"`
 	ExampleOfWork *IDRef `json:"exampleOfWork,omitempty"`
 }
 
+// Crate refers to another RO-Crate, such as the crate of a component workflow.
+type Crate struct {
+	ID          string `json:"@id"`
+	Type        string `json:"@type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	ConformsTo  IDRef  `json:"conformsTo"`
+	SubjectOf   IDRef  `json:"subjectOf"`
+}
+
 type Person struct {
 	ID          string `json:"@id"`
 	Type        string `json:"@type"`
@@ -106,8 +121,13 @@ type IDRef struct {
 	ID string `json:"@id,omitempty"`
 }
 
+// Marshal returns the indented JSON document of the RO-Crate metadata.
+func (r RoCrate) Marshal() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
 func (r RoCrate) SaveToFile(name string) error {
-	v, err := json.MarshalIndent(r, "", "  ")
+	v, err := r.Marshal()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,184 @@
+package vocabulary
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	_ "embed"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kind is the canonical meaning of a relationship, independent of how it was
+// spelled in the spreadsheets. Relationships are stored and converted by kind only.
+type Kind string
+
+const (
+	// Input: id1 is consumed by id2.
+	Input Kind = "input"
+	// Output: id1 is produced by id2.
+	Output Kind = "output"
+	// Update: id1 is modified in place by id2.
+	Update Kind = "update"
+	// PartOf: id1 is a component of id2.
+	PartOf Kind = "part_of"
+	// Precedes: id1 comes before id2.
+	Precedes Kind = "precedes"
+	// ParentOf: id1 contains id2.
+	ParentOf Kind = "parent_of"
+	// Manages: id1 orchestrates id2.
+	Manages Kind = "manages"
+	// Parallel: id1 runs at the same time as id2.
+	Parallel Kind = "parallel"
+	// NewVersionOf: id1 supersedes id2.
+	NewVersionOf Kind = "new_version_of"
+)
+
+// phrases holds the canonical spreadsheet text of every kind.
+var phrases = map[Kind]string{
+	Input:        "is input to",
+	Output:       "is output from",
+	Update:       "is updated by",
+	PartOf:       "is part of",
+	Precedes:     "is previous to",
+	ParentOf:     "is parent of",
+	Manages:      "manages",
+	Parallel:     "is parallel to",
+	NewVersionOf: "is a new version of",
+}
+
+// Phrase returns the canonical text of the kind, as written back to spreadsheets.
+func (k Kind) Phrase() string {
+	if p, ok := phrases[k]; ok {
+		return p
+	}
+	return string(k)
+}
+
+// Term is the canonical form of a relationship alias.
+type Term struct {
+	Kind Kind
+	// Reverse is set when the alias reads in the opposite direction of Kind,
+	// i.e. the two IDs must be swapped.
+	Reverse bool
+}
+
+// Vocabulary maps, for each relationship table, normalized aliases to their terms.
+type Vocabulary struct {
+	tables map[string]map[string]Term
+}
+
+// file is the YAML representation of a vocabulary.
+type file struct {
+	Tables map[string][]entry `yaml:"tables"`
+}
+
+type entry struct {
+	Kind    Kind     `yaml:"kind"`
+	Reverse bool     `yaml:"reverse"`
+	Aliases []string `yaml:"aliases"`
+}
+
+//go:embed default.yaml
+var defaultVocabulary []byte
+
+// Default returns the built-in vocabulary.
+func Default() *Vocabulary {
+	v := &Vocabulary{tables: make(map[string]map[string]Term)}
+	if err := v.merge(defaultVocabulary); err != nil {
+		panic(fmt.Sprintf("invalid built-in vocabulary: %v", err))
+	}
+	return v
+}
+
+// Load returns the built-in vocabulary extended with the definitions of the YAML
+// file at path. Aliases defined in the file take precedence over the built-in ones.
+// An empty path returns the built-in vocabulary.
+func Load(path string) (*Vocabulary, error) {
+	v := Default()
+	if path == "" {
+		return v, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vocabulary file: %w", err)
+	}
+	if err := v.merge(data); err != nil {
+		return nil, fmt.Errorf("invalid vocabulary file %s: %w", path, err)
+	}
+	return v, nil
+}
+
+// merge validates a YAML vocabulary and adds its aliases to v.
+func (v *Vocabulary) merge(data []byte) error {
+	var f file
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return err
+	}
+
+	for table, entries := range f.Tables {
+		table = strings.ToUpper(strings.TrimSpace(table))
+		if !isRelationshipTable(table) {
+			return fmt.Errorf("unknown relationship table %q", table)
+		}
+		terms, ok := v.tables[table]
+		if !ok {
+			terms = make(map[string]Term)
+			v.tables[table] = terms
+		}
+		for _, e := range entries {
+			if _, ok := phrases[e.Kind]; !ok {
+				return fmt.Errorf("unknown relationship kind %q in table %s", e.Kind, table)
+			}
+			if len(e.Aliases) == 0 {
+				return fmt.Errorf("kind %q in table %s has no aliases", e.Kind, table)
+			}
+			// Swapping the IDs of a table with different types on each side would put
+			// them in the wrong columns.
+			if e.Reverse && !isSymmetricTable(table) {
+				return fmt.Errorf("kind %q in table %s cannot be reversed, the table relates different types", e.Kind, table)
+			}
+			for _, alias := range e.Aliases {
+				terms[Normalize(alias)] = Term{Kind: e.Kind, Reverse: e.Reverse}
+			}
+			// The kind name and its phrase always resolve to the canonical direction.
+			for _, alias := range []string{string(e.Kind), e.Kind.Phrase()} {
+				if _, exists := terms[Normalize(alias)]; !exists {
+					terms[Normalize(alias)] = Term{Kind: e.Kind}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Lookup returns the term for a relationship text found in the given table.
+func (v *Vocabulary) Lookup(table, text string) (Term, bool) {
+	term, ok := v.tables[table][Normalize(text)]
+	return term, ok
+}
+
+// Normalize lowercases a relationship text and collapses its whitespace, so that
+// "is part of " and "Is  part of" are the same alias.
+func Normalize(text string) string {
+	return strings.ToLower(strings.Join(strings.Fields(text), " "))
+}
+
+// isSymmetricTable tells whether a relationship table has the same type on both sides.
+func isSymmetricTable(table string) bool {
+	switch table {
+	case "WF_WF", "ST_ST", "SS_SS", "DT_DT":
+		return true
+	}
+	return false
+}
+
+func isRelationshipTable(table string) bool {
+	switch table {
+	case "WF_WF", "ST_WF", "ST_ST", "SS_ST", "SS_SS", "DT_ST", "DT_SS", "DT_DT":
+		return true
+	}
+	return false
+}
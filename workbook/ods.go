@@ -0,0 +1,153 @@
+package workbook
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// OpenDocument namespaces of the elements read from content.xml.
+const (
+	odsTableNS = "urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+	odsTextNS  = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+)
+
+// odsReader walks content.xml and collects the text of the cells of every table.
+// Repeated rows and columns are expanded, except for the empty ones that trail a
+// table or a row, which spreadsheet applications write to fill the whole grid.
+type odsReader struct {
+	sheets []Sheet
+	sheet  *Sheet
+
+	row, col             int
+	rowRepeat, colRepeat int
+	rowHasText           bool
+	cell                 strings.Builder
+	inCell, inParagraph  bool
+	paragraphs           int
+}
+
+// readODS reads the tables of an OpenDocument spreadsheet.
+func readODS(r *zip.Reader) ([]Sheet, error) {
+	data, err := openFile(r, "content.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	o := &odsReader{}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid content.xml: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			o.start(t)
+		case xml.EndElement:
+			o.end(t)
+		case xml.CharData:
+			if o.inParagraph {
+				o.cell.Write(t)
+			}
+		}
+	}
+	if o.sheet != nil {
+		return nil, fmt.Errorf("invalid content.xml: unterminated table %q", o.sheet.Name)
+	}
+	return o.sheets, nil
+}
+
+func (o *odsReader) start(t xml.StartElement) {
+	switch {
+	case t.Name.Space == odsTableNS && t.Name.Local == "table":
+		o.sheet = &Sheet{Name: attr(t, odsTableNS, "name")}
+		o.row = 0
+	case o.sheet == nil:
+		return
+	case t.Name.Space == odsTableNS && t.Name.Local == "table-row":
+		o.col = 0
+		o.rowRepeat = repeat(t, "number-rows-repeated")
+		o.rowHasText = false
+	case t.Name.Space == odsTableNS && (t.Name.Local == "table-cell" || t.Name.Local == "covered-table-cell"):
+		o.inCell = true
+		o.cell.Reset()
+		o.paragraphs = 0
+		o.colRepeat = repeat(t, "number-columns-repeated")
+	case !o.inCell:
+		return
+	case t.Name.Space == odsTextNS && t.Name.Local == "p":
+		if o.paragraphs > 0 {
+			o.cell.WriteString("\n")
+		}
+		o.paragraphs++
+		o.inParagraph = true
+	case t.Name.Space == odsTextNS && t.Name.Local == "s":
+		o.cell.WriteString(strings.Repeat(" ", repeat(t, "c")))
+	case t.Name.Space == odsTextNS && t.Name.Local == "tab":
+		o.cell.WriteString("\t")
+	case t.Name.Space == odsTextNS && t.Name.Local == "line-break":
+		o.cell.WriteString("\n")
+	}
+}
+
+func (o *odsReader) end(t xml.EndElement) {
+	if o.sheet == nil {
+		return
+	}
+	switch {
+	case t.Name.Space == odsTableNS && t.Name.Local == "table":
+		o.sheets = append(o.sheets, *o.sheet)
+		o.sheet = nil
+	case t.Name.Space == odsTableNS && t.Name.Local == "table-row":
+		if o.rowHasText {
+			// Copy the row to its repetitions.
+			for i := 1; i < o.rowRepeat; i++ {
+				o.sheet.Rows = setCell(o.sheet.Rows, o.row+i, 0, "")
+				o.sheet.Rows[o.row+i] = append([]string(nil), o.sheet.Rows[o.row]...)
+			}
+		}
+		o.row += o.rowRepeat
+	case t.Name.Space == odsTableNS && (t.Name.Local == "table-cell" || t.Name.Local == "covered-table-cell"):
+		if value := o.cell.String(); value != "" {
+			for i := 0; i < o.colRepeat; i++ {
+				o.sheet.Rows = setCell(o.sheet.Rows, o.row, o.col+i, value)
+			}
+			o.rowHasText = true
+		}
+		o.col += o.colRepeat
+		o.inCell = false
+	case t.Name.Space == odsTextNS && t.Name.Local == "p":
+		o.inParagraph = false
+	}
+}
+
+// attr returns the value of a namespaced attribute.
+func attr(t xml.StartElement, space, local string) string {
+	for _, a := range t.Attr {
+		if a.Name.Space == space && a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// repeat returns the repetition count stored in a table or text attribute, 1 by default.
+func repeat(t xml.StartElement, local string) int {
+	for _, a := range t.Attr {
+		if a.Name.Local == local {
+			if n, err := strconv.Atoi(a.Value); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return 1
+}
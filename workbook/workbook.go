@@ -0,0 +1,74 @@
+// Package workbook reads the tabs of .xlsx and .ods spreadsheet files as rows of
+// cell text, so that they can be imported like their CSV exports.
+package workbook
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Sheet is a tab of a workbook. Rows holds the text of its cells; Rows[i] is the
+// spreadsheet row i+1, empty rows included, so that row numbers match the ones
+// shown by spreadsheet applications.
+type Sheet struct {
+	Name string
+	Rows [][]string
+}
+
+// Read returns the tabs of the .xlsx or .ods file at path, in workbook order.
+func Read(path string) ([]Sheet, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open workbook %s: %w", path, err)
+	}
+	defer r.Close()
+
+	var sheets []Sheet
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".xlsx":
+		sheets, err = readXLSX(&r.Reader)
+	case ".ods":
+		sheets, err = readODS(&r.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported workbook format %q, expected .xlsx or .ods", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workbook %s: %w", path, err)
+	}
+	return sheets, nil
+}
+
+// Find returns the sheet with the given name, ignoring case and surrounding spaces.
+func Find(sheets []Sheet, name string) (Sheet, bool) {
+	for _, sheet := range sheets {
+		if strings.EqualFold(strings.TrimSpace(sheet.Name), name) {
+			return sheet, true
+		}
+	}
+	return Sheet{}, false
+}
+
+// openFile returns the content of a file of the archive.
+func openFile(r *zip.Reader, name string) ([]byte, error) {
+	f, err := r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// setCell stores value at the given 0-based row and column, growing rows as needed.
+func setCell(rows [][]string, row, col int, value string) [][]string {
+	for len(rows) <= row {
+		rows = append(rows, nil)
+	}
+	for len(rows[row]) <= col {
+		rows[row] = append(rows[row], "")
+	}
+	rows[row][col] = value
+	return rows
+}
@@ -0,0 +1,155 @@
+package workbook
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Office Open XML parts used to locate the worksheets of a workbook.
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxText is a string item, either plain or made of rich text runs.
+type xlsxText struct {
+	T string `xml:"t"`
+	R []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	s := t.T
+	for _, r := range t.R {
+		s += r.T
+	}
+	return s
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxWorksheet struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			Ref    string   `xml:"r,attr"`
+			Type   string   `xml:"t,attr"`
+			Value  string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSX reads the worksheets of an Office Open XML workbook.
+func readXLSX(r *zip.Reader) ([]Sheet, error) {
+	var wb xlsxWorkbook
+	if err := unmarshalFile(r, "xl/workbook.xml", &wb); err != nil {
+		return nil, err
+	}
+	var rels xlsxRelationships
+	if err := unmarshalFile(r, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	targets := make(map[string]string, len(rels.Relationships))
+	for _, rel := range rels.Relationships {
+		if strings.HasPrefix(rel.Target, "/") {
+			targets[rel.ID] = strings.TrimPrefix(rel.Target, "/")
+		} else {
+			targets[rel.ID] = path.Join("xl", rel.Target)
+		}
+	}
+
+	// Workbooks without any text cell have no shared strings.
+	var shared xlsxSharedStrings
+	if _, err := fs.Stat(r, "xl/sharedStrings.xml"); err == nil {
+		if err := unmarshalFile(r, "xl/sharedStrings.xml", &shared); err != nil {
+			return nil, err
+		}
+	}
+
+	sheets := make([]Sheet, 0, len(wb.Sheets))
+	for _, s := range wb.Sheets {
+		target, ok := targets[s.RID]
+		if !ok {
+			return nil, fmt.Errorf("sheet %q has no worksheet", s.Name)
+		}
+		var ws xlsxWorksheet
+		if err := unmarshalFile(r, target, &ws); err != nil {
+			return nil, err
+		}
+
+		sheet := Sheet{Name: s.Name}
+		for i, row := range ws.Rows {
+			rowIndex := i
+			if row.R > 0 {
+				rowIndex = row.R - 1
+			}
+			for j, c := range row.Cells {
+				col := j
+				if index := columnIndex(c.Ref); index >= 0 {
+					col = index
+				}
+				var value string
+				switch c.Type {
+				case "s":
+					n, err := strconv.Atoi(c.Value)
+					if err != nil || n < 0 || n >= len(shared.Items) {
+						return nil, fmt.Errorf("sheet %q: invalid shared string %q in cell %s", s.Name, c.Value, c.Ref)
+					}
+					value = shared.Items[n].String()
+				case "inlineStr":
+					value = c.Inline.String()
+				default:
+					value = c.Value
+				}
+				if value != "" {
+					sheet.Rows = setCell(sheet.Rows, rowIndex, col, value)
+				}
+			}
+		}
+		sheets = append(sheets, sheet)
+	}
+	return sheets, nil
+}
+
+// columnIndex returns the 0-based column of a cell reference such as "AB12", or -1
+// when the reference is missing.
+func columnIndex(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+	}
+	return col - 1
+}
+
+func unmarshalFile(r *zip.Reader, name string, v any) error {
+	data, err := openFile(r, name)
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return nil
+}